@@ -2,17 +2,19 @@ package ai
 
 import (
 	"context"
-	"strconv"
+	"encoding/json"
+	"net/http"
 	"strings"
-	"sync"
-	"time"
+	"text/template"
+
+	"github.com/cmingxu/mpu/model"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	openai "github.com/sashabaranov/go-openai"
 )
 
-const WordCountPerSecond = 6 // 每秒生成的字数
+const WordCountPerSecond = model.BaseWordsPerSecond // 每秒生成的字数
 
 const SystemPrompt = `
 You are a video script generator. Your task is to generate video title, video subtitle in chinese, translation subtitle into english, 
@@ -21,8 +23,8 @@ and generate image generation prompt for each subtitle based on the provided use
 you can extend the idea with conversational text / short story to refflect the idea / old chinese saying to reflect the idea.
 
 response should be in chinese, total chinese characters response size should around {{.WordCount}}. then you have to cut response into sequence of
-subtitle, with each subtitle translated into english. each subtitle should be between 10 to 28 characters in chinese,
-and the english translation should not exceeding 14 words.
+subtitle, with each subtitle translated into english. each subtitle should be between {{.MinSubtitleChars}} to {{.MaxSubtitleChars}} characters in chinese,
+and the english translation should not exceeding {{.MaxSubtitleWords}} words.
 The main language of the script is Chinese, with English translation provided for each subtitle.
 
 ## Title requirements:
@@ -37,7 +39,7 @@ The main language of the script is Chinese, with English translation provided fo
 ## image generation prompt requirements:
 1, image generation prompt should be in chinese, and should be descriptive enough for image generation.
 2, the target image should be related to the subtitle.
-3, the porompt must contain 火柴人，矢量图，黑白图标风格，简约，透明底色，线条粗细适中，线条清晰，线条流畅, 线条简洁, 线条不交叉, 线条不重叠, 线条不模糊, 线条不粗糙, 线条不复杂, 线条不花哨, 线条不夸张, 线条不浮夸, 线条不繁琐, 线条不冗余.
+3, describe what the image shows only, the drawing style is added by the template.
 
 ## response
 1, response should be a json object with title and script_items, script_items field is an array of objects, each object should contain cn, en, image_prompt fields.
@@ -51,24 +53,24 @@ response with "ERROR[actual_message]" if you can not generage a result, where th
 {"title":"视频标题","script_items":[{"cn":"中文字幕","en":"English Subtitle","image_prompt":""},{"cn":"中文字幕","en":"English Subtitle","image_prompt":""}]}
 `
 
-var (
-	instance *Client
-	once     sync.Once
+// Structured output modes of script models, without one the model is only
+// asked by the prompt to answer json.
+const (
+	StructuredOutputNone       = ""
+	StructuredOutputJSONSchema = "json_schema" // response_format json_schema
+	StructuredOutputTools      = "tools"       // a forced function call
 )
 
-type Client struct {
-	endpoint string         // API endpoint
-	key      string         // API key
-	model    string         // Model name
-	client   *openai.Client // OpenAI client
-}
-
-func GetClient() *Client {
-	if instance == nil {
-		panic("instance already created, use GetClient() to get the instance")
-	}
+// scriptFunctionName is the function models in tools mode call with the
+// script.
+const scriptFunctionName = "save_script"
 
-	return instance
+type Client struct {
+	endpoint   string         // API endpoint
+	key        string         // API key
+	model      string         // Model name
+	structured string         // Structured output mode
+	client     *openai.Client // OpenAI client
 }
 
 func NewClient(model, key, endpoint string) *Client {
@@ -78,25 +80,141 @@ func NewClient(model, key, endpoint string) *Client {
 		endpoint: endpoint,
 	}
 
+	c.setHTTPClient(nil)
+	return c
+}
+
+// setHTTPClient rebuilds the openai client on hc, nil is the default
+// client.
+func (c *Client) setHTTPClient(hc *http.Client) {
 	config := openai.DefaultConfig(c.key)
-	config.BaseURL = c.endpoint
+	if c.endpoint != "" {
+		config.BaseURL = c.endpoint
+	}
+	if hc != nil {
+		config.HTTPClient = hc
+	}
 	c.client = openai.NewClientWithConfig(config)
+}
+
+func (c *Client) Model() string {
+	return c.model
+}
 
-	instance = c
+// WithModel returns a client of the same endpoint running model.
+func (c *Client) WithModel(model string) ScriptGenerator {
+	cc := *c
+	cc.model = model
+	return &cc
+}
 
-	return c
+// SetStructuredOutput selects how the model is held to the script schema,
+// mode is one of the StructuredOutput constants.
+func (c *Client) SetStructuredOutput(mode string) error {
+	switch mode {
+	case StructuredOutputNone, StructuredOutputJSONSchema, StructuredOutputTools:
+		c.structured = mode
+		return nil
+	}
+
+	return errors.Errorf("unknown structured output %q, expected %s or %s",
+		mode, StructuredOutputJSONSchema, StructuredOutputTools)
 }
 
-func (c *Client) GenerateScript(ctx context.Context, prompt string,
-	d time.Duration) (string, error) {
-	log.Info().Msgf("Generating script with prompt: %s, expect duration: %s", prompt, d)
+// applyStructuredOutput asks for the script schema in the way the model
+// supports.
+func (c *Client) applyStructuredOutput(req *openai.ChatCompletionRequest) error {
+	if c.structured == StructuredOutputNone {
+		return nil
+	}
+
+	schema, err := model.ScriptSchema()
+	if err != nil {
+		return err
+	}
+	// the $schema keyword is not accepted by every provider
+	bare := *schema
+	bare.Schema = ""
+	raw, err := json.Marshal(&bare)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal script schema")
+	}
+
+	switch c.structured {
+	case StructuredOutputJSONSchema:
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "movie_script",
+				Schema: json.RawMessage(raw),
+				Strict: true,
+			},
+		}
+	case StructuredOutputTools:
+		req.Tools = []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        scriptFunctionName,
+				Description: "Save the generated video script",
+				Parameters:  json.RawMessage(raw),
+				Strict:      true,
+			},
+		}}
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: scriptFunctionName},
+		}
+	}
+
+	return nil
+}
+
+var systemPromptTemplate = template.Must(template.New("system").Parse(SystemPrompt))
+
+// BuildSystemPrompt fills the system prompt of r in, SystemPrompt when r
+// brings none. Prompts are text/templates of the request, e.g.
+// {{.WordCount}} or {{.Idea}}, limits r leaves zero keep the defaults.
+func BuildSystemPrompt(r ScriptRequest) (string, error) {
+	tpl := systemPromptTemplate
+	if r.SystemPrompt != "" {
+		var err error
+		if tpl, err = template.New("system").Parse(r.SystemPrompt); err != nil {
+			return "", errors.Wrap(err, "invalid system prompt")
+		}
+	}
+
+	var buf strings.Builder
+	if err := tpl.Execute(&buf, r.withDefaults()); err != nil {
+		return "", errors.Wrap(err, "failed to build system prompt")
+	}
+
+	return buf.String(), nil
+}
+
+// RetryPrompt asks the model to fix the violations of its last answer.
+func RetryPrompt(violations []string) string {
+	var b strings.Builder
+	b.WriteString("你的回答违反了以下规则：\n")
+	for _, v := range violations {
+		b.WriteString("- " + v + "\n")
+	}
+	b.WriteString("请修正这些问题，并重新输出完整的 JSON，不要输出其他内容。")
+
+	return b.String()
+}
+
+func (c *Client) GenerateScript(ctx context.Context, r ScriptRequest) (string, error) {
+	prompt := r.Idea
+	log.Info().Msgf("Generating script with prompt: %s, expect duration: %s", prompt, r.Duration)
 
 	req := openai.ChatCompletionRequest{
 		Model: c.model,
 	}
 
-	calculatedWordCount := int(d.Seconds() * WordCountPerSecond)
-	systemPromptWithWordCount := strings.ReplaceAll(SystemPrompt, "{{.WordCount}}", strconv.Itoa(calculatedWordCount))
+	systemPromptWithWordCount, err := BuildSystemPrompt(r)
+	if err != nil {
+		return "", err
+	}
 	req.Messages = []openai.ChatCompletionMessage{
 		{
 			Role:    openai.ChatMessageRoleSystem,
@@ -107,17 +225,49 @@ func (c *Client) GenerateScript(ctx context.Context, prompt string,
 			Content: prompt,
 		},
 	}
+	if r.Previous != "" {
+		req.Messages = append(req.Messages,
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: r.Previous,
+			},
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: RetryPrompt(r.Violations),
+			},
+		)
+	}
+
+	if err := c.applyStructuredOutput(&req); err != nil {
+		return "", err
+	}
 
 	resp, err := c.client.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return "", err
 	}
+	addUsage(ctx, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
+	if len(resp.Choices) == 0 {
+		return "", errors.New("model returned no choices")
+	}
 
 	log.Info().Msgf("SystemPrompt: %s", systemPromptWithWordCount)
 	log.Info().Msgf("user prompt: %s", prompt)
-	log.Info().Msgf("Received response: %s", resp.Choices[0].Message.Content)
+	msg := resp.Choices[0].Message
+	if msg.Refusal != "" {
+		return "", errors.Errorf("model refused: %s", msg.Refusal)
+	}
+
+	content := msg.Content
+	for _, call := range msg.ToolCalls {
+		if call.Function.Name == scriptFunctionName {
+			content = call.Function.Arguments
+		}
+	}
+
+	log.Info().Msgf("Received response: %s", content)
 
-	content := resp.Choices[0].Message.Content
 	if strings.HasPrefix(content, "ERROR[") {
 		matched := strings.TrimPrefix(content, "ERROR[")
 		matched = strings.TrimSuffix(matched, "]")
@@ -127,3 +277,28 @@ func (c *Client) GenerateScript(ctx context.Context, prompt string,
 
 	return content, nil
 }
+
+// Complete answers one system and user prompt, it is what the staged
+// script pipeline runs on.
+func (c *Client) Complete(ctx context.Context, system, prompt string) (string, error) {
+	resp, err := c.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: c.model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: system},
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	addUsage(ctx, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
+	if len(resp.Choices) == 0 {
+		return "", errors.New("model returned no choices")
+	}
+
+	content := resp.Choices[0].Message.Content
+	log.Info().Msgf("Received response: %s", content)
+
+	return content, nil
+}
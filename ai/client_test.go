@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildSystemPrompt(t *testing.T) {
+	prompt, err := BuildSystemPrompt(ScriptRequest{
+		Duration:         time.Minute,
+		WordsPerSecond:   7.2,
+		MaxSubtitleChars: 16,
+		MaxSubtitleWords: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"should around 432.",
+		"between 10 to 16 characters in chinese",
+		"should not exceeding 10 words",
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Fatalf("prompt misses %q:\n%s", want, prompt)
+		}
+	}
+}
+
+func TestStructuredOutput(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		msg := map[string]interface{}{"role": "assistant", "content": validScript}
+		if _, ok := body["tools"]; ok {
+			msg = map[string]interface{}{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{
+				"id": "call_1", "type": "function",
+				"function": map[string]interface{}{"name": scriptFunctionName, "arguments": validScript},
+			}}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"choices": []interface{}{map[string]interface{}{"message": msg}}})
+	}))
+	defer srv.Close()
+
+	for _, mode := range []string{StructuredOutputNone, StructuredOutputJSONSchema, StructuredOutputTools} {
+		c := NewClient("gpt", "key", srv.URL)
+		if err := c.SetStructuredOutput(mode); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := c.GenerateScript(context.Background(), ScriptRequest{Idea: "金牛座", Duration: time.Minute})
+		if err != nil || out != validScript {
+			t.Fatalf("%q: unexpected answer %q, %v", mode, out, err)
+		}
+
+		var schema interface{}
+		switch mode {
+		case StructuredOutputJSONSchema:
+			schema = body["response_format"].(map[string]interface{})["json_schema"].(map[string]interface{})["schema"]
+		case StructuredOutputTools:
+			schema = body["tools"].([]interface{})[0].(map[string]interface{})["function"].(map[string]interface{})["parameters"]
+		default:
+			if body["response_format"] != nil || body["tools"] != nil {
+				t.Fatalf("plain mode should not ask for structured output: %v", body)
+			}
+			continue
+		}
+
+		raw, _ := json.Marshal(schema)
+		item := `"required":["cn","en","image_prompt"]`
+		if !strings.Contains(string(raw), item) || strings.Contains(string(raw), "voice_path") || strings.Contains(string(raw), "$schema") {
+			t.Fatalf("%q: unexpected script schema %s", mode, raw)
+		}
+	}
+
+	if err := NewClient("gpt", "key", srv.URL).SetStructuredOutput("xml"); err == nil {
+		t.Fatal("unknown structured output should fail")
+	}
+}
+
+func TestScriptChain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		content := validScript
+		if body.Model == "primary" {
+			content = "ERROR[content policy]"
+		}
+		msg := map[string]interface{}{"role": "assistant", "content": content}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": msg}},
+			"usage":   map[string]interface{}{"prompt_tokens": 100, "completion_tokens": 20},
+		})
+	}))
+	defer srv.Close()
+
+	r := NewRegistry()
+	var calls []*Call
+	r.SetRecorder(func(call *Call) { calls = append(calls, call) })
+	if err := r.Register(ProviderConfig{Name: "hosted", Type: "openai", Model: "primary", Endpoint: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetDefault(KindScript, "hosted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetScriptFallbacks([]ScriptLink{ParseScriptLink("hosted/Qwen/Qwen2.5-7B")}); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := r.ScriptChain("")
+	if err != nil || len(chain.Links()) != 2 || chain.Links()[0].String() != "hosted/primary" {
+		t.Fatalf("unexpected chain %+v %v", chain, err)
+	}
+
+	req := ScriptRequest{Idea: "金牛座", Duration: time.Minute}
+	noWrap := func(g ScriptGenerator) ScriptGenerator { return g }
+	out, link, err := chain.GenerateScript(context.Background(), req, noWrap)
+	if err != nil || out != validScript || link.String() != "hosted/Qwen/Qwen2.5-7B" {
+		t.Fatalf("the refusal should fall back to the second model, got %q %s %v", out, link, err)
+	}
+
+	if len(calls) != 2 || calls[0].Err == nil || calls[0].Model != "primary" || calls[1].Err != nil ||
+		calls[1].Model != "Qwen/Qwen2.5-7B" || calls[1].PromptTokens != 100 || calls[1].CompletionTokens != 20 {
+		t.Fatalf("every model of the chain should be metered: %+v", calls)
+	}
+
+	if err := r.SetScriptFallbacks([]ScriptLink{{Provider: "missing"}}); err == nil {
+		t.Fatal("fallbacks to unknown providers should be rejected")
+	}
+}
@@ -0,0 +1,219 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// FakeProvider is the name the fake providers are registered under.
+const FakeProvider = "fake"
+
+// Fake implements ScriptGenerator, ScriptStager, SpeechSynthesizer and
+// ImageGenerator without any network access. Results only depend on the
+// input, so local development and tests get the same movie every time.
+type Fake struct{}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+func init() {
+	RegisterFactory(FakeProvider, func(cfg ProviderConfig) (interface{}, error) {
+		return NewFake(), nil
+	})
+}
+
+var fakeScript = model.MovieScript{
+	Title: "星座小知识",
+	ScriptItems: []*model.ScriptItem{
+		{
+			ZhSubtitle:  "金牛座的人做事踏实稳重",
+			EnSubtitle:  "taurus people are steady and reliable",
+			ImagePrompt: "火柴人，矢量图，黑白图标风格，简约，一个人稳稳地搬着箱子",
+		},
+		{
+			ZhSubtitle:  "她们热爱美食也懂得享受生活",
+			EnSubtitle:  "they love good food and enjoy life",
+			ImagePrompt: "火柴人，矢量图，黑白图标风格，简约，一个人坐在餐桌前吃饭",
+		},
+		{
+			ZhSubtitle:  "认定的事情就会坚持到底",
+			EnSubtitle:  "once decided they never give up",
+			ImagePrompt: "火柴人，矢量图，黑白图标风格，简约，一个人攀登高山",
+		},
+		{
+			ZhSubtitle:  "真诚待人是她们最大的魅力",
+			EnSubtitle:  "sincerity is their greatest charm",
+			ImagePrompt: "火柴人，矢量图，黑白图标风格，简约，两个人握手微笑",
+		},
+	},
+}
+
+// GenerateScript returns the same canned script for every idea.
+func (f *Fake) GenerateScript(ctx context.Context, req ScriptRequest) (string, error) {
+	raw, err := json.Marshal(fakeScript)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal fake script")
+	}
+
+	return string(raw), nil
+}
+
+// RunScriptStage fills the artifacts of stage from the canned script.
+func (f *Fake) RunScriptStage(ctx context.Context, stage string, req ScriptRequest, a *model.ScriptArtifacts) error {
+	switch stage {
+	case model.ScriptStageOutline:
+		a.Title = fakeScript.Title
+		a.Outline = []string{"金牛座的性格", "金牛座的爱好", "金牛座的魅力"}
+	case model.ScriptStageDraft:
+		for _, item := range fakeScript.ScriptItems {
+			a.Draft += item.ZhSubtitle + "。"
+		}
+	case model.ScriptStageSegment:
+		a.Segments = nil
+		for _, item := range fakeScript.ScriptItems {
+			a.Segments = append(a.Segments, item.ZhSubtitle)
+		}
+	case model.ScriptStageTranslate:
+		a.Translations = nil
+		for i := range a.Segments {
+			a.Translations = append(a.Translations, fakeScript.ScriptItems[i%len(fakeScript.ScriptItems)].EnSubtitle)
+		}
+	case model.ScriptStageImagePrompts:
+		a.ImagePrompts = nil
+		for i := range a.Segments {
+			a.ImagePrompts = append(a.ImagePrompts, fakeScript.ScriptItems[i%len(fakeScript.ScriptItems)].ImagePrompt)
+		}
+	}
+
+	return nil
+}
+
+// MPEG-1 Layer III, 32kbps, 32kHz, mono, no padding. Every frame is 144
+// bytes and holds 1152 samples, all zero side info decodes as silence.
+var silentFrameHeader = []byte{0xFF, 0xFB, 0x18, 0xC0}
+
+const (
+	silentFrameSize     = 144
+	silentFrameDuration = time.Second * 1152 / 32000
+)
+
+// GenerateAudio returns a silent mp3 about as long as reading text aloud at
+// WordCountPerSecond times the speed would take.
+func (f *Fake) GenerateAudio(ctx context.Context, text string, opts SpeechOptions) ([]byte, error) {
+	d := time.Duration(float64(utf8.RuneCountInString(text)) * float64(time.Second) / (WordCountPerSecond * opts.speed()))
+	return SilentMp3(d), nil
+}
+
+// SilentMp3 builds a silent mp3 of at least d, and at least one frame.
+func SilentMp3(d time.Duration) []byte {
+	frames := int((d + silentFrameDuration - 1) / silentFrameDuration)
+	if frames < 1 {
+		frames = 1
+	}
+
+	buf := make([]byte, 0, frames*silentFrameSize)
+	frame := make([]byte, silentFrameSize)
+	copy(frame, silentFrameHeader)
+	for i := 0; i < frames; i++ {
+		buf = append(buf, frame...)
+	}
+
+	return buf
+}
+
+const (
+	fakeImageWidth  = 1280
+	fakeImageHeight = 720
+	fakeImageScale  = 2 // basicfont is tiny, draw small and scale up
+	fakeImageMargin = 4
+)
+
+// GenerateImage returns a placeholder png with the prompt written on it.
+func (f *Fake) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	w, h := fakeImageWidth/fakeImageScale, fakeImageHeight/fakeImageScale
+	canvas := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for x := 0; x < w; x++ {
+		canvas.SetGray(x, 0, color.Gray{})
+		canvas.SetGray(x, h-1, color.Gray{})
+	}
+	for y := 0; y < h; y++ {
+		canvas.SetGray(0, y, color.Gray{})
+		canvas.SetGray(w-1, y, color.Gray{})
+	}
+
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: canvas, Src: image.Black, Face: face}
+	lineHeight := face.Metrics().Height.Ceil()
+	x, y := fakeImageMargin, fakeImageMargin+face.Metrics().Ascent.Ceil()
+	for _, r := range prompt {
+		// characters basicfont does not know, like chinese, are written
+		// as their boxed code point so different prompts stay apart
+		label := string(r)
+		if _, ok := face.GlyphAdvance(r); !ok {
+			label = fmt.Sprintf("%04x", r)
+		}
+
+		width := len(label) * face.Advance
+		if r == '\n' || x+width > w-fakeImageMargin {
+			x, y = fakeImageMargin, y+lineHeight
+		}
+		if y > h-fakeImageMargin {
+			break
+		}
+
+		if r == '\n' {
+			continue
+		}
+
+		d.Dot = fixed.P(x, y)
+		d.DrawString(label)
+		if len(label) > 1 {
+			drawBox(canvas, x-1, y-face.Ascent-1, width+1, lineHeight)
+			width += face.Advance
+		}
+		x += width
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w*fakeImageScale, h*fakeImageScale))
+	for py := 0; py < img.Rect.Dy(); py++ {
+		for px := 0; px < img.Rect.Dx(); px++ {
+			img.SetGray(px, py, canvas.GrayAt(px/fakeImageScale, py/fakeImageScale))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, errors.Wrap(err, "failed to encode fake image")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func drawBox(img *image.Gray, x, y, w, h int) {
+	for i := 0; i < w; i++ {
+		img.SetGray(x+i, y, color.Gray{})
+		img.SetGray(x+i, y+h-1, color.Gray{})
+	}
+	for i := 0; i < h; i++ {
+		img.SetGray(x, y+i, color.Gray{})
+		img.SetGray(x+w-1, y+i, color.Gray{})
+	}
+}
@@ -0,0 +1,145 @@
+package ai
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ScriptLink is a step of the script fallback chain, a script provider and
+// the model it runs, empty for the model it was configured with.
+type ScriptLink struct {
+	Provider string
+	Model    string
+}
+
+// ParseScriptLink reads "provider" or "provider/model", model names may
+// contain slashes themselves.
+func ParseScriptLink(s string) ScriptLink {
+	provider, model, _ := strings.Cut(strings.TrimSpace(s), "/")
+	return ScriptLink{Provider: provider, Model: model}
+}
+
+func (l ScriptLink) String() string {
+	if l.Model == "" {
+		return l.Provider
+	}
+
+	return l.Provider + "/" + l.Model
+}
+
+// Modeler is a provider which tells the model it runs.
+type Modeler interface {
+	Model() string
+}
+
+// ModelSwitcher is a script provider which can run another model of the
+// same endpoint.
+type ModelSwitcher interface {
+	WithModel(model string) ScriptGenerator
+}
+
+// SetScriptFallbacks sets the chain of providers and models script
+// generation falls back to, in order, when the provider of a movie fails.
+func (r *Registry) SetScriptFallbacks(links []ScriptLink) error {
+	for _, link := range links {
+		g, err := r.scriptGenerator(link.Provider)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := g.(ModelSwitcher); link.Model != "" && !ok {
+			return errors.Errorf("script provider %s can not switch to model %s", link.Provider, link.Model)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallbacks = links
+	return nil
+}
+
+// ScriptChain is the script provider called name, or the default one when
+// name is empty, followed by the fallback chain.
+func (r *Registry) ScriptChain(name string) (*ScriptChain, error) {
+	links := []ScriptLink{{Provider: r.Resolve(KindScript, name)}}
+	r.mu.RLock()
+	links = append(links, r.fallbacks...)
+	r.mu.RUnlock()
+
+	chain := &ScriptChain{}
+	seen := map[string]bool{}
+	for _, link := range links {
+		g, err := r.scriptGenerator(link.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		if link.Model != "" {
+			g = g.(ModelSwitcher).WithModel(link.Model)
+		}
+
+		link.Model = ModelOf(g)
+		if seen[link.String()] {
+			continue
+		}
+		seen[link.String()] = true
+
+		chain.links = append(chain.links, link)
+		chain.generators = append(chain.generators, &meteredScript{r: r, g: g, link: link})
+	}
+
+	return chain, nil
+}
+
+// ModelOf is the model g runs, empty when it does not tell.
+func ModelOf(g interface{}) string {
+	if m, ok := g.(Modeler); ok {
+		return m.Model()
+	}
+
+	return ""
+}
+
+// ScriptChain tries its providers in order until one of them writes a
+// script.
+type ScriptChain struct {
+	links      []ScriptLink
+	generators []ScriptGenerator
+}
+
+// Links are the providers and models of the chain in order.
+func (c *ScriptChain) Links() []ScriptLink {
+	return c.links
+}
+
+// GenerateScript runs wrap around every provider of the chain in turn and
+// returns the first script along with the link which wrote it. Failures,
+// refusals and scripts wrap rejects all move on to the next link.
+func (c *ScriptChain) GenerateScript(ctx context.Context, req ScriptRequest,
+	wrap func(ScriptGenerator) ScriptGenerator) (string, ScriptLink, error) {
+	var failures []string
+	for i, g := range c.generators {
+		content, err := wrap(g).GenerateScript(ctx, req)
+		if err == nil {
+			return content, c.links[i], nil
+		}
+
+		if ctx.Err() != nil {
+			return "", ScriptLink{}, err
+		}
+
+		// a chain of one fails like the provider itself
+		if len(c.generators) == 1 {
+			return "", ScriptLink{}, err
+		}
+
+		log.Warn().Err(err).Msgf("Script model %s failed", c.links[i])
+		failures = append(failures, c.links[i].String()+": "+err.Error())
+	}
+
+	return "", ScriptLink{}, errors.Errorf("every script model failed: %s", strings.Join(failures, "; "))
+}
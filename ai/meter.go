@@ -0,0 +1,206 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cmingxu/mpu/model"
+)
+
+// NoItem tags calls which are not made for a single script item.
+const NoItem = -1
+
+// Call is one provider call as the registry meters it.
+type Call struct {
+	Kind       string
+	Provider   string
+	Model      string
+	MovieId    int64 // 0 when the call is not made for a movie
+	Item       int   // NoItem when the call is not made for a script item
+	PromptHash string
+	Latency    time.Duration
+	Err        error
+
+	PromptTokens     int // 对话模型的输入 token
+	CompletionTokens int // 对话模型的输出 token
+	Characters       int // 合成语音的字数
+	Images           int // 生成的图片数
+}
+
+// CallRecorder receives every metered provider call once it returned.
+type CallRecorder func(call *Call)
+
+type callTagsKey struct{}
+
+type callTags struct {
+	movieId int64
+	item    int
+}
+
+// WithCallTags marks the provider calls made with ctx as made for item of
+// movie, item is NoItem for calls about the whole movie.
+func WithCallTags(ctx context.Context, movieId int64, item int) context.Context {
+	return context.WithValue(ctx, callTagsKey{}, callTags{movieId: movieId, item: item})
+}
+
+type usageKey struct{}
+
+// Usage is what a provider reports it used for a call.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// addUsage adds the token usage of a response to the call metered with
+// ctx, if any.
+func addUsage(ctx context.Context, prompt, completion int) {
+	if u, ok := ctx.Value(usageKey{}).(*Usage); ok {
+		u.PromptTokens += prompt
+		u.CompletionTokens += completion
+	}
+}
+
+// SetRecorder makes every call of the providers handed out by the
+// registry reported to rec.
+func (r *Registry) SetRecorder(rec CallRecorder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.recorder = rec
+}
+
+// meter runs fn as the call described by call and reports it. Units are
+// only counted for successful calls.
+func (r *Registry) meter(ctx context.Context, call Call, hash string, fn func(ctx context.Context) error) error {
+	r.mu.RLock()
+	rec := r.recorder
+	r.mu.RUnlock()
+	if rec == nil {
+		return fn(ctx)
+	}
+
+	call.Item = NoItem
+	if tags, ok := ctx.Value(callTagsKey{}).(callTags); ok {
+		call.MovieId, call.Item = tags.movieId, tags.item
+	}
+	call.PromptHash = hash
+
+	var usage Usage
+	start := time.Now()
+	err := fn(context.WithValue(ctx, usageKey{}, &usage))
+	call.Latency, call.Err = time.Since(start), err
+	call.PromptTokens, call.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	if err != nil {
+		call.Characters, call.Images = 0, 0
+	}
+
+	rec(&call)
+	return err
+}
+
+// promptHash identifies the prompt of a call made of several parts.
+func promptHash(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+type meteredScript struct {
+	r    *Registry
+	g    ScriptGenerator
+	link ScriptLink
+}
+
+func (m *meteredScript) GenerateScript(ctx context.Context, req ScriptRequest) (content string, err error) {
+	call := Call{Kind: KindScript, Provider: m.link.Provider, Model: m.link.Model}
+	err = m.r.meter(ctx, call, promptHash(req.SystemPrompt, req.Idea, req.Previous), func(ctx context.Context) error {
+		content, err = m.g.GenerateScript(ctx, req)
+		return err
+	})
+	return content, err
+}
+
+func (m *meteredScript) Model() string {
+	return m.link.Model
+}
+
+type meteredCompleter struct {
+	r    *Registry
+	c    Completer
+	link ScriptLink
+}
+
+func (m *meteredCompleter) Complete(ctx context.Context, system, prompt string) (content string, err error) {
+	call := Call{Kind: KindScript, Provider: m.link.Provider, Model: m.link.Model}
+	err = m.r.meter(ctx, call, promptHash(system, prompt), func(ctx context.Context) error {
+		content, err = m.c.Complete(ctx, system, prompt)
+		return err
+	})
+	return content, err
+}
+
+func (m *meteredCompleter) Model() string {
+	return m.link.Model
+}
+
+type meteredStager struct {
+	r    *Registry
+	s    ScriptStager
+	link ScriptLink
+}
+
+func (m *meteredStager) RunScriptStage(ctx context.Context, stage string, req ScriptRequest, a *model.ScriptArtifacts) error {
+	call := Call{Kind: KindScript, Provider: m.link.Provider, Model: m.link.Model}
+	return m.r.meter(ctx, call, promptHash(stage, req.SystemPrompt, req.Idea), func(ctx context.Context) error {
+		return m.s.RunScriptStage(ctx, stage, req, a)
+	})
+}
+
+func (m *meteredStager) Model() string {
+	return m.link.Model
+}
+
+type meteredSpeech struct {
+	r        *Registry
+	s        SpeechSynthesizer
+	provider string
+}
+
+func (m *meteredSpeech) GenerateAudio(ctx context.Context, text string, opts SpeechOptions) (audio []byte, err error) {
+	call := Call{Kind: KindSpeech, Provider: m.provider, Model: ModelOf(m.s), Characters: utf8.RuneCountInString(text)}
+	err = m.r.meter(ctx, call, promptHash(text, opts.Voice), func(ctx context.Context) error {
+		audio, err = m.s.GenerateAudio(ctx, text, opts)
+		return err
+	})
+	return audio, err
+}
+
+func (m *meteredSpeech) Model() string {
+	return ModelOf(m.s)
+}
+
+type meteredImage struct {
+	r        *Registry
+	g        ImageGenerator
+	provider string
+}
+
+func (m *meteredImage) GenerateImage(ctx context.Context, prompt string) (image []byte, err error) {
+	call := Call{Kind: KindImage, Provider: m.provider, Model: ModelOf(m.g), Images: 1}
+	err = m.r.meter(ctx, call, promptHash(prompt), func(ctx context.Context) error {
+		image, err = m.g.GenerateImage(ctx, prompt)
+		return err
+	})
+	return image, err
+}
+
+func (m *meteredImage) Model() string {
+	return ModelOf(m.g)
+}
+
+func (m *meteredImage) Size() string {
+	return SizeOf(m.g)
+}
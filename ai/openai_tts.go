@@ -0,0 +1,91 @@
+package ai
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	OpenAITTSModel = "tts-1"
+	OpenAITTSVoice = "alloy"
+)
+
+// OpenAITts speaks through any OpenAI compatible /audio/speech endpoint.
+type OpenAITts struct {
+	key      string
+	endpoint string
+	model    string
+	voice    string
+
+	client *openai.Client
+}
+
+func NewOpenAITts(key, endpoint, model, voice string) *OpenAITts {
+	if model == "" {
+		model = OpenAITTSModel
+	}
+
+	if voice == "" {
+		voice = OpenAITTSVoice
+	}
+
+	t := &OpenAITts{
+		key:      key,
+		endpoint: endpoint,
+		model:    model,
+		voice:    voice,
+	}
+	t.setHTTPClient(nil)
+
+	return t
+}
+
+func (t *OpenAITts) Model() string {
+	return t.model
+}
+
+// setHTTPClient rebuilds the openai client on hc, nil is the default
+// client.
+func (t *OpenAITts) setHTTPClient(hc *http.Client) {
+	config := openai.DefaultConfig(t.key)
+	if t.endpoint != "" {
+		config.BaseURL = t.endpoint
+	}
+	if hc != nil {
+		config.HTTPClient = hc
+	}
+	t.client = openai.NewClientWithConfig(config)
+}
+
+func (t *OpenAITts) GenerateAudio(ctx context.Context, text string, opts SpeechOptions) ([]byte, error) {
+	log.Info().Msgf("Generating audio with %s for text: %s", t.model, text)
+
+	voice := t.voice
+	if opts.Voice != "" {
+		voice = opts.Voice
+	}
+
+	resp, err := t.client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(t.model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(voice),
+		ResponseFormat: openai.SpeechResponseFormatMp3,
+		Speed:          opts.speed(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create speech")
+	}
+	defer resp.Close()
+
+	raw, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read speech response body")
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,224 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+)
+
+// Completer answers a single system and user prompt with text, script
+// providers implementing it can run the staged pipeline.
+type Completer interface {
+	Complete(ctx context.Context, system, prompt string) (string, error)
+}
+
+// ScriptStager runs one stage of the staged script pipeline, it reads the
+// artifacts of earlier stages from a and writes its own.
+type ScriptStager interface {
+	RunScriptStage(ctx context.Context, stage string, req ScriptRequest, a *model.ScriptArtifacts) error
+}
+
+// RunScriptStage checks the stage before stage is done, drops the artifacts
+// stage is going to replace and everything built on them, then runs it.
+func RunScriptStage(ctx context.Context, s ScriptStager, stage string, req ScriptRequest, a *model.ScriptArtifacts) error {
+	if !model.IsScriptStage(stage) {
+		return errors.Errorf("unknown script stage %q", stage)
+	}
+
+	if needs := model.ScriptStageNeeds(stage); needs != "" && !a.Done(needs) {
+		return errors.Errorf("script stage %s needs stage %s first", stage, needs)
+	}
+
+	a.Clear(stage)
+	if err := s.RunScriptStage(ctx, stage, req, a); err != nil {
+		return errors.Wrapf(err, "script stage %s failed", stage)
+	}
+
+	if !a.Done(stage) {
+		return errors.Errorf("script stage %s returned nothing", stage)
+	}
+
+	return nil
+}
+
+const OutlinePrompt = `
+You plan short videos. Expand the user's idea into the outline of a video of about {{.WordCount}} chinese characters,
+you can extend the idea with conversational text / short story / old chinese saying to reflect the idea.
+
+1, give 3 to 8 beats, each beat is one chinese sentence saying what that part of the video tells.
+2, give a catchy chinese title of at most 20 characters, plain chinese without english words or symbols.
+
+respond with a json object only: {"title":"视频标题","beats":["第一段","第二段"]}
+`
+
+const DraftPrompt = `
+You write the narration of short videos. Write the chinese narration following the outline the user gives,
+the narration should be around {{.WordCount}} chinese characters, one beat after another.
+
+respond with the narration text only, no title, no headings, no explanation.
+`
+
+const SegmentPrompt = `
+You cut video narrations into subtitles. Cut the chinese narration the user gives into subtitles in order,
+each subtitle between {{.MinSubtitleChars}} to {{.MaxSubtitleChars}} chinese characters. keep the words of the narration,
+only drop punctuation at the ends of the subtitles.
+
+respond with a json object only: {"segments":["第一条字幕","第二条字幕"]}
+`
+
+const TranslatePrompt = `
+You translate video subtitles. Translate every chinese subtitle of the json array the user gives into english,
+each translation at most {{.MaxSubtitleWords}} words, all lowercase and without punctuation.
+
+respond with a json object only, with exactly one translation per subtitle in the same order:
+{"translations":["first subtitle","second subtitle"]}
+`
+
+const ImagePromptsPrompt = `
+You write image generation prompts for video subtitles. Write one prompt for every chinese subtitle of the json
+array the user gives.
+
+1, the prompt should be in chinese, and should be descriptive enough for image generation.
+2, the target image should be related to the subtitle.
+3, describe what the image shows only, the drawing style is added by the template.
+
+respond with a json object only, with exactly one prompt per subtitle in the same order:
+{"image_prompts":["第一条提示词","第二条提示词"]}
+`
+
+var stagePromptTemplates = map[string]*template.Template{
+	model.ScriptStageOutline:      template.Must(template.New(model.ScriptStageOutline).Parse(OutlinePrompt)),
+	model.ScriptStageDraft:        template.Must(template.New(model.ScriptStageDraft).Parse(DraftPrompt)),
+	model.ScriptStageSegment:      template.Must(template.New(model.ScriptStageSegment).Parse(SegmentPrompt)),
+	model.ScriptStageTranslate:    template.Must(template.New(model.ScriptStageTranslate).Parse(TranslatePrompt)),
+	model.ScriptStageImagePrompts: template.Must(template.New(model.ScriptStageImagePrompts).Parse(ImagePromptsPrompt)),
+}
+
+// Pipeline runs the script stages as separate prompts of one model.
+type Pipeline struct {
+	Completer Completer
+}
+
+func NewPipeline(c Completer) *Pipeline {
+	return &Pipeline{Completer: c}
+}
+
+// Model is the model of the completer, empty when it does not tell.
+func (p *Pipeline) Model() string {
+	return ModelOf(p.Completer)
+}
+
+func (p *Pipeline) RunScriptStage(ctx context.Context, stage string, req ScriptRequest, a *model.ScriptArtifacts) error {
+	var system strings.Builder
+	if err := stagePromptTemplates[stage].Execute(&system, req.withDefaults()); err != nil {
+		return errors.Wrap(err, "failed to build stage prompt")
+	}
+
+	switch stage {
+	case model.ScriptStageOutline:
+		var out struct {
+			Title string   `json:"title"`
+			Beats []string `json:"beats"`
+		}
+		if err := p.completeJSON(ctx, system.String(), req.Idea, &out); err != nil {
+			return err
+		}
+		a.Title, a.Outline = strings.TrimSpace(out.Title), out.Beats
+
+	case model.ScriptStageDraft:
+		var prompt strings.Builder
+		fmt.Fprintf(&prompt, "创意：%s\n标题：%s\n大纲：\n", req.Idea, a.Title)
+		for i, beat := range a.Outline {
+			fmt.Fprintf(&prompt, "%d. %s\n", i+1, beat)
+		}
+		draft, err := p.Completer.Complete(ctx, system.String(), prompt.String())
+		if err != nil {
+			return err
+		}
+		a.Draft = stripFences(draft)
+
+	case model.ScriptStageSegment:
+		var out struct {
+			Segments []string `json:"segments"`
+		}
+		if err := p.completeJSON(ctx, system.String(), a.Draft, &out); err != nil {
+			return err
+		}
+		a.Segments = out.Segments
+
+	case model.ScriptStageTranslate:
+		var out struct {
+			Translations []string `json:"translations"`
+		}
+		if err := p.completePerSegment(ctx, system.String(), a.Segments, &out, &out.Translations); err != nil {
+			return err
+		}
+		a.Translations = out.Translations
+
+	case model.ScriptStageImagePrompts:
+		var out struct {
+			ImagePrompts []string `json:"image_prompts"`
+		}
+		if err := p.completePerSegment(ctx, system.String(), a.Segments, &out, &out.ImagePrompts); err != nil {
+			return err
+		}
+		a.ImagePrompts = out.ImagePrompts
+	}
+
+	return nil
+}
+
+func (p *Pipeline) completeJSON(ctx context.Context, system, prompt string, v interface{}) error {
+	content, err := p.Completer.Complete(ctx, system, prompt)
+	if err != nil {
+		return err
+	}
+
+	raw := ExtractJSON(content)
+	if err := json.Unmarshal([]byte(raw), v); err == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(RepairJSON(raw)), v); err != nil {
+		return errors.Wrap(err, "answer is not valid json")
+	}
+
+	return nil
+}
+
+// completePerSegment sends the segments as a json array and expects one
+// answer per segment in list.
+func (p *Pipeline) completePerSegment(ctx context.Context, system string, segments []string, v interface{}, list *[]string) error {
+	prompt, err := json.Marshal(segments)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal segments")
+	}
+
+	if err := p.completeJSON(ctx, system, string(prompt), v); err != nil {
+		return err
+	}
+
+	if len(*list) != len(segments) {
+		return errors.Errorf("expected %d answers, got %d", len(segments), len(*list))
+	}
+
+	return nil
+}
+
+func stripFences(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+			s = s[nl+1:]
+		}
+		s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+	}
+
+	return strings.TrimSpace(s)
+}
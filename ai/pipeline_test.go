@@ -0,0 +1,72 @@
+package ai
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmingxu/mpu/model"
+)
+
+// canned answers every stage prompt with a fixed reply and remembers the
+// prompts it got.
+type canned struct {
+	replies map[string]string // stage prompt marker => reply
+	prompts []string
+}
+
+func (c *canned) Complete(ctx context.Context, system, prompt string) (string, error) {
+	c.prompts = append(c.prompts, prompt)
+	for marker, reply := range c.replies {
+		if strings.Contains(system, marker) {
+			return reply, nil
+		}
+	}
+
+	return "", nil
+}
+
+func TestPipeline(t *testing.T) {
+	c := &canned{replies: map[string]string{
+		"You plan short videos":      "```json\n{\"title\": \"星座小知识\", \"beats\": [\"性格\", \"魅力\"],}\n```",
+		"You write the narration":    "金牛座的人做事踏实稳重。真诚待人是她们最大的魅力。",
+		"You cut video narrations":   `{"segments": ["金牛座的人做事踏实稳重", "真诚待人是她们最大的魅力"]}`,
+		"You translate":              `{"translations": ["taurus people are steady", "sincerity is their charm"]}`,
+		"You write image generation": `{"image_prompts": ["火柴人，一个人搬箱子", "火柴人，两个人握手"]}`,
+	}}
+	p := NewPipeline(c)
+	req := ScriptRequest{Idea: "金牛座", Duration: time.Minute}
+
+	var a model.ScriptArtifacts
+	if err := RunScriptStage(context.Background(), p, model.ScriptStageDraft, req, &a); err == nil {
+		t.Fatal("draft should need an outline")
+	}
+
+	for _, stage := range model.ScriptStages {
+		if err := RunScriptStage(context.Background(), p, stage, req, &a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !strings.Contains(c.prompts[1], "1. 性格\n2. 魅力") {
+		t.Fatalf("draft prompt misses the outline: %q", c.prompts[1])
+	}
+
+	script, err := a.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script.Title != "星座小知识" || len(script.ScriptItems) != 2 || script.ScriptItems[1].ImagePrompt != "火柴人，两个人握手" {
+		t.Fatalf("unexpected script %+v", script)
+	}
+	if violations := CheckScript(script, req); len(violations) > 0 {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+
+	c.replies["You translate"] = `{"translations": ["only one"]}`
+	if err := RunScriptStage(context.Background(), p, model.ScriptStageTranslate, req, &a); err == nil ||
+		!strings.Contains(err.Error(), "expected 2 answers, got 1") {
+		t.Fatalf("a translation per segment is required, got %v", err)
+	}
+}
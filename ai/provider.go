@@ -0,0 +1,542 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+)
+
+// ScriptRequest is what a script is generated from, the limits come from
+// the preset of the movie.
+type ScriptRequest struct {
+	Idea             string        // 用户创意
+	Duration         time.Duration // 目标时长
+	WordsPerSecond   float64       // 每秒朗读的中文字数
+	MinSubtitleChars int           // 每条中文字幕最少字数
+	MaxSubtitleChars int           // 每条中文字幕最多字数
+	MaxSubtitleWords int           // 每条英文字幕最多单词数
+
+	SystemPrompt string // 模板的系统提示词，text/template，为空时使用 SystemPrompt
+
+	Previous   string   // 上一次生成的文案，重新生成时使用
+	Violations []string // 上一次文案违反的规则
+}
+
+// WordCount is about how many chinese characters fill Duration.
+func (r ScriptRequest) WordCount() int {
+	wps := r.WordsPerSecond
+	if wps <= 0 {
+		wps = WordCountPerSecond
+	}
+
+	return int(math.Round(r.Duration.Seconds() * wps))
+}
+
+// withDefaults fills the limits r leaves zero in from the default preset.
+func (r ScriptRequest) withDefaults() ScriptRequest {
+	if r.MinSubtitleChars <= 0 {
+		r.MinSubtitleChars = model.DefaultPreset.MinSubtitleChars
+	}
+	if r.MaxSubtitleChars <= 0 {
+		r.MaxSubtitleChars = model.DefaultPreset.MaxSubtitleChars
+	}
+	if r.MaxSubtitleWords <= 0 {
+		r.MaxSubtitleWords = model.DefaultPreset.MaxSubtitleWords
+	}
+
+	return r
+}
+
+// ScriptGenerator turns an idea into a MovieScript json string.
+type ScriptGenerator interface {
+	GenerateScript(ctx context.Context, req ScriptRequest) (string, error)
+}
+
+// SpeechOptions tune speech synthesis, zero values use the provider
+// defaults.
+type SpeechOptions struct {
+	Speed float64 // 语速，1 为正常
+	Voice string  // 声音，为空时使用 provider 配置的声音
+}
+
+func (o SpeechOptions) speed() float64 {
+	if o.Speed <= 0 {
+		return 1
+	}
+
+	return o.Speed
+}
+
+// SpeechSynthesizer turns a subtitle into mp3 audio.
+type SpeechSynthesizer interface {
+	GenerateAudio(ctx context.Context, text string, opts SpeechOptions) ([]byte, error)
+}
+
+// ImageGenerator turns an image prompt into png/jpeg image data.
+type ImageGenerator interface {
+	GenerateImage(ctx context.Context, prompt string) ([]byte, error)
+}
+
+// Sizer is an image provider which tells the size, WIDTHxHEIGHT, of the
+// images it draws.
+type Sizer interface {
+	Size() string
+}
+
+// SizeOf is the size of the images g draws, empty when it does not tell.
+func SizeOf(g interface{}) string {
+	if s, ok := g.(Sizer); ok {
+		return s.Size()
+	}
+
+	return ""
+}
+
+const (
+	KindScript = "script" // 文案生成
+	KindSpeech = "speech" // 语音合成
+	KindImage  = "image"  // 文生图
+)
+
+// ProviderConfig is a named provider instance, Type selects the
+// implementation and the rest configures it. Fields which do not apply to
+// a type are ignored.
+type ProviderConfig struct {
+	Name     string `json:"name"`            // 名称，电影通过名称选择 provider
+	Type     string `json:"type"`            // 实现类型，如 openai / siliconflow / volcengine
+	Endpoint string `json:"endpoint"`        // API 地址
+	Key      string `json:"key"`             // API key
+	Model    string `json:"model"`           // 模型名称
+	Voice    string `json:"voice,omitempty"` // 语音合成的声音
+	Size     string `json:"size,omitempty"`  // 图片尺寸，如 1280x720
+
+	Concurrency int    `json:"concurrency,omitempty"` // 同时进行的调用数上限，0 为不限
+	Timeout     string `json:"timeout,omitempty"`     // 单次请求超时，如 90s
+	Retries     int    `json:"retries,omitempty"`     // 失败后的重试次数，0 为默认，负数不重试
+
+	// HTTPClient is the resilient client Registry.Register builds for the
+	// provider, factories send their requests through it.
+	HTTPClient *http.Client `json:"-"`
+
+	StructuredOutput string `json:"structured_output,omitempty"` // 文案结构化输出：json_schema / tools，空为纯文本提示
+}
+
+// ProvidersFile is the layout of the --providers-config json file.
+type ProvidersFile struct {
+	Providers []ProviderConfig `json:"providers"`
+	Defaults  struct {
+		Script string `json:"script"`
+		Speech string `json:"speech"`
+		Image  string `json:"image"`
+	} `json:"defaults"`
+	Fallbacks struct {
+		Script []string `json:"script"` // provider 或 provider/model，按顺序尝试
+	} `json:"fallbacks"`
+}
+
+// transportOptions are the default transport options with the timeout and
+// retries of the config applied.
+func (cfg ProviderConfig) transportOptions() (TransportOptions, error) {
+	opts := DefaultTransportOptions
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || d <= 0 {
+			return opts, errors.Errorf("invalid timeout %q for provider %s", cfg.Timeout, cfg.Name)
+		}
+		opts.Timeout = d
+	}
+
+	switch {
+	case cfg.Retries < 0:
+		opts.Retries = 0
+	case cfg.Retries > 0:
+		opts.Retries = cfg.Retries
+	}
+
+	return opts, nil
+}
+
+// httpClient is the client a provider built outside of a registry uses.
+func (cfg ProviderConfig) httpClient() *http.Client {
+	if cfg.HTTPClient != nil {
+		return cfg.HTTPClient
+	}
+
+	return &http.Client{}
+}
+
+func LoadProvidersFile(path string) (*ProvidersFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read providers config %s", path)
+	}
+
+	var f ProvidersFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse providers config %s", path)
+	}
+
+	return &f, nil
+}
+
+// Factory builds a provider from its config, the returned value implements
+// at least one of ScriptGenerator, SpeechSynthesizer and ImageGenerator.
+type Factory func(cfg ProviderConfig) (interface{}, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// RegisterFactory makes a provider type available to ProviderConfig.Type.
+func RegisterFactory(typ string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	factories[typ] = f
+}
+
+func init() {
+	RegisterFactory("openai", func(cfg ProviderConfig) (interface{}, error) {
+		c := NewClient(cfg.Model, cfg.Key, cfg.Endpoint)
+		c.setHTTPClient(cfg.httpClient())
+		if err := c.SetStructuredOutput(cfg.StructuredOutput); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+
+	RegisterFactory("siliconflow", func(cfg ProviderConfig) (interface{}, error) {
+		t := NewTts(cfg.Key, cfg.Endpoint, cfg.Model, cfg.Voice)
+		t.client = cfg.httpClient()
+		return t, nil
+	})
+
+	RegisterFactory("openai-tts", func(cfg ProviderConfig) (interface{}, error) {
+		t := NewOpenAITts(cfg.Key, cfg.Endpoint, cfg.Model, cfg.Voice)
+		t.setHTTPClient(cfg.httpClient())
+		return t, nil
+	})
+
+	RegisterFactory("volcengine", func(cfg ProviderConfig) (interface{}, error) {
+		t := NewTxt2Img(cfg.Key, cfg.Endpoint, cfg.Model, cfg.Size)
+		t.client = cfg.httpClient()
+		return t, nil
+	})
+
+	RegisterFactory("sdwebui", func(cfg ProviderConfig) (interface{}, error) {
+		if cfg.Endpoint == "" {
+			return nil, errors.New("sdwebui provider requires an endpoint")
+		}
+		w := NewSDWebUI(cfg.Endpoint, cfg.Key, cfg.Model, cfg.Size)
+		w.client = cfg.httpClient()
+		return w, nil
+	})
+}
+
+// Registry holds the named providers of a deployment and which of them are
+// used when a movie does not pick one.
+type Registry struct {
+	mu sync.RWMutex
+
+	scripts  map[string]ScriptGenerator
+	speeches map[string]SpeechSynthesizer
+	images   map[string]ImageGenerator
+
+	defaults map[string]string        // kind => provider name
+	limits   map[string]chan struct{} // provider name => call slots
+	breakers map[string]*Breaker      // provider name => breaker of its transport
+
+	fallbacks []ScriptLink // 文案生成失败后依次尝试的 provider 和模型
+	recorder  CallRecorder // 记录每次调用
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		scripts:  map[string]ScriptGenerator{},
+		speeches: map[string]SpeechSynthesizer{},
+		images:   map[string]ImageGenerator{},
+		defaults: map[string]string{},
+		limits:   map[string]chan struct{}{},
+		breakers: map[string]*Breaker{},
+	}
+}
+
+// Register builds the provider described by cfg and registers it under
+// cfg.Name for every kind it implements.
+func (r *Registry) Register(cfg ProviderConfig) error {
+	if cfg.Name == "" {
+		return errors.New("provider name is required")
+	}
+
+	factoriesMu.RLock()
+	f, ok := factories[cfg.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return errors.Errorf("unknown provider type %q for provider %s", cfg.Type, cfg.Name)
+	}
+
+	opts, err := cfg.transportOptions()
+	if err != nil {
+		return err
+	}
+
+	transport := NewTransport(cfg.Name, opts)
+	cfg.HTTPClient = transport.Client()
+
+	p, err := f(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create provider %s", cfg.Name)
+	}
+
+	if err := r.Add(cfg.Name, p); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.breakers[cfg.Name] = transport.Breaker()
+	r.mu.Unlock()
+
+	r.SetConcurrency(cfg.Name, cfg.Concurrency)
+	return nil
+}
+
+// Breakers returns the breaker state of every provider registered from a
+// config, by name.
+func (r *Registry) Breakers() map[string]BreakerStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make(map[string]BreakerStatus, len(r.breakers))
+	for name, b := range r.breakers {
+		statuses[name] = b.Status()
+	}
+
+	return statuses
+}
+
+// SetConcurrency limits how many calls the provider called name serves at
+// once, across all its kinds and movies. n <= 0 lifts the limit.
+func (r *Registry) SetConcurrency(name string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n <= 0 {
+		delete(r.limits, name)
+		return
+	}
+
+	r.limits[name] = make(chan struct{}, n)
+}
+
+// Acquire waits for a free call slot of the kind provider called name, or
+// of the default one when name is empty. release gives the slot back once
+// the call is done.
+func (r *Registry) Acquire(ctx context.Context, kind, name string) (release func(), err error) {
+	name = r.Resolve(kind, name)
+
+	r.mu.RLock()
+	slots, ok := r.limits[name]
+	r.mu.RUnlock()
+	if !ok {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Add registers an already built provider under name for every kind it
+// implements.
+func (r *Registry) Add(name string, p interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registered := false
+	if g, ok := p.(ScriptGenerator); ok {
+		r.scripts[name] = g
+		registered = true
+	}
+
+	if g, ok := p.(SpeechSynthesizer); ok {
+		r.speeches[name] = g
+		registered = true
+	}
+
+	if g, ok := p.(ImageGenerator); ok {
+		r.images[name] = g
+		registered = true
+	}
+
+	if !registered {
+		return errors.Errorf("provider %s implements no known provider interface", name)
+	}
+
+	return nil
+}
+
+// SetDefault selects the provider used for kind when a movie does not name
+// one.
+func (r *Registry) SetDefault(kind, name string) error {
+	if !r.Has(kind, name) {
+		return errors.Errorf("no %s provider named %s", kind, name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.defaults[kind] = name
+	return nil
+}
+
+func (r *Registry) Default(kind string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.defaults[kind]
+}
+
+// Has reports whether a provider of kind is registered under name.
+func (r *Registry) Has(kind, name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	switch kind {
+	case KindScript:
+		_, ok := r.scripts[name]
+		return ok
+	case KindSpeech:
+		_, ok := r.speeches[name]
+		return ok
+	case KindImage:
+		_, ok := r.images[name]
+		return ok
+	}
+
+	return false
+}
+
+// Names lists the registered provider names of kind.
+func (r *Registry) Names(kind string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0)
+	switch kind {
+	case KindScript:
+		for name := range r.scripts {
+			names = append(names, name)
+		}
+	case KindSpeech:
+		for name := range r.speeches {
+			names = append(names, name)
+		}
+	case KindImage:
+		for name := range r.images {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns name, or the name of the default provider of kind when
+// name is empty.
+func (r *Registry) Resolve(kind, name string) string {
+	if name != "" {
+		return name
+	}
+
+	return r.Default(kind)
+}
+
+// ScriptGenerator returns the script provider called name, or the default
+// one when name is empty.
+func (r *Registry) ScriptGenerator(name string) (ScriptGenerator, error) {
+	g, err := r.scriptGenerator(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &meteredScript{r: r, g: g, link: ScriptLink{Provider: r.Resolve(KindScript, name), Model: ModelOf(g)}}, nil
+}
+
+// scriptGenerator is ScriptGenerator without metering.
+func (r *Registry) scriptGenerator(name string) (ScriptGenerator, error) {
+	name = r.Resolve(KindScript, name)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	g, ok := r.scripts[name]
+	if !ok {
+		return nil, errors.Errorf("no script provider named %q", name)
+	}
+
+	return g, nil
+}
+
+// ScriptStager returns the staged pipeline of the script provider called
+// name, or of the default one when name is empty.
+func (r *Registry) ScriptStager(name string) (ScriptStager, error) {
+	g, err := r.scriptGenerator(name)
+	if err != nil {
+		return nil, err
+	}
+
+	link := ScriptLink{Provider: r.Resolve(KindScript, name), Model: ModelOf(g)}
+	switch p := g.(type) {
+	case ScriptStager:
+		return &meteredStager{r: r, s: p, link: link}, nil
+	case Completer:
+		return NewPipeline(&meteredCompleter{r: r, c: p, link: link}), nil
+	}
+
+	return nil, errors.Errorf("script provider %q does not support staged generation", r.Resolve(KindScript, name))
+}
+
+// SpeechSynthesizer returns the speech provider called name, or the default
+// one when name is empty.
+func (r *Registry) SpeechSynthesizer(name string) (SpeechSynthesizer, error) {
+	name = r.Resolve(KindSpeech, name)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	g, ok := r.speeches[name]
+	if !ok {
+		return nil, errors.Errorf("no speech provider named %q", name)
+	}
+
+	return &meteredSpeech{r: r, s: g, provider: name}, nil
+}
+
+// ImageGenerator returns the image provider called name, or the default one
+// when name is empty.
+func (r *Registry) ImageGenerator(name string) (ImageGenerator, error) {
+	name = r.Resolve(KindImage, name)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	g, ok := r.images[name]
+	if !ok {
+		return nil, errors.Errorf("no image provider named %q", name)
+	}
+
+	return &meteredImage{r: r, g: g, provider: name}, nil
+}
@@ -0,0 +1,110 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+// SDWebUI talks to a Stable Diffusion WebUI (AUTOMATIC1111 compatible)
+// server through its /sdapi/v1/txt2img api.
+type SDWebUI struct {
+	client   *http.Client
+	endpoint string
+	key      string
+	model    string
+	width    int
+	height   int
+}
+
+func NewSDWebUI(endpoint, key, model, size string) *SDWebUI {
+	if size == "" {
+		size = Txt2ImgSize
+	}
+
+	w := &SDWebUI{
+		client:   &http.Client{},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		key:      key,
+		model:    model,
+	}
+
+	if _, err := fmt.Sscanf(size, "%dx%d", &w.width, &w.height); err != nil {
+		w.width, w.height = 1280, 720
+	}
+
+	return w
+}
+
+func (w *SDWebUI) Model() string {
+	return w.model
+}
+
+func (w *SDWebUI) Size() string {
+	return fmt.Sprintf("%dx%d", w.width, w.height)
+}
+
+func (w *SDWebUI) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	log.Debug().Msgf("Generating image with sdwebui prompt: %s", prompt)
+
+	body := map[string]interface{}{
+		"prompt": prompt,
+		"width":  w.width,
+		"height": w.height,
+		"steps":  20,
+	}
+
+	if w.model != "" {
+		body["override_settings"] = map[string]interface{}{
+			"sd_model_checkpoint": w.model,
+		}
+	}
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal sdwebui request")
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost,
+		w.endpoint+"/sdapi/v1/txt2img", bytes.NewBuffer(raw))
+	req.Header.Set("Content-Type", "application/json")
+	if w.key != "" {
+		req.Header.Set("Authorization", "Bearer "+w.key)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make request to sdwebui")
+	}
+	defer resp.Body.Close()
+
+	raw, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body from sdwebui")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("sdwebui returned status: %s %s", resp.Status, string(raw))
+	}
+
+	img := gjson.GetBytes(raw, "images.0").String()
+	if img == "" {
+		return nil, errors.New("sdwebui returned no image")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(img)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode base64 image from sdwebui")
+	}
+
+	return decoded, nil
+}
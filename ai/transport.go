@@ -0,0 +1,302 @@
+package ai
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned without calling a provider which failed too
+// often in a row, until its cooldown is over.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// TransportOptions tune the http transport of the providers.
+type TransportOptions struct {
+	Timeout          time.Duration // 单次请求超时，包括读取响应
+	Retries          int           // 失败后的重试次数
+	BaseDelay        time.Duration // 第一次重试前的等待，之后每次翻倍
+	MaxDelay         time.Duration // 重试等待上限
+	MaxRetryAfter    time.Duration // Retry-After 超过它时不再重试
+	BreakerThreshold int           // 连续失败多少次后熔断
+	BreakerCooldown  time.Duration // 熔断后多久放一个试探请求
+}
+
+var DefaultTransportOptions = TransportOptions{
+	Timeout:          2 * time.Minute,
+	Retries:          3,
+	BaseDelay:        500 * time.Millisecond,
+	MaxDelay:         10 * time.Second,
+	MaxRetryAfter:    time.Minute,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// Transport is the http.RoundTripper of the providers. Every attempt gets
+// its own timeout, network errors, 429 and 5xx answers are retried with
+// exponential backoff and jitter or after the Retry-After the provider asks
+// for, and calls which still fail trip the breaker of the provider.
+type Transport struct {
+	name    string
+	opts    TransportOptions
+	base    http.RoundTripper
+	breaker *Breaker
+}
+
+func NewTransport(name string, opts TransportOptions) *Transport {
+	return &Transport{
+		name:    name,
+		opts:    opts,
+		base:    http.DefaultTransport,
+		breaker: NewBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+}
+
+// Client returns an http client sending its requests through t.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) Breaker() *Breaker {
+	return t.breaker
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, errors.Wrapf(err, "provider %s", t.name)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.try(req, attempt)
+		if req.Context().Err() != nil {
+			// the caller gave up, that says nothing about the provider
+			t.breaker.abort()
+			return resp, err
+		}
+
+		wait, retry := t.backoff(req, resp, err, attempt)
+		if !retry {
+			if down(resp, err) {
+				t.breaker.failure()
+			} else {
+				t.breaker.success()
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			log.Warn().Msgf("provider %s answered %s, retrying in %s", t.name, resp.Status, wait)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			log.Warn().Err(err).Msgf("provider %s failed, retrying in %s", t.name, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			t.breaker.abort()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// try sends one attempt of req, the timeout covers reading the body too so
+// it is only released when the body is closed.
+func (t *Transport) try(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if t.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), t.opts.Timeout)
+	}
+
+	r := req.Clone(ctx)
+	if attempt > 0 && req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, errors.Wrap(err, "failed to rewind request body")
+		}
+		r.Body = body
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff decides whether the outcome of an attempt is worth another one
+// and how long to wait for it.
+func (t *Transport) backoff(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= t.opts.Retries || (req.Body != nil && req.GetBody == nil) {
+		return 0, false
+	}
+
+	if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return 0, false
+	}
+
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait, wait <= t.opts.MaxRetryAfter
+		}
+	}
+
+	delay := t.opts.BaseDelay << attempt
+	if delay > t.opts.MaxDelay || delay <= 0 {
+		delay = t.opts.MaxDelay
+	}
+
+	// full jitter on the upper half keeps concurrent items from retrying
+	// in lockstep
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// down tells whether a final outcome counts against the provider, rate
+// limits mean it is up.
+func down(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an http date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(header); err == nil {
+		wait := time.Until(at)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"    // 正常
+	BreakerOpen     = "open"      // 熔断，直接失败
+	BreakerHalfOpen = "half_open" // 冷却结束，试探中
+)
+
+// Breaker opens after threshold calls in a row failed and fails calls fast
+// while open. Once the cooldown is over one call is let through, its
+// outcome closes the breaker or opens it again.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// BreakerStatus is the state of a breaker as the health endpoint shows it.
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`             // 连续失败次数
+	OpenUntil *time.Time `json:"open_until,omitempty"` // 熔断结束时间
+}
+
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state(), Failures: b.failures}
+	if status.State == BreakerOpen {
+		until := b.openedAt.Add(b.cooldown)
+		status.OpenUntil = &until
+	}
+
+	return status
+}
+
+func (b *Breaker) state() string {
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return BreakerClosed
+	}
+
+	if time.Since(b.openedAt) < b.cooldown {
+		return BreakerOpen
+	}
+
+	return BreakerHalfOpen
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+func (b *Breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures, b.probing = 0, false
+}
+
+func (b *Breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// abort ends a call without an outcome, a probe is let through again.
+func (b *Breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
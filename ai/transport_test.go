@@ -0,0 +1,130 @@
+package ai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var testTransportOptions = TransportOptions{
+	Timeout:          time.Second,
+	Retries:          2,
+	BaseDelay:        time.Millisecond,
+	MaxDelay:         5 * time.Millisecond,
+	MaxRetryAfter:    time.Second,
+	BreakerThreshold: 2,
+	BreakerCooldown:  50 * time.Millisecond,
+}
+
+func TestTransportRetries(t *testing.T) {
+	var calls, down int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			n = 2
+		}
+
+		switch n {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	// a retried post sends its body again
+	tts := NewTts("key", srv.URL, "", "")
+	tts.client = NewTransport("tts", testTransportOptions).Client()
+	out, err := tts.GenerateAudio(context.Background(), "你好", SpeechOptions{})
+	if err != nil || string(out) != "ok" || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected success on the third call, got %q %v after %d calls", out, err, calls)
+	}
+
+	// out of retries the last answer is returned
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&down, 1)
+	_, err = tts.GenerateAudio(context.Background(), "你好", SpeechOptions{})
+	if err == nil || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected failure after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	if wait, ok := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); !ok || wait < 59*time.Minute {
+		t.Fatalf("expected an http date Retry-After to be parsed, got %s", wait)
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	opts := testTransportOptions
+	opts.Timeout, opts.Retries = 20*time.Millisecond, 0
+	start := time.Now()
+	_, err := NewTransport("slow", opts).Client().Get(srv.URL)
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the attempt to time out, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var calls, healthy int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	opts := testTransportOptions
+	opts.Retries = 0
+	transport := NewTransport("down", opts)
+	client := transport.Client()
+	get := func() error {
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := get(); !errors.Is(err, ErrCircuitOpen) || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected the open breaker to fail fast, got %v after %d calls", err, calls)
+	}
+
+	status := transport.Breaker().Status()
+	if status.State != BreakerOpen || status.Failures != 2 || status.OpenUntil == nil {
+		t.Fatalf("unexpected breaker status %+v", status)
+	}
+
+	// after the cooldown one probe goes through and closes the breaker
+	time.Sleep(opts.BreakerCooldown)
+	atomic.StoreInt32(&healthy, 1)
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := transport.Breaker().Status(); status.State != BreakerClosed || status.Failures != 0 {
+		t.Fatalf("a successful probe should close the breaker: %+v", status)
+	}
+}
@@ -7,15 +7,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
-	openai "github.com/sashabaranov/go-openai"
 )
 
 const (
 	TTSModel     = "FunAudioLLM/CosyVoice2-0.5B"
 	DefaultVoice = "benjamin"
+	TTSEndpoint  = "https://api.siliconflow.cn/v1/audio/speech"
 )
 
 var (
@@ -31,34 +32,43 @@ var (
 	}
 )
 
-var ttsInstance *Tts
-
+// Tts is the SiliconFlow speech api, empty endpoint, model and voice fall
+// back to the CosyVoice2 defaults.
 type Tts struct {
 	key      string
 	endpoint string
+	model    string
 	voice    string
 
-	client *openai.Client
+	client *http.Client
 }
 
-func NewTts(key string) *Tts {
-	t := &Tts{
-		key:      key,
-		endpoint: "https://api.siliconflow.cn/v1/audio/speech",
-		voice:    fmt.Sprintf("%s:%s", TTSModel, DefaultVoice),
+func NewTts(key, endpoint, model, voice string) *Tts {
+	if endpoint == "" {
+		endpoint = TTSEndpoint
 	}
 
-	config := openai.DefaultConfig(t.key)
-	config.BaseURL = t.endpoint
-	t.client = openai.NewClientWithConfig(config)
+	if model == "" {
+		model = TTSModel
+	}
 
-	ttsInstance = t
+	if voice == "" {
+		voice = DefaultVoice
+	}
 
-	return ttsInstance
+	t := &Tts{
+		key:      key,
+		endpoint: endpoint,
+		model:    model,
+		voice:    fmt.Sprintf("%s:%s", model, voice),
+		client:   &http.Client{},
+	}
+
+	return t
 }
 
-func GetTTSInstance() *Tts {
-	return ttsInstance
+func (t *Tts) Model() string {
+	return t.model
 }
 
 //	curl --request POST \
@@ -75,22 +85,30 @@ func GetTTSInstance() *Tts {
 //	  "speed": 1,
 //	  "gain": 0
 //	}'
-func (t *Tts) GenerateAudio(ctx context.Context, text string) ([]byte, error) {
+func (t *Tts) GenerateAudio(ctx context.Context, text string, opts SpeechOptions) ([]byte, error) {
 	if t.client == nil {
 		return nil, errors.New("TTS client is not initialized")
 	}
 
 	log.Info().Msgf("Generating audio for text: %s", text)
 
+	voice := t.voice
+	if opts.Voice != "" {
+		voice = opts.Voice
+		if !strings.Contains(voice, ":") {
+			voice = fmt.Sprintf("%s:%s", t.model, voice)
+		}
+	}
+
 	data := map[string]interface{}{
-		"model":           TTSModel,
+		"model":           t.model,
 		"input":           text,
-		"voice":           t.voice,
+		"voice":           voice,
 		"response_format": "mp3",
 		"sample_rate":     32000,
 		"stream":          true,
 		"gain":            0.0,
-		"speed":           1.0,
+		"speed":           opts.speed(),
 	}
 
 	jsonData, err := json.Marshal(data)
@@ -98,22 +116,27 @@ func (t *Tts) GenerateAudio(ctx context.Context, text string) ([]byte, error) {
 		return nil, errors.Wrap(err, "failed to marshal TTS request data")
 	}
 
-	req, _ := http.NewRequest(
+	req, err := http.NewRequestWithContext(ctx,
 		http.MethodPost,
 		t.endpoint,
 		bytes.NewBuffer(jsonData),
 	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create TTS request")
+	}
 
 	req.Header.Set("Authorization", "Bearer "+t.key)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := t.client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create TTS request")
+		return nil, errors.Wrap(err, "failed to send TTS request")
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("TTS request failed with status code: %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("TTS request failed with status code: %d %s", resp.StatusCode, body)
 	}
 
 	responseBody, err := io.ReadAll(resp.Body)
@@ -13,25 +13,54 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+const (
+	Txt2ImgEndpoint = "https://ark.cn-beijing.volces.com/api/v3/images/generations"
+	Txt2ImgModel    = "doubao-seedream-3-0-t2i-250415"
+	Txt2ImgSize     = "1280x720"
+	// Txt2ImgSeed is fixed so a prompt draws the same image every time.
+	Txt2ImgSeed = 12
+)
+
+// Txt2Img is the Volcengine ark image generation api, empty endpoint, model
+// and size fall back to the seedream defaults.
 type Txt2Img struct {
-	client *http.Client
-	key    string
+	client   *http.Client
+	key      string
+	endpoint string
+	model    string
+	size     string
 }
 
-var txt2ImgInstance *Txt2Img
+func NewTxt2Img(key, endpoint, model, size string) *Txt2Img {
+	if endpoint == "" {
+		endpoint = Txt2ImgEndpoint
+	}
+
+	if model == "" {
+		model = Txt2ImgModel
+	}
+
+	if size == "" {
+		size = Txt2ImgSize
+	}
 
-func NewTxt2Img(key string) *Txt2Img {
 	c := &Txt2Img{
-		key: key,
+		key:      key,
+		endpoint: endpoint,
+		model:    model,
+		size:     size,
 	}
 
 	c.client = &http.Client{}
-	txt2ImgInstance = c
-	return txt2ImgInstance
+	return c
+}
+
+func (t *Txt2Img) Model() string {
+	return t.model
 }
 
-func GetTxt2Img() *Txt2Img {
-	return txt2ImgInstance
+func (t *Txt2Img) Size() string {
+	return t.size
 }
 
 // curl -X POST https://ark.cn-beijing.volces.com/api/v3/images/generations \
@@ -64,16 +93,16 @@ func GetTxt2Img() *Txt2Img {
 func (t *Txt2Img) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
 	log.Debug().Msgf("Generating image with prompt: %s", prompt)
 
-	if txt2ImgInstance == nil {
+	if t.client == nil {
 		return nil, errors.New("txt2img client not initialized")
 	}
 
 	body := map[string]interface{}{
-		"model":           "doubao-seedream-3-0-t2i-250415",
+		"model":           t.model,
 		"prompt":          prompt,
 		"response_format": "b64_json",
-		"size":            "1280x720",
-		"seed":            12,
+		"size":            t.size,
+		"seed":            Txt2ImgSeed,
 		"guidance_scale":  2.5,
 		"watermark":       false,
 	}
@@ -86,8 +115,10 @@ func (t *Txt2Img) GenerateImage(ctx context.Context, prompt string) ([]byte, err
 		panic(err)
 	}
 
-	req, _ := http.NewRequestWithContext(ctx, "POST",
-		"https://ark.cn-beijing.volces.com/api/v3/images/generations", bytes.NewBuffer(raw))
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewBuffer(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create txt2img request")
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+t.key)
@@ -96,6 +127,7 @@ func (t *Txt2Img) GenerateImage(ctx context.Context, prompt string) ([]byte, err
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to make request to txt2img API")
 	}
+	defer resp.Body.Close()
 
 	log.Debug().Msgf("txt2img API response status: %s", resp.Status)
 	if resp.StatusCode != http.StatusOK {
@@ -0,0 +1,309 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// MaxTitleChars is the longest title the prompt allows.
+const MaxTitleChars = 20
+
+// DefaultScriptAttempts is how often a model is asked for a script before
+// its violations are given up on.
+const DefaultScriptAttempts = 3
+
+// Violation is a rule of the prompt a generated script breaks, Item is -1
+// for the script itself.
+type Violation struct {
+	Item    int    `json:"item"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Item < 0 {
+		return fmt.Sprintf("%s: %s", v.Field, v.Message)
+	}
+
+	return fmt.Sprintf("script_items[%d].%s: %s", v.Item, v.Field, v.Message)
+}
+
+// ScriptValidationError is returned when a model keeps breaking the rules,
+// Output is its last answer.
+type ScriptValidationError struct {
+	Attempts   int
+	Violations []Violation
+	Output     string
+}
+
+func (e *ScriptValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.String())
+	}
+
+	return fmt.Sprintf("generated script is invalid after %d attempts: %s", e.Attempts, strings.Join(msgs, "; "))
+}
+
+// ExtractJSON strips markdown code fences and any chatter around the json
+// object of a model answer.
+func ExtractJSON(content string) string {
+	s := strings.TrimSpace(content)
+	if i := strings.Index(s, "```"); i >= 0 {
+		s = s[i+3:]
+		// language tag, e.g. ```json
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 && !strings.ContainsAny(s[:nl], "{[") {
+			s = s[nl+1:]
+		}
+		if j := strings.Index(s, "```"); j >= 0 {
+			s = s[:j]
+		}
+	}
+
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		s = s[i:]
+	}
+	if j := strings.LastIndexByte(s, '}'); j >= 0 && isBalanced(s[:j+1]) {
+		s = s[:j+1]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func isBalanced(s string) bool {
+	depth, inString, escaped := 0, false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && r == '\\':
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '{' || r == '[':
+			depth++
+		case r == '}' || r == ']':
+			depth--
+		}
+	}
+
+	return depth == 0 && !inString
+}
+
+// fullwidth punctuation models like to use outside of strings
+var jsonPunctuation = map[rune]rune{
+	'“': '"', '”': '"', '：': ':', '，': ',', '｛': '{', '｝': '}', '［': '[', '］': ']',
+}
+
+// RepairJSON fixes the faults models commonly make: trailing commas,
+// fullwidth punctuation between values, raw line breaks inside strings and
+// answers cut off before the closing brackets.
+func RepairJSON(s string) string {
+	var (
+		out      strings.Builder
+		stack    []rune
+		inString bool
+		escaped  bool
+		fancy    bool // the string was opened by a fullwidth quote
+	)
+
+	for _, r := range s {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"' && fancy:
+				out.WriteString(`\"`)
+				continue
+			case r == '"' || (r == '”' && fancy):
+				inString = false
+				out.WriteRune('"')
+				continue
+			case r == '\n':
+				out.WriteString(`\n`)
+				continue
+			case r == '\r':
+				continue
+			case r == '\t':
+				out.WriteString(`\t`)
+				continue
+			}
+			out.WriteRune(r)
+			continue
+		}
+
+		fancy = r == '“'
+		if p, ok := jsonPunctuation[r]; ok {
+			r = p
+		}
+
+		switch r {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			trimTrailingComma(&out)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		out.WriteRune(r)
+	}
+
+	if inString {
+		if escaped {
+			out.WriteString(`\`)
+		}
+		out.WriteRune('"')
+	}
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		trimTrailingComma(&out)
+		out.WriteRune(stack[i])
+	}
+
+	return out.String()
+}
+
+func trimTrailingComma(b *strings.Builder) {
+	s := strings.TrimRightFunc(b.String(), unicode.IsSpace)
+	if strings.HasSuffix(s, ",") {
+		b.Reset()
+		b.WriteString(strings.TrimSuffix(s, ","))
+	}
+}
+
+// ParseScript turns a model answer into a script, repairing it if needed.
+func ParseScript(content string) (*model.MovieScript, error) {
+	raw := ExtractJSON(content)
+
+	var script model.MovieScript
+	if err := json.Unmarshal([]byte(raw), &script); err == nil {
+		return &script, nil
+	}
+
+	if err := json.Unmarshal([]byte(RepairJSON(raw)), &script); err != nil {
+		return nil, errors.Wrap(err, "generated script is not valid json")
+	}
+
+	return &script, nil
+}
+
+// CheckScript lists the rules of the prompt script breaks, the subtitle
+// limits come from req.
+func CheckScript(script *model.MovieScript, req ScriptRequest) []Violation {
+	req = req.withDefaults()
+	minChars, maxChars, maxWords := req.MinSubtitleChars, req.MaxSubtitleChars, req.MaxSubtitleWords
+
+	var violations []Violation
+	add := func(item int, field, format string, args ...interface{}) {
+		violations = append(violations, Violation{Item: item, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	title := strings.TrimSpace(script.Title)
+	if title == "" {
+		add(-1, "title", "title is missing")
+	} else if n := utf8.RuneCountInString(title); n > MaxTitleChars {
+		add(-1, "title", "%d characters, at most %d allowed", n, MaxTitleChars)
+	}
+
+	if len(script.ScriptItems) == 0 {
+		add(-1, "script_items", "no script items")
+	}
+
+	for i, item := range script.ScriptItems {
+		if item == nil {
+			add(i, "cn", "item is empty")
+			continue
+		}
+
+		cn := []rune(strings.TrimSpace(item.ZhSubtitle))
+		if len(cn) < minChars || len(cn) > maxChars {
+			add(i, "cn", "%d characters, expected %d to %d", len(cn), minChars, maxChars)
+		}
+
+		en := strings.Fields(item.EnSubtitle)
+		switch {
+		case len(en) == 0:
+			add(i, "en", "english translation is missing")
+		case len(en) > maxWords:
+			add(i, "en", "%d words, at most %d allowed", len(en), maxWords)
+		}
+		if item.EnSubtitle != strings.ToLower(item.EnSubtitle) {
+			add(i, "en", "must be all lowercase")
+		}
+
+		if strings.TrimSpace(item.ImagePrompt) == "" {
+			add(i, "image_prompt", "image prompt is missing")
+		}
+	}
+
+	return violations
+}
+
+// ValidatingScriptGenerator checks every script of Generator against the
+// prompt rules and asks again with the violations until it gets a valid
+// one or runs out of attempts. Valid scripts are returned as clean json.
+type ValidatingScriptGenerator struct {
+	Generator   ScriptGenerator
+	MaxAttempts int
+}
+
+func NewValidatingScriptGenerator(g ScriptGenerator, attempts int) *ValidatingScriptGenerator {
+	if attempts <= 0 {
+		attempts = DefaultScriptAttempts
+	}
+
+	return &ValidatingScriptGenerator{Generator: g, MaxAttempts: attempts}
+}
+
+func (v *ValidatingScriptGenerator) GenerateScript(ctx context.Context, req ScriptRequest) (string, error) {
+	var last *ScriptValidationError
+	for attempt := 1; attempt <= v.MaxAttempts; attempt++ {
+		content, err := v.Generator.GenerateScript(ctx, req)
+		if err != nil {
+			return "", err
+		}
+
+		var violations []Violation
+		script, err := ParseScript(content)
+		if err != nil {
+			violations = []Violation{{Item: -1, Field: "json", Message: err.Error()}}
+		} else {
+			violations = CheckScript(script, req)
+		}
+
+		if len(violations) == 0 {
+			raw, err := json.Marshal(script)
+			if err != nil {
+				return "", errors.Wrap(err, "failed to marshal script")
+			}
+			return string(raw), nil
+		}
+
+		last = &ScriptValidationError{Attempts: attempt, Violations: violations, Output: content}
+		req.Previous = content
+		req.Violations = make([]string, 0, len(violations))
+		for _, violation := range violations {
+			req.Violations = append(req.Violations, violation.String())
+		}
+		log.Warn().Msgf("Script attempt %d of %d is invalid: %s", attempt, v.MaxAttempts, strings.Join(req.Violations, "; "))
+	}
+
+	return "", last
+}
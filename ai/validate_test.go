@@ -0,0 +1,105 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cmingxu/mpu/model"
+)
+
+const validScript = `{"title": "星座小知识", "script_items": [
+	{"cn": "金牛座的人做事踏实稳重", "en": "taurus people are steady", "image_prompt": "a calm bull"}
+]}`
+
+func TestParseScript(t *testing.T) {
+	for name, content := range map[string]string{
+		"plain":           validScript,
+		"fenced":          "好的，这是文案：\n```json\n" + validScript + "\n```\n希望你喜欢",
+		"trailing commas": strings.Replace(validScript, `"a calm bull"}`, `"a calm bull",},`, 1),
+		"fullwidth":       strings.Replace(validScript, `"title": `, `“title”：`, 1),
+		"line break":      strings.Replace(validScript, "踏实稳重", "踏实\n稳重", 1),
+		"truncated":       strings.TrimSuffix(strings.TrimSpace(validScript), "]}") + `, {"cn": "认定的事情`,
+	} {
+		script, err := ParseScript(content)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if script.Title != "星座小知识" || len(script.ScriptItems) == 0 ||
+			!strings.HasPrefix(script.ScriptItems[0].ZhSubtitle, "金牛座的人做事踏实") {
+			t.Fatalf("%s: unexpected script %+v", name, script)
+		}
+	}
+
+	if _, err := ParseScript("sorry, I can not help with that"); err == nil {
+		t.Fatal("an answer without json should not parse")
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	script := &model.MovieScript{
+		Title: "一个远远超过二十个字符限制的非常非常长的视频标题",
+		ScriptItems: []*model.ScriptItem{
+			{ZhSubtitle: "金牛座的人做事踏实稳重", EnSubtitle: "taurus people are steady", ImagePrompt: "a bull"},
+			{ZhSubtitle: "太短", EnSubtitle: "Too Short"},
+			{ZhSubtitle: "金牛座的人做事踏实稳重", EnSubtitle: "one two three four five six seven eight nine ten eleven", ImagePrompt: "a bull"},
+		},
+	}
+
+	var got []string
+	for _, v := range CheckScript(script, ScriptRequest{MaxSubtitleWords: 10}) {
+		got = append(got, v.String())
+	}
+
+	want := []string{
+		"title: 24 characters, at most 20 allowed",
+		"script_items[1].cn: 2 characters, expected 10 to 28",
+		"script_items[1].en: must be all lowercase",
+		"script_items[1].image_prompt: image prompt is missing",
+		"script_items[2].en: 11 words, at most 10 allowed",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected violations:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+// sequence answers with outs in turn and remembers the requests.
+type sequence struct {
+	outs []string
+	reqs []ScriptRequest
+}
+
+func (s *sequence) GenerateScript(ctx context.Context, req ScriptRequest) (string, error) {
+	s.reqs = append(s.reqs, req)
+	out := s.outs[0]
+	if len(s.outs) > 1 {
+		s.outs = s.outs[1:]
+	}
+
+	return out, nil
+}
+
+func TestValidatingScriptGenerator(t *testing.T) {
+	bad := strings.Replace(validScript, "taurus", "Taurus", 1)
+
+	seq := &sequence{outs: []string{bad, "```json\n" + validScript + "\n```"}}
+	out, err := NewValidatingScriptGenerator(seq, 3).GenerateScript(context.Background(), ScriptRequest{Idea: "金牛座"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "```") || len(seq.reqs) != 2 {
+		t.Fatalf("expected the clean second answer, got %q after %d requests", out, len(seq.reqs))
+	}
+	if retry := seq.reqs[1]; retry.Previous != bad || len(retry.Violations) != 1 ||
+		retry.Violations[0] != "script_items[0].en: must be all lowercase" {
+		t.Fatalf("retry does not carry the violations %+v", retry)
+	}
+
+	seq = &sequence{outs: []string{bad}}
+	_, err = NewValidatingScriptGenerator(seq, 3).GenerateScript(context.Background(), ScriptRequest{})
+	var verr *ScriptValidationError
+	if !errors.As(err, &verr) || verr.Attempts != 3 || len(verr.Violations) != 1 || verr.Output != bad {
+		t.Fatalf("expected a ScriptValidationError after 3 attempts, got %v", err)
+	}
+}
@@ -14,7 +14,7 @@ var commands = []*cli2.Command{
 	{
 		Name:  "server",
 		Usage: "webserver for Money Printer Ultra",
-		Flags: []cli2.Flag{
+		Flags: append([]cli2.Flag{
 			&cli2.StringFlag{
 				Name:  "listen-addr",
 				Value: ":8080",
@@ -43,42 +43,99 @@ var commands = []*cli2.Command{
 				Value:   "",
 				EnvVars: []string{"VOLENGINE_KEY"},
 			},
-		},
 
-		Before: func(c *cli2.Context) error {
-			zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+			&cli2.IntFlag{
+				Name:    "workers",
+				Usage:   "number of background job workers",
+				Value:   2,
+				EnvVars: []string{"WORKERS"},
+			},
 
-			zeroLogLevel, err := zerolog.ParseLevel(c.String("log-level"))
-			if err != nil {
-				return err
-			}
+			&cli2.IntFlag{
+				Name:    "item-workers",
+				Usage:   "number of script items a voice or image job generates at once",
+				Value:   server.DefaultItemWorkers,
+				EnvVars: []string{"ITEM_WORKERS"},
+			},
+
+			&cli2.IntFlag{
+				Name:    "script-attempts",
+				Usage:   "how often a script breaking the prompt rules is generated again",
+				Value:   ai.DefaultScriptAttempts,
+				EnvVars: []string{"SCRIPT_ATTEMPTS"},
+			},
 
-			zerolog.SetGlobalLevel(zeroLogLevel)
+			&cli2.StringFlag{
+				Name:    "prices-config",
+				Usage:   "json file with the prices of the AI providers, for the cost reports",
+				EnvVars: []string{"PRICES_CONFIG"},
+			},
 
-			return nil
-		},
+			&cli2.StringFlag{
+				Name:    "composer-python",
+				Usage:   "python interpreter running the composer",
+				Value:   server.DefaultComposer.Python,
+				EnvVars: []string{"COMPOSER_PYTHON"},
+			},
+
+			&cli2.StringFlag{
+				Name:    "composer-script",
+				Usage:   "path of composer/main.py",
+				Value:   server.DefaultComposer.Script,
+				EnvVars: []string{"COMPOSER_SCRIPT"},
+			},
+		}, providerFlags...),
+
+		Before: setupLogging,
 
 		Action: func(c *cli2.Context) error {
-			if err := model.Init(c.String("work-dir") + "/mpu.db"); err != nil {
+			if err := openDB(c); err != nil {
 				return err
 			}
 
-			if err := model.InitDB(); err != nil {
+			if err := model.Migrate(); err != nil {
 				return err
 			}
 
-			ai.NewClient(c.String("model"),
-				c.String("openai-key"),
-				c.String("openai-api"))
-
-			ai.NewTts(c.String("openai-key"))
+			providers, err := buildRegistry(c)
+			if err != nil {
+				return err
+			}
 
-			ai.NewTxt2Img(c.String("volengine-key"))
+			s := server.New(c.String("listen-addr"), c.String("work-dir"), c.Int("workers"), providers)
+			s.SetComposer(server.Composer{
+				Python: c.String("composer-python"),
+				Script: c.String("composer-script"),
+			})
+			s.SetScriptAttempts(c.Int("script-attempts"))
+			s.SetItemWorkers(c.Int("item-workers"))
+
+			if path := c.String("prices-config"); path != "" {
+				prices, err := model.LoadPriceTable(path)
+				if err != nil {
+					return err
+				}
+				s.SetPrices(prices)
+			}
 
-			s := server.New(c.String("listen-addr"), c.String("work-dir"))
 			return s.Start()
 		},
 	},
+	migrateCommand,
+	schemaCommand,
+}
+
+func setupLogging(c *cli2.Context) error {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	zeroLogLevel, err := zerolog.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return err
+	}
+
+	zerolog.SetGlobalLevel(zeroLogLevel)
+
+	return nil
 }
 
 var (
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/cmingxu/mpu/model"
+
+	cli2 "github.com/urfave/cli/v2"
+)
+
+var migrateCommand = &cli2.Command{
+	Name:   "migrate",
+	Usage:  "manage the database schema",
+	Before: setupLogging,
+	Subcommands: []*cli2.Command{
+		{
+			Name:  "up",
+			Usage: "apply pending migrations",
+			Flags: []cli2.Flag{
+				&cli2.IntFlag{
+					Name:  "to",
+					Usage: "stop at this version, 0 means latest",
+				},
+			},
+			Action: func(c *cli2.Context) error {
+				if err := openDB(c); err != nil {
+					return err
+				}
+				defer model.Close()
+
+				if err := model.CheckSchemaVersion(); err != nil {
+					return err
+				}
+
+				applied, err := model.MigrateUp(c.Int("to"))
+				for _, m := range applied {
+					fmt.Printf("applied %d %s\n", m.Version, m.Name)
+				}
+
+				if err == nil && len(applied) == 0 {
+					fmt.Println("already up to date")
+				}
+
+				return err
+			},
+		},
+		{
+			Name:  "down",
+			Usage: "revert applied migrations, newest first",
+			Flags: []cli2.Flag{
+				&cli2.IntFlag{
+					Name:  "steps",
+					Usage: "number of migrations to revert",
+					Value: 1,
+				},
+			},
+			Action: func(c *cli2.Context) error {
+				if err := openDB(c); err != nil {
+					return err
+				}
+				defer model.Close()
+
+				reverted, err := model.MigrateDown(c.Int("steps"))
+				for _, m := range reverted {
+					fmt.Printf("reverted %d %s\n", m.Version, m.Name)
+				}
+
+				return err
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "list migrations and whether they are applied",
+			Action: func(c *cli2.Context) error {
+				if err := openDB(c); err != nil {
+					return err
+				}
+				defer model.Close()
+
+				list, err := model.ListMigrationStatus()
+				if err != nil {
+					return err
+				}
+
+				for _, s := range list {
+					appliedAt := "pending"
+					if s.Applied {
+						appliedAt = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+					}
+					fmt.Printf("%4d  %-45s %s\n", s.Version, s.Name, appliedAt)
+				}
+
+				return nil
+			},
+		},
+	},
+}
+
+func openDB(c *cli2.Context) error {
+	return model.Init(c.String("work-dir") + "/mpu.db")
+}
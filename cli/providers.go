@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"github.com/cmingxu/mpu/ai"
+
+	cli2 "github.com/urfave/cli/v2"
+)
+
+// Names of the providers built from the legacy key flags.
+const (
+	builtinScriptProvider = "openai"
+	builtinSpeechProvider = "siliconflow"
+	builtinImageProvider  = "volcengine"
+)
+
+var providerFlags = []cli2.Flag{
+	&cli2.StringFlag{
+		Name:    "providers-config",
+		Usage:   "json file with extra named providers and the defaults",
+		EnvVars: []string{"PROVIDERS_CONFIG"},
+	},
+
+	&cli2.BoolFlag{
+		Name:    "fake-providers",
+		Usage:   "use the offline fake providers by default, for local development and tests",
+		EnvVars: []string{"FAKE_PROVIDERS"},
+	},
+
+	&cli2.StringFlag{
+		Name:    "openai-structured-output",
+		Usage:   "how the builtin openai provider is held to the script schema: json_schema, tools or empty for the prompt only",
+		EnvVars: []string{"OPENAI_STRUCTURED_OUTPUT"},
+	},
+
+	&cli2.StringSliceFlag{
+		Name:    "script-fallbacks",
+		Usage:   "provider or provider/model pairs script generation falls back to in order, e.g. openai/gpt-4o-mini,local",
+		EnvVars: []string{"SCRIPT_FALLBACKS"},
+	},
+
+	&cli2.StringFlag{
+		Name:    "script-provider",
+		Usage:   "default script provider",
+		Value:   builtinScriptProvider,
+		EnvVars: []string{"SCRIPT_PROVIDER"},
+	},
+
+	&cli2.StringFlag{
+		Name:    "speech-provider",
+		Usage:   "default speech provider",
+		Value:   builtinSpeechProvider,
+		EnvVars: []string{"SPEECH_PROVIDER"},
+	},
+
+	&cli2.StringFlag{
+		Name:    "image-provider",
+		Usage:   "default image provider",
+		Value:   builtinImageProvider,
+		EnvVars: []string{"IMAGE_PROVIDER"},
+	},
+}
+
+// buildRegistry registers the providers configured by the key flags and the
+// providers config file, defaults in the file win over unset flags and
+// --fake-providers wins over everything.
+func buildRegistry(c *cli2.Context) (*ai.Registry, error) {
+	r := ai.NewRegistry()
+
+	builtins := []ai.ProviderConfig{
+		{
+			Name:     builtinScriptProvider,
+			Type:     "openai",
+			Model:    c.String("model"),
+			Key:      c.String("openai-key"),
+			Endpoint: c.String("openai-api"),
+
+			StructuredOutput: c.String("openai-structured-output"),
+		},
+		{
+			Name: builtinSpeechProvider,
+			Type: "siliconflow",
+			Key:  c.String("openai-key"),
+		},
+		{
+			Name: builtinImageProvider,
+			Type: "volcengine",
+			Key:  c.String("volengine-key"),
+		},
+	}
+
+	for _, cfg := range builtins {
+		if err := r.Register(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	defaults := map[string]string{
+		ai.KindScript: c.String("script-provider"),
+		ai.KindSpeech: c.String("speech-provider"),
+		ai.KindImage:  c.String("image-provider"),
+	}
+
+	fallbacks := c.StringSlice("script-fallbacks")
+
+	if path := c.String("providers-config"); path != "" {
+		f, err := ai.LoadProvidersFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cfg := range f.Providers {
+			if err := r.Register(cfg); err != nil {
+				return nil, err
+			}
+		}
+
+		if !c.IsSet("script-fallbacks") {
+			fallbacks = f.Fallbacks.Script
+		}
+
+		for kind, name := range map[string]string{
+			ai.KindScript: f.Defaults.Script,
+			ai.KindSpeech: f.Defaults.Speech,
+			ai.KindImage:  f.Defaults.Image,
+		} {
+			if name != "" && !c.IsSet(kind+"-provider") {
+				defaults[kind] = name
+			}
+		}
+	}
+
+	if c.Bool("fake-providers") {
+		if err := r.Add(ai.FakeProvider, ai.NewFake()); err != nil {
+			return nil, err
+		}
+
+		for kind := range defaults {
+			defaults[kind] = ai.FakeProvider
+		}
+	}
+
+	for kind, name := range defaults {
+		if err := r.SetDefault(kind, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.Bool("fake-providers") {
+		links := make([]ai.ScriptLink, 0, len(fallbacks))
+		for _, link := range fallbacks {
+			links = append(links, ai.ParseScriptLink(link))
+		}
+
+		if err := r.SetScriptFallbacks(links); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
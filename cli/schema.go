@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cmingxu/mpu/model"
+
+	cli2 "github.com/urfave/cli/v2"
+)
+
+// schemas are the JSON Schemas `mpu schema` can print.
+var schemas = map[string]func() (*model.Schema, error){
+	"render-spec": model.RenderSpecSchema,
+}
+
+var schemaCommand = &cli2.Command{
+	Name:      "schema",
+	Usage:     "print a JSON Schema, e.g. mpu schema render-spec > composer/render_spec.schema.json",
+	ArgsUsage: "render-spec",
+	Action: func(c *cli2.Context) error {
+		name := c.Args().First()
+		build, ok := schemas[name]
+		if !ok {
+			return fmt.Errorf("unknown schema %q", name)
+		}
+
+		schema, err := build()
+		if err != nil {
+			return err
+		}
+
+		raw, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(raw))
+		return nil
+	},
+}
@@ -1,255 +1,218 @@
 import logging
 import json
 import os
-import dataclasses
+import sys
 import random
-from typing import List
-from PIL import Image, ImageDraw, ImageFont
-import math
-from type import MovieMeta, ScriptItem
 import glob
-from itertools import chain
+
+from type import RenderSpec, RenderItem, TextStyle, Position, RENDER_SPEC_VERSION
 
 from moviepy import (
-    VideoClip,
-    VideoFileClip,
-    ImageSequenceClip,
     ImageClip,
     TextClip,
     ColorClip,
     AudioFileClip,
-    AudioClip,
-    UpdatedVideoClip,
     CompositeVideoClip,
-    concatenate_videoclips,
-    concatenate_audioclips,
-    clips_array,
+    CompositeAudioClip,
     vfx,
+    afx,
 )
-import numpy as np
 
 log = logging.getLogger(__name__)
 
 workdir = os.getenv("WORKDIR", "/default/workdir")
-metafile = os.getenv("METAFILE", "meta.json")
+metafile = os.getenv("METAFILE", "spec.json")
 env = os.getenv("ENV", "dev")
 
 ROOT = os.path.dirname(os.path.abspath(__file__))
+SCHEMA = os.path.join(ROOT, "render_spec.schema.json")
 
-# prepare_data function to convert raw data into a MovieMeta object
-def prepare_data(data: dict) -> MovieMeta:
-    script_items = data.get("script_items", [])
+# prepare_data function to convert the raw spec into a RenderSpec object,
+# the spec is checked against the schema when jsonschema is installed
+def prepare_data(data: dict) -> RenderSpec:
+    if data.get("version") != RENDER_SPEC_VERSION:
+        raise ValueError(f"unsupported render spec version {data.get('version')}, expected {RENDER_SPEC_VERSION}")
 
-    meta = MovieMeta(**data)
-    meta.script_items = [ScriptItem(**item)
-            for item in script_items]
-    return meta
+    try:
+        import jsonschema
+    except ImportError:
+        jsonschema = None
 
-def validate_data(meta: MovieMeta) -> bool:
-    for item in meta.script_items:
-        if not item.cn or not item.en or not item.image_prompt or not item.voice_path or not item.image_path:
-            log.error(f"Invalid script item: {item}")
-            return False
+    if jsonschema is not None:
+        with open(SCHEMA, 'r') as f:
+            jsonschema.validate(data, json.load(f))
+
+    return RenderSpec.from_dict(data)
 
-    for item in meta.script_items:
-        if not os.path.exists(item.voice_path):
+def validate_data(spec: RenderSpec) -> bool:
+    if not spec.items:
+        log.error("Render spec has no items")
+        return False
+
+    # voice_path and image_path are relative to workdir
+    for item in spec.items:
+        if not os.path.exists(os.path.join(workdir, item.voice_path)):
             log.error(f"Voice file does not exist: {item.voice_path}")
             return False
-        if not os.path.exists(item.image_path):
+        if not os.path.exists(os.path.join(workdir, item.image_path)):
             log.error(f"Image file does not exist: {item.image_path}")
             return False
 
-# Define some constants for later use
-black = (0, 0, 0)  # RGB for black
-red = (255, 0, 0)  # RGB for red
-gray = (128, 128, 128)  # RGB for gray
-light_gray = (211, 211, 211)  # RGB for light gray
-white = (255, 255, 255)  # RGB for white
-
-# resolution settings
-height = 1920
-width = 1080
-hgihtlight_height = 1920 * (1 - 0.618)
-padding = 20
+    if spec.bgm and not os.path.exists(os.path.join(workdir, spec.bgm.path)):
+        log.error(f"Background music does not exist: {spec.bgm.path}")
+        return False
 
-origin = (0,  height / 2 - hgihtlight_height / 2) #left_top
-center = (width / 2, height / 2)
-bottom_left = (0, int(height / 2 + hgihtlight_height / 2)) #left_bottom
-top_right = (width, height / 2 - hgihtlight_height / 2) #right_top
-bottom_right = (width, height / 2 + hgihtlight_height / 2)
+    return True
 
-# main text font  size
-font_size_h1 = 50
-font_height_h1 = int(font_size_h1 * 1.2)  # Adjust height based on font size
+# "#rrggbb" to the RGB tuple moviepy wants
+def rgb(color: str) -> tuple:
+    return tuple(int(color[i:i + 2], 16) for i in (1, 3, 5))
 
-font_size_h2 = 30
-font_height_h2 = int(font_size_h1 * 1.2)  # Adjust height based on font size
+def seconds(ms: int) -> float:
+    return ms / 1000.0
 
-# audio settings
-audio_pause = 0.3
-
-silence_clip = AudioClip(lambda t: 0, duration=audio_pause)
+# fuction to calculate the size of the text based on font size, this is chinese text, so we need to use a different approach
+def cal_text_width(text: str, font_size: int) -> int:
+    return int(font_size * len(text) * 0.8)  # Adjust width based on text length
 
+def text_clip(spec: RenderSpec, text: str, style: TextStyle, width: int) -> TextClip:
+    return TextClip(text=text,
+                    font=os.path.join(ROOT, style.font),
+                    font_size=style.font_size,
+                    color=rgb(style.color),
+                    size=(min(width, spec.width), style.line_height),
+                    bg_color=rgb(style.background))
+
+def place(clip, pos: Position):
+    if pos.align == "center":
+        return clip.with_position(("center", pos.y))
+    return clip.with_position((pos.x, pos.y))
+
+def effects(name: str, duration: float) -> list:
+    if duration <= 0:
+        return []
+
+    return {
+        "slide_left": [vfx.SlideIn(duration, "left")],
+        "slide_top": [vfx.SlideIn(duration, "top")],
+        "slide_right": [vfx.SlideIn(duration, "right")],
+        "crossfade": [vfx.CrossFadeIn(duration)],
+        "none": [],
+    }[name]
+
+# timeline works out (start, duration) in seconds of every item, items
+# follow each other with their pause in between unless the spec fixes them
+def timeline(spec: RenderSpec, audio_clips: list) -> list:
+    cursor = 0.0
+    slots = []
+    for item, audio in zip(spec.items, audio_clips):
+        start = seconds(item.start_ms) if item.start_ms else cursor
+        duration = seconds(item.duration_ms) if item.duration_ms else audio.duration
+        slots.append((start, duration))
+        cursor = start + duration + seconds(item.pause_ms)
+    return slots
+
+
+def generate_video(spec: RenderSpec) -> str:
+    layout = spec.layout
+    styles = spec.styles
+    transition = seconds(spec.transitions.duration_ms)
 
-def generate_video(meta: MovieMeta) -> str:
     audio_clips = []
-    total_duration = 0
-    start_time = 0
-    for i, item in enumerate(meta.script_items):
-        print(f"{workdir}/{item.voice_path}")
-        audio_clip = AudioFileClip(f"{workdir}/{item.voice_path}")
+    for i, item in enumerate(spec.items):
+        audio_clip = AudioFileClip(os.path.join(workdir, item.voice_path))
         print(f"Processing audio for item {i+1}: {item.voice_path} {audio_clip.duration} seconds")
-        audio_clip = audio_clip.with_volume_scaled(0.9)
-        audio_clip = audio_clip.with_start(start_time + i * audio_pause)
-        audio_clip = audio_clip.with_end(start_time + i * audio_pause + audio_clip.duration)
-        audio_clips.append(audio_clip)
-        total_duration += audio_clip.duration
-    audio_clip = concatenate_audioclips(list(chain.from_iterable([[ac, silence_clip] for ac in audio_clips])))
-    total_duration = total_duration + (len(meta.script_items) -1 )* audio_pause
+        audio_clips.append(audio_clip.with_volume_scaled(spec.voice_volume))
 
-    image_clips = []
-    start_time = 0
-    for i, item in enumerate(meta.script_items):
-        duration = audio_clips[i].duration
-        print(f"Processing image for item {i+1}: {item.image_path} ")
-        image_clip = ImageClip(f"{workdir}/image/{i}.png")
-        image_clip = image_clip.with_duration(duration + (len(meta.script_items) - 1) * audio_pause)
-        image_clip = image_clip.with_start(start_time + i * audio_pause)
-        image_clip = image_clip.with_end(start_time + i * audio_pause + duration )
-        image_clip = image_clip.resized(new_size=(height/3, width/3))
-        image_clips.append(image_clip)
-        start_time += duration
-
-    max_image_height = max(clip.size[1] for clip in image_clips)
-    max_image_width = max(clip.size[0] for clip in image_clips)
+    slots = timeline(spec, audio_clips)
+    total_duration = max(start + duration for start, duration in slots)
 
-    text_clips = []
-    start_time = 0
-    for i, item in enumerate(meta.script_items):
-        print(f"Processing item {i+1}: {item.cn} / {item.en}")
-        duration = audio_clips[i].duration
-        text_clip = TextClip(text=item.cn, font=f"{ROOT}/fonts/ZCOOLQingKeHuangYou-Regular.ttf",
-                             font_size=font_size_h1,
-                             color=black,
-                             size=(cal_text_width(item.cn, font_size_h1), font_height_h1),
-                             bg_color=white)
-        text_clip = text_clip.with_duration(duration + (len(meta.script_items) - 1) * audio_pause)
-        text_clip = text_clip.with_start(start_time + i * audio_pause)
-        text_clip = text_clip.with_end(start_time + i * audio_pause + duration)
-        text_clips.append(text_clip)
-        start_time += duration
+    audio_clips = [clip.with_start(start) for clip, (start, _) in zip(audio_clips, slots)]
+    if spec.bgm:
+        bgm_clip = AudioFileClip(os.path.join(workdir, spec.bgm.path))
+        bgm_clip = bgm_clip.with_effects([afx.AudioLoop(duration=total_duration)])
+        audio_clips.append(bgm_clip.with_volume_scaled(spec.bgm.volume))
+    audio_clip = CompositeAudioClip(audio_clips).with_duration(total_duration)
 
+    image_clips = []
+    text_clips = []
     en_text_clips = []
-    start_time = 0
-    for i, item in enumerate(meta.script_items):
-        duration = audio_clips[i].duration
-        print(f"Processing item {i+1}: {item.en}")
-        text_clip = TextClip(text=item.en,
-                             font=f"{ROOT}/fonts/ZCOOLQingKeHuangYou-Regular.ttf",
-                             color=black,
-                             font_size=font_size_h2,
-                             size=(cal_text_width(item.cn * 4, font_size_h1), font_height_h2),
-                             bg_color=white)
-        text_clip = text_clip.with_duration(duration + (len(meta.script_items) - 1) * audio_pause)
-        text_clip = text_clip.with_start(start_time + i * audio_pause)
-        text_clip = text_clip.with_end(start_time + + i * audio_pause + duration)
-        en_text_clips.append(text_clip)
-        start_time += duration
-
-    bg_clip = ColorClip(size=(width, height), color=black, duration=total_duration)
-    hightlight_clip = ColorClip(size=(width, int(hgihtlight_height)), color=white, duration=total_duration)
-
-    print(f"bg_clip duration: {bg_clip.duration} seconds size: {bg_clip.size}")
-
-    hightlight_clip = hightlight_clip.with_position(origin)
-    text_clips = [CompositeVideoClip(([clip.with_effects([vfx.CrossFadeIn(0.3)])])) for clip in text_clips]
-    text_clips = [clip.with_position(("center", bottom_right[1] - font_height_h1 - padding - font_height_h1)) for clip in text_clips]
-
-    en_text_clips = [CompositeVideoClip(([clip.with_effects([vfx.CrossFadeIn(0.3)])])) for clip in en_text_clips]
-    en_text_clips = [clip.with_position(("center", bottom_right[1] - font_height_h1 - padding)) for clip in en_text_clips]
-
-    image_effects = [
-        [vfx.SlideIn(0.3, "left")],
-        [vfx.SlideIn(0.3, "top")],
-        [vfx.SlideIn(0.3, "right")],
-        [vfx.CrossFadeIn(0.3)],
-        # [vfx.CrossFadeOut(0.5)],
-    ]
-    image_clips = [CompositeVideoClip(([clip.with_effects(random.choice(image_effects))])) for clip in image_clips]
-    image_clips = [clip.with_position(("center", center[1] - max_image_height / 2 )) for clip in image_clips]
-
-    title_clip =TextClip(text=meta.title,
-                         font=f"{ROOT}/fonts/ZCOOLQingKeHuangYou-Regular.ttf",
-                         color=black,
-                         size=(cal_text_width(meta.title, font_size_h2), font_height_h2),
-                         bg_color=white)
-
-    title_clip = title_clip.with_duration(total_duration)
-    title_clip = title_clip.with_position((padding, origin[1] + padding))
-
-    color_clip = ColorClip(size=(50, 50), color=red, duration=total_duration)
-    color_clip1 = ColorClip(size=(50, 50), color=red, duration=total_duration)
-
-    color_clip = color_clip.with_position((top_right[0] - 50, top_right[1]))
-    color_clip1 = color_clip1.with_position((0, int(bottom_left[1] - 50)))
-
-    print(f"color_clip duration: {bottom_left}")
+    for i, (item, (start, duration)) in enumerate(zip(spec.items, slots)):
+        print(f"Processing item {i+1}: {item.image_path} {item.cn} / {item.en}")
+
+        image_clip = ImageClip(os.path.join(workdir, item.image_path))
+        image_clip = image_clip.resized(new_size=(layout.image.width, layout.image.height))
+        image_clip = image_clip.with_start(start).with_duration(duration)
+        image_clip = image_clip.with_effects(effects(random.choice(spec.transitions.image), transition))
+        image_clips.append(CompositeVideoClip([image_clip]).with_start(start).with_position((layout.image.x, layout.image.y)))
+
+        for text, style, pos, clips, width in (
+                (item.cn, styles.subtitle, layout.subtitle, text_clips, cal_text_width(item.cn, styles.subtitle.font_size)),
+                (item.en, styles.translation, layout.translation, en_text_clips, spec.width)):
+            clip = text_clip(spec, text, style, width).with_start(start).with_duration(duration)
+            clip = clip.with_effects(effects(spec.transitions.text, transition))
+            clips.append(place(CompositeVideoClip([clip]).with_start(start), pos))
+
+    bg_clip = ColorClip(size=(spec.width, spec.height), color=rgb(spec.background), duration=total_duration)
+    hightlight_clip = ColorClip(size=(layout.band.width, layout.band.height), color=rgb(layout.band_color), duration=total_duration)
+    hightlight_clip = hightlight_clip.with_position((layout.band.x, layout.band.y))
+
+    title_clip = text_clip(spec, spec.title, styles.title, cal_text_width(spec.title, styles.title.font_size))
+    title_clip = place(title_clip.with_duration(total_duration), layout.title)
+
+    all_clips = [bg_clip, hightlight_clip, title_clip]
+    if layout.marker_size > 0:
+        size = layout.marker_size
+        band = layout.band
+        for pos in ((band.x + band.width - size, band.y), (band.x, band.y + band.height - size)):
+            marker = ColorClip(size=(size, size), color=rgb(layout.marker_color), duration=total_duration)
+            all_clips.append(marker.with_position(pos))
 
     print(f"Total duration: {total_duration} seconds")
-    for i, item in enumerate(meta.script_items):
-        print(f"audio {i} start_time {audio_clips[i].start} end_time {audio_clips[i].end} duration {audio_clips[i].duration}")
-        print(f"text {i} start_time {text_clips[i].start} end_time {text_clips[i].end} duration {text_clips[i].duration}")
-        print(f"image {i} start_time {image_clips[i].start} end_time {image_clips[i].end} duration {image_clips[i].duration}")
-        print(" ==== ")
-
-
-
+    for i, (start, duration) in enumerate(slots):
+        print(f"item {i} start_time {start} duration {duration}")
 
-    all_clips = [bg_clip,
-                 hightlight_clip,
-                 title_clip,
-                 color_clip,
-                 color_clip1,
-                 ] + text_clips + image_clips + en_text_clips
-    [print(f"clip {i} duration: {clip.duration} seconds size: {clip.size}") for i, clip in enumerate(all_clips)]
-    final_clip = CompositeVideoClip(all_clips)
+    all_clips = all_clips + text_clips + image_clips + en_text_clips
+    final_clip = CompositeVideoClip(all_clips, size=(spec.width, spec.height)).with_duration(total_duration)
     print(f"final_clip duration: {final_clip.duration} seconds size: {final_clip.size}")
     final_clip = final_clip.with_audio(audio_clip)
     if env == "dev":
         final_clip.preview()
-    final_clip.write_videofile(f"{workdir}/output.mp4", fps=24, codec='libx264', audio_codec='aac')
-    #
 
-
-
-# fuction to calculate the size of the text based on font size, this is chinese text, so we need to use a different approach
-def cal_text_width(text: str, font_size: int) -> tuple:
-    return int(font_size * len(text) * 0.8)  # Adjust width based on text length
+    output = os.path.join(workdir, spec.output.file)
+    final_clip.write_videofile(output, fps=spec.fps, codec=spec.output.video_codec, audio_codec=spec.output.audio_codec)
+    return output
 
 
 def main():
-    log.setLevel(logging.DEBUG)
+    logging.basicConfig(level=logging.INFO)
     log.info("Starting the main function of the composer module.")
     log.info(f"Working directory is set to: {workdir}")
-    print(f"Working directory is set to: {workdir}")
     for file in glob.glob(f"{workdir}/*"):
         print(file)
 
-    meta_path = os.path.join(workdir, metafile)
-    if not os.path.exists(meta_path):
-        log.error(f"Meta file {metafile} does not exist in {workdir}.")
-        return
+    spec_path = os.path.join(workdir, metafile)
+    if not os.path.exists(spec_path):
+        log.error(f"Render spec {metafile} does not exist in {workdir}.")
+        sys.exit(1)
 
-    with open(os.path.join(workdir, metafile), 'r') as f:
+    with open(spec_path, 'r') as f:
         data = json.loads(f.read())
 
-    meta = prepare_data(data)
+    try:
+        spec = prepare_data(data)
+    except Exception as e:
+        log.error(f"Invalid render spec: {e}")
+        sys.exit(1)
 
-    if validate_data(meta):
-        log.info("Data validation passed.")
+    if not validate_data(spec):
+        log.error("Data validation failed.")
+        sys.exit(1)
 
+    log.info("Data validation passed.")
 
-    generate_video(meta)
+    generate_video(spec)
 
 
-main()
+if __name__ == "__main__":
+    main()
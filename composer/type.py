@@ -1,17 +1,128 @@
 import dataclasses
-from typing import List
+from typing import List, Optional
+
+# Mirrors model.RenderSpec in Go, render_spec.schema.json is generated from
+# it with `mpu schema render-spec`. Times are milliseconds, sizes pixels.
+RENDER_SPEC_VERSION = 1
+
+
+@dataclasses.dataclass
+class Rect:
+    x: int
+    y: int
+    width: int
+    height: int
+
+
+@dataclasses.dataclass
+class Position:
+    x: int
+    y: int
+    align: str
+
+
+@dataclasses.dataclass
+class Layout:
+    padding: int
+    band: Rect
+    band_color: str
+    marker_size: int
+    marker_color: str
+    title: Position
+    image: Rect
+    subtitle: Position
+    translation: Position
+
+
+@dataclasses.dataclass
+class TextStyle:
+    font: str
+    font_size: int
+    line_height: int
+    color: str
+    background: str
+
 
 @dataclasses.dataclass
-class ScriptItem:
+class Styles:
+    title: TextStyle
+    subtitle: TextStyle
+    translation: TextStyle
+
+
+@dataclasses.dataclass
+class Transitions:
+    image: List[str]
+    text: str
+    duration_ms: int
+
+
+@dataclasses.dataclass
+class Bgm:
+    path: str
+    volume: float
+
+
+@dataclasses.dataclass
+class Output:
+    file: str
+    video_codec: str
+    audio_codec: str
+
+
+@dataclasses.dataclass
+class RenderItem:
     cn: str
     en: str
-    image_prompt: str
     voice_path: str
-    image_path: str = ''
+    image_path: str
+    pause_ms: int
+    start_ms: int = 0
+    duration_ms: int = 0
+
 
 @dataclasses.dataclass
-class MovieMeta:
+class RenderSpec:
+    version: int
     title: str
-    script_items: List[ScriptItem]
-    workdir: str = ''
+    width: int
+    height: int
+    fps: int
+    background: str
+    layout: Layout
+    styles: Styles
+    transitions: Transitions
+    voice_volume: float
+    output: Output
+    items: List[RenderItem]
+    bgm: Optional[Bgm] = None
 
+    @staticmethod
+    def from_dict(data: dict) -> "RenderSpec":
+        layout = data["layout"]
+        styles = data["styles"]
+        return RenderSpec(
+            version=data["version"],
+            title=data["title"],
+            width=data["width"],
+            height=data["height"],
+            fps=data["fps"],
+            background=data["background"],
+            layout=Layout(
+                padding=layout["padding"],
+                band=Rect(**layout["band"]),
+                band_color=layout["band_color"],
+                marker_size=layout["marker_size"],
+                marker_color=layout["marker_color"],
+                title=Position(**layout["title"]),
+                image=Rect(**layout["image"]),
+                subtitle=Position(**layout["subtitle"]),
+                translation=Position(**layout["translation"]),
+            ),
+            styles=Styles(**{k: TextStyle(**v) for k, v in styles.items()}),
+            transitions=Transitions(**data["transitions"]),
+            voice_volume=data["voice_volume"],
+            output=Output(**data["output"]),
+            items=[RenderItem(**item) for item in data["items"]],
+            bgm=Bgm(**data["bgm"]) if data.get("bgm") else None,
+        )
@@ -0,0 +1,232 @@
+// Package media reads and writes the files around a movie which are not
+// generated by AI providers: mp3 durations and subtitle files.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mp3Info describes an mp3 stream.
+type Mp3Info struct {
+	Duration   time.Duration
+	Frames     int
+	SampleRate int
+	Channels   int
+}
+
+var ErrNotMp3 = errors.New("no mp3 frames found")
+
+// mpeg versions as encoded in the frame header
+const (
+	mpeg25 = 0
+	mpeg2  = 2
+	mpeg1  = 3
+)
+
+var mp3Bitrates = map[[2]int][16]int{
+	// {version is mpeg1, layer} => kbps by index, 0 is free format
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{0, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mp3SampleRates = map[int][3]int{
+	mpeg1:  {44100, 48000, 32000},
+	mpeg2:  {22050, 24000, 16000},
+	mpeg25: {11025, 12000, 8000},
+}
+
+type mp3Frame struct {
+	version    int
+	layer      int
+	sampleRate int
+	channels   int
+	size       int
+	samples    int
+}
+
+// parseMp3Frame decodes the 4 byte frame header at the start of b.
+func parseMp3Frame(b []byte) (mp3Frame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+
+	f := mp3Frame{
+		version: int(b[1]>>3) & 0x03,
+		layer:   4 - int(b[1]>>1)&0x03,
+	}
+	if f.version == 1 || f.layer == 4 {
+		return f, false // reserved
+	}
+
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int(b[2]>>2) & 0x03
+	padding := int(b[2]>>1) & 0x01
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return f, false // free format is not supported
+	}
+
+	v1 := 0
+	if f.version == mpeg1 {
+		v1 = 1
+	}
+	bitrate := mp3Bitrates[[2]int{v1, f.layer}][bitrateIndex] * 1000
+	f.sampleRate = mp3SampleRates[f.version][sampleRateIndex]
+
+	f.channels = 2
+	if b[3]>>6 == 0x03 {
+		f.channels = 1
+	}
+
+	switch {
+	case f.layer == 1:
+		f.samples = 384
+		f.size = (12*bitrate/f.sampleRate + padding) * 4
+	case f.layer == 3 && f.version != mpeg1:
+		f.samples = 576
+		f.size = 72*bitrate/f.sampleRate + padding
+	default:
+		f.samples = 1152
+		f.size = 144*bitrate/f.sampleRate + padding
+	}
+
+	return f, f.size > 4
+}
+
+// xingFrames reads the frame count of a Xing/Info header in the first
+// frame, which VBR encoders write because frames differ in size.
+func xingFrames(frame []byte, f mp3Frame) (int, bool, bool) {
+	offset := 4
+	switch {
+	case f.version == mpeg1 && f.channels == 1:
+		offset += 17
+	case f.version == mpeg1:
+		offset += 32
+	case f.channels == 1:
+		offset += 9
+	default:
+		offset += 17
+	}
+
+	if len(frame) < offset+12 {
+		return 0, false, false
+	}
+
+	tag := frame[offset : offset+4]
+	if !bytes.Equal(tag, []byte("Xing")) && !bytes.Equal(tag, []byte("Info")) {
+		return 0, false, false
+	}
+
+	flags := binary.BigEndian.Uint32(frame[offset+4:])
+	if flags&0x01 == 0 {
+		return 0, false, true
+	}
+
+	return int(binary.BigEndian.Uint32(frame[offset+8:])), true, true
+}
+
+// skipID3v2 returns where the audio starts after an optional ID3v2 tag.
+func skipID3v2(data []byte) int {
+	if len(data) < 10 || !bytes.Equal(data[:3], []byte("ID3")) {
+		return 0
+	}
+
+	// synchsafe integer, 7 bits per byte
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	size += 10
+	if data[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+
+	return size
+}
+
+// ParseMp3 works out the duration of mp3 data from its frame headers,
+// without decoding any audio.
+func ParseMp3(data []byte) (*Mp3Info, error) {
+	pos := skipID3v2(data)
+
+	// find the first frame, a following frame header guards against sync
+	// words inside other data
+	var first mp3Frame
+	for ; pos+4 <= len(data); pos++ {
+		f, ok := parseMp3Frame(data[pos:])
+		if !ok {
+			continue
+		}
+
+		next := pos + f.size
+		if next+4 <= len(data) {
+			if _, ok := parseMp3Frame(data[next:]); !ok {
+				continue
+			}
+		} else if next > len(data) {
+			continue
+		}
+
+		first = f
+		break
+	}
+
+	if pos+4 > len(data) {
+		return nil, ErrNotMp3
+	}
+
+	info := &Mp3Info{SampleRate: first.sampleRate, Channels: first.channels}
+	if frames, ok, isXing := xingFrames(data[pos:min(pos+first.size, len(data))], first); isXing {
+		if ok {
+			info.Frames = frames
+			info.Duration = framesDuration(frames, first)
+			return info, nil
+		}
+
+		// the tag frame holds no audio
+		pos += first.size
+	}
+
+	samples := 0
+	for pos+4 <= len(data) {
+		f, ok := parseMp3Frame(data[pos:])
+		if !ok || pos+f.size > len(data) {
+			break // trailing ID3v1 tag, garbage or a truncated frame
+		}
+
+		info.Frames++
+		samples += f.samples
+		pos += f.size
+	}
+
+	if info.Frames == 0 {
+		return nil, ErrNotMp3
+	}
+
+	info.Duration = time.Duration(samples) * time.Second / time.Duration(info.SampleRate)
+	return info, nil
+}
+
+func framesDuration(frames int, f mp3Frame) time.Duration {
+	return time.Duration(frames*f.samples) * time.Second / time.Duration(f.sampleRate)
+}
+
+// Mp3Duration returns the duration of the mp3 file at path.
+func Mp3Duration(path string) (time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	info, err := ParseMp3(data)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	return info.Duration, nil
+}
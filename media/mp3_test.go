@@ -0,0 +1,65 @@
+package media
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// frames builds n silent MPEG-1 Layer III frames, 32kbps 32kHz mono, which
+// are 144 bytes and 36ms each.
+func frames(n int) []byte {
+	frame := make([]byte, 144)
+	copy(frame, []byte{0xFF, 0xFB, 0x18, 0xC0})
+
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = append(buf, frame...)
+	}
+	return buf
+}
+
+func TestParseMp3(t *testing.T) {
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x01\x00"), make([]byte, 128)...) // 128 byte tag
+
+	xing := frames(1)
+	copy(xing[4+17:], "Xing")
+	binary.BigEndian.PutUint32(xing[4+17+4:], 1)
+	binary.BigEndian.PutUint32(xing[4+17+8:], 250)
+
+	info := frames(1)
+	copy(info[4+17:], "Info")
+
+	for name, c := range map[string]struct {
+		data []byte
+		want time.Duration
+	}{
+		"cbr":          {frames(100), 3600 * time.Millisecond},
+		"id3v2":        {append(id3, frames(10)...), 360 * time.Millisecond},
+		"id3v1":        {append(frames(10), append([]byte("TAG"), make([]byte, 125)...)...), 360 * time.Millisecond},
+		"leading junk": {append([]byte{0xFF, 0x00, 0x12}, frames(5)...), 180 * time.Millisecond},
+		"xing":         {append(xing, frames(3)...), 9000 * time.Millisecond},
+		"info":         {append(info, frames(3)...), 108 * time.Millisecond},
+		"single":       {frames(1), 36 * time.Millisecond},
+	} {
+		got, err := ParseMp3(c.data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if got.Duration != c.want || got.SampleRate != 32000 || got.Channels != 1 {
+			t.Errorf("%s: expected %s, got %+v", name, c.want, got)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"text":      []byte("not an mp3 at all"),
+		"truncated": frames(1)[:100],
+	} {
+		if _, err := ParseMp3(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package media
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cue is one timed subtitle, Cn and En are the two languages of a script
+// item.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Cn    string
+	En    string
+}
+
+const (
+	FormatSRT = "srt"
+	FormatVTT = "vtt"
+	FormatASS = "ass"
+
+	LangCn   = "cn"
+	LangEn   = "en"
+	LangBoth = "both"
+)
+
+var (
+	SubtitleFormats = []string{FormatSRT, FormatVTT, FormatASS}
+	SubtitleLangs   = []string{LangCn, LangEn, LangBoth}
+)
+
+// SubtitleContentTypes are the mime types of the subtitle formats.
+var SubtitleContentTypes = map[string]string{
+	FormatSRT: "application/x-subrip; charset=utf-8",
+	FormatVTT: "text/vtt; charset=utf-8",
+	FormatASS: "text/x-ssa; charset=utf-8",
+}
+
+// lines returns the text of c in lang, top line first.
+func (c Cue) lines(lang string) []string {
+	switch lang {
+	case LangCn:
+		return []string{c.Cn}
+	case LangEn:
+		return []string{c.En}
+	}
+
+	return []string{c.Cn, c.En}
+}
+
+// AssStyle is an ASS style, colors are "#rrggbb".
+type AssStyle struct {
+	Font       string
+	FontSize   int
+	Color      string
+	Background string
+	MarginV    int // distance from the bottom of the video
+}
+
+// AssOptions lays out ASS subtitles, Cn and En are used for the two tracks
+// of bilingual subtitles.
+type AssOptions struct {
+	Width  int
+	Height int
+	Cn     AssStyle
+	En     AssStyle
+}
+
+// WriteSubtitles writes cues in format, lang selects the languages.
+func WriteSubtitles(w io.Writer, format, lang string, cues []Cue, opts AssOptions) error {
+	if lang != LangCn && lang != LangEn && lang != LangBoth {
+		return errors.Errorf("unknown subtitle language %q", lang)
+	}
+
+	switch format {
+	case FormatSRT:
+		return WriteSRT(w, lang, cues)
+	case FormatVTT:
+		return WriteVTT(w, lang, cues)
+	case FormatASS:
+		return WriteASS(w, lang, cues, opts)
+	}
+
+	return errors.Errorf("unknown subtitle format %q", format)
+}
+
+// WriteSRT writes SubRip subtitles.
+func WriteSRT(w io.Writer, lang string, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cues {
+		fmt.Fprintf(bw, "%d\n%s --> %s\n", i+1, srtTime(c.Start), srtTime(c.End))
+		for _, line := range c.lines(lang) {
+			fmt.Fprintln(bw, oneLine(line))
+		}
+		fmt.Fprintln(bw)
+	}
+
+	return bw.Flush()
+}
+
+// WriteVTT writes WebVTT subtitles.
+func WriteVTT(w io.Writer, lang string, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "WEBVTT\n\n")
+	for i, c := range cues {
+		fmt.Fprintf(bw, "%d\n%s --> %s\n", i+1, vttTime(c.Start), vttTime(c.End))
+		for _, line := range c.lines(lang) {
+			fmt.Fprintln(bw, vttEscaper.Replace(oneLine(line)))
+		}
+		fmt.Fprintln(bw)
+	}
+
+	return bw.Flush()
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// WriteASS writes Advanced SubStation Alpha subtitles, with lang both the
+// chinese and english lines are separate events in their own styles.
+func WriteASS(w io.Writer, lang string, cues []Cue, opts AssOptions) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "[Script Info]\nScriptType: v4.00+\nPlayResX: %d\nPlayResY: %d\nWrapStyle: 0\nScaledBorderAndShadow: yes\n\n",
+		opts.Width, opts.Height)
+
+	fmt.Fprint(bw, "[V4+ Styles]\n")
+	fmt.Fprint(bw, "Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, "+
+		"Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, "+
+		"Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	for _, s := range []struct {
+		name  string
+		style AssStyle
+	}{{"CN", opts.Cn}, {"EN", opts.En}} {
+		// BorderStyle 3 draws an opaque box in OutlineColour behind the text
+		fmt.Fprintf(bw, "Style: %s,%s,%d,%s,%s,%s,%s,0,0,0,0,100,100,0,0,3,2,0,2,10,10,%d,1\n",
+			s.name, s.style.Font, s.style.FontSize, assColor(s.style.Color), assColor(s.style.Color),
+			assColor(s.style.Background), assColor(s.style.Background), s.style.MarginV)
+	}
+
+	fmt.Fprint(bw, "\n[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+	for _, c := range cues {
+		for _, track := range []struct {
+			lang  string
+			style string
+			text  string
+		}{{LangCn, "CN", c.Cn}, {LangEn, "EN", c.En}} {
+			if lang != LangBoth && lang != track.lang {
+				continue
+			}
+
+			fmt.Fprintf(bw, "Dialogue: 0,%s,%s,%s,,0,0,0,,%s\n",
+				assTime(c.Start), assTime(c.End), track.style, assEscaper.Replace(oneLine(track.text)))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// braces would start override tags
+var assEscaper = strings.NewReplacer("{", "(", "}", ")")
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func splitTime(d time.Duration) (h, m, s, ms int64) {
+	if d < 0 {
+		d = 0
+	}
+
+	total := d.Milliseconds()
+	return total / 3600000, total / 60000 % 60, total / 1000 % 60, total % 1000
+}
+
+func srtTime(d time.Duration) string {
+	h, m, s, ms := splitTime(d)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", h, m, s, ms)
+}
+
+func vttTime(d time.Duration) string {
+	h, m, s, ms := splitTime(d)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+}
+
+func assTime(d time.Duration) string {
+	h, m, s, ms := splitTime(d)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", h, m, s, ms/10)
+}
+
+// assColor turns "#rrggbb" into ASS &HAABBGGRR.
+func assColor(c string) string {
+	if len(c) != 7 || c[0] != '#' {
+		return "&H00FFFFFF"
+	}
+
+	return strings.ToUpper("&H00" + c[5:7] + c[3:5] + c[1:3])
+}
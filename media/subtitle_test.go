@@ -0,0 +1,86 @@
+package media
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCues = []Cue{
+	{Start: 0, End: 1500 * time.Millisecond, Cn: "金牛座的人做事踏实", En: "taurus people are <steady>"},
+	{Start: 1800 * time.Millisecond, End: 3723456 * time.Millisecond, Cn: "热爱{美食}", En: "they love\nfood"},
+}
+
+func write(t *testing.T, format, lang string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	opts := AssOptions{
+		Width:  1080,
+		Height: 1920,
+		Cn:     AssStyle{Font: "Sans", FontSize: 50, Color: "#000000", Background: "#ffffff", MarginV: 673},
+		En:     AssStyle{Font: "Sans", FontSize: 30, Color: "#112233", Background: "#ffffff", MarginV: 613},
+	}
+	if err := WriteSubtitles(&buf, format, lang, testCues, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestWriteSRT(t *testing.T) {
+	want := "1\n00:00:00,000 --> 00:00:01,500\n金牛座的人做事踏实\ntaurus people are <steady>\n\n" +
+		"2\n00:00:01,800 --> 01:02:03,456\n热爱{美食}\nthey love food\n\n"
+	if got := write(t, FormatSRT, LangBoth); got != want {
+		t.Fatalf("unexpected srt:\n%s", got)
+	}
+
+	want = "1\n00:00:00,000 --> 00:00:01,500\ntaurus people are <steady>\n\n" +
+		"2\n00:00:01,800 --> 01:02:03,456\nthey love food\n\n"
+	if got := write(t, FormatSRT, LangEn); got != want {
+		t.Fatalf("unexpected english srt:\n%s", got)
+	}
+}
+
+func TestWriteVTT(t *testing.T) {
+	want := "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.500\n金牛座的人做事踏实\n\n" +
+		"2\n00:00:01.800 --> 01:02:03.456\n热爱{美食}\n\n"
+	if got := write(t, FormatVTT, LangCn); got != want {
+		t.Fatalf("unexpected vtt:\n%s", got)
+	}
+
+	if got := write(t, FormatVTT, LangEn); !strings.Contains(got, "taurus people are &lt;steady&gt;\n") {
+		t.Fatalf("vtt text is not escaped:\n%s", got)
+	}
+}
+
+func TestWriteASS(t *testing.T) {
+	got := write(t, FormatASS, LangBoth)
+	for _, want := range []string{
+		"PlayResX: 1080\nPlayResY: 1920\n",
+		"Style: CN,Sans,50,&H00000000,&H00000000,&H00FFFFFF,&H00FFFFFF,0,0,0,0,100,100,0,0,3,2,0,2,10,10,673,1\n",
+		"Style: EN,Sans,30,&H00332211,&H00332211,&H00FFFFFF,&H00FFFFFF,0,0,0,0,100,100,0,0,3,2,0,2,10,10,613,1\n",
+		"Dialogue: 0,0:00:00.00,0:00:01.50,CN,,0,0,0,,金牛座的人做事踏实\n" +
+			"Dialogue: 0,0:00:00.00,0:00:01.50,EN,,0,0,0,,taurus people are <steady>\n",
+		"Dialogue: 0,0:00:01.80,1:02:03.45,CN,,0,0,0,,热爱(美食)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("ass misses %q:\n%s", want, got)
+		}
+	}
+
+	if got := write(t, FormatASS, LangCn); strings.Contains(got, ",EN,,") {
+		t.Fatalf("chinese only ass has english events:\n%s", got)
+	}
+}
+
+func TestWriteSubtitlesInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSubtitles(&buf, "sub", LangCn, testCues, AssOptions{}); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+	if err := WriteSubtitles(&buf, FormatSRT, "jp", testCues, AssOptions{}); err == nil {
+		t.Fatal("unknown language should fail")
+	}
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var AICallCreationSchema = `
+CREATE TABLE IF NOT EXISTS ai_calls (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER, -- 电影ID，不属于电影的调用为空
+	item_index INTEGER, -- 脚本条目序号，不属于单个条目的调用为空
+	kind TEXT NOT NULL, -- 类型 script/speech/image
+	provider TEXT NOT NULL, -- provider 名称
+	model TEXT NOT NULL DEFAULT '', -- 模型
+	prompt_hash TEXT NOT NULL DEFAULT '', -- 提示词 sha256
+	latency_ms INTEGER NOT NULL DEFAULT 0, -- 耗时，毫秒
+	status TEXT NOT NULL, -- 结果 ok/failed
+	error TEXT NOT NULL DEFAULT '', -- 错误信息
+	prompt_tokens INTEGER NOT NULL DEFAULT 0, -- 输入 token
+	completion_tokens INTEGER NOT NULL DEFAULT 0, -- 输出 token
+	characters INTEGER NOT NULL DEFAULT 0, -- 合成语音的字数
+	images INTEGER NOT NULL DEFAULT 0, -- 生成的图片数
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 创建时间，UTC
+);
+CREATE INDEX IF NOT EXISTS idx_ai_calls_movie_id ON ai_calls(movie_id);
+CREATE INDEX IF NOT EXISTS idx_ai_calls_created_at ON ai_calls(created_at);
+`
+
+// Outcomes of an AI call.
+const (
+	CallStatusOK     = "ok"
+	CallStatusFailed = "failed"
+)
+
+// AICall is one call to an AI provider.
+type AICall struct {
+	Id               int64     `db:"id" json:"id"`                               // ID
+	MovieId          *int64    `db:"movie_id" json:"movie_id"`                   // 电影ID
+	ItemIndex        *int64    `db:"item_index" json:"item_index"`               // 脚本条目序号
+	Kind             string    `db:"kind" json:"kind"`                           // 类型
+	Provider         string    `db:"provider" json:"provider"`                   // provider 名称
+	Model            string    `db:"model" json:"model"`                         // 模型
+	PromptHash       string    `db:"prompt_hash" json:"prompt_hash"`             // 提示词 sha256
+	LatencyMs        int64     `db:"latency_ms" json:"latency_ms"`               // 耗时，毫秒
+	Status           string    `db:"status" json:"status"`                       // 结果
+	Error            string    `db:"error" json:"error,omitempty"`               // 错误信息
+	PromptTokens     int64     `db:"prompt_tokens" json:"prompt_tokens"`         // 输入 token
+	CompletionTokens int64     `db:"completion_tokens" json:"completion_tokens"` // 输出 token
+	Characters       int64     `db:"characters" json:"characters"`               // 合成语音的字数
+	Images           int64     `db:"images" json:"images"`                       // 生成的图片数
+	CreatedAt        time.Time `db:"created_at" json:"created_at"`               // 创建时间
+}
+
+func (c *AICall) Create() error {
+	result, err := db.NamedExec("INSERT INTO ai_calls (movie_id, item_index, kind, provider, model, prompt_hash, "+
+		"latency_ms, status, error, prompt_tokens, completion_tokens, characters, images) "+
+		"VALUES (:movie_id, :item_index, :kind, :provider, :model, :prompt_hash, "+
+		":latency_ms, :status, :error, :prompt_tokens, :completion_tokens, :characters, :images)", c)
+	if err != nil {
+		return errors.Wrap(err, "failed to record ai call")
+	}
+
+	c.Id, _ = result.LastInsertId()
+	return nil
+}
+
+// ListAICalls lists the AI calls made for a movie, newest first.
+func ListAICalls(movieId int64, limit int) ([]*AICall, error) {
+	calls := make([]*AICall, 0)
+	if err := db.Select(&calls, "SELECT * FROM ai_calls WHERE movie_id = ? ORDER BY id DESC LIMIT ?",
+		movieId, limit); err != nil {
+		return nil, errors.Wrap(err, "failed to list ai calls")
+	}
+
+	return calls, nil
+}
+
+// CallUsage sums up the calls of one provider model, Day is only set for
+// the daily usage.
+type CallUsage struct {
+	Day              string  `db:"day" json:"day,omitempty"`
+	Kind             string  `db:"kind" json:"kind"`
+	Provider         string  `db:"provider" json:"provider"`
+	Model            string  `db:"model" json:"model"`
+	Calls            int64   `db:"calls" json:"calls"`                         // 调用次数
+	Failed           int64   `db:"failed" json:"failed"`                       // 失败次数
+	LatencyMs        int64   `db:"latency_ms" json:"latency_ms"`               // 总耗时，毫秒
+	PromptTokens     int64   `db:"prompt_tokens" json:"prompt_tokens"`         // 输入 token
+	CompletionTokens int64   `db:"completion_tokens" json:"completion_tokens"` // 输出 token
+	Characters       int64   `db:"characters" json:"characters"`               // 合成语音的字数
+	Images           int64   `db:"images" json:"images"`                       // 生成的图片数
+	Cost             float64 `db:"-" json:"cost"`                              // 费用
+	Priced           bool    `db:"-" json:"priced"`                            // 价格表中是否有该模型
+}
+
+const usageColumns = "kind, provider, model, COUNT(*) AS calls, " +
+	"SUM(status = 'failed') AS failed, SUM(latency_ms) AS latency_ms, " +
+	"SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens, " +
+	"SUM(characters) AS characters, SUM(images) AS images"
+
+// MovieUsage sums up the AI calls made for a movie by provider model.
+func MovieUsage(movieId int64) ([]*CallUsage, error) {
+	usage := make([]*CallUsage, 0)
+	if err := db.Select(&usage, "SELECT "+usageColumns+" FROM ai_calls WHERE movie_id = ? "+
+		"GROUP BY kind, provider, model ORDER BY kind, provider, model", movieId); err != nil {
+		return nil, errors.Wrap(err, "failed to sum up ai calls")
+	}
+
+	return usage, nil
+}
+
+// DailyUsage sums up the AI calls of the UTC days from to to, both
+// YYYY-MM-DD and included, by day and provider model.
+func DailyUsage(from, to string) ([]*CallUsage, error) {
+	usage := make([]*CallUsage, 0)
+	if err := db.Select(&usage, "SELECT date(created_at) AS day, "+usageColumns+" FROM ai_calls "+
+		"WHERE date(created_at) BETWEEN ? AND ? "+
+		"GROUP BY day, kind, provider, model ORDER BY day, kind, provider, model", from, to); err != nil {
+		return nil, errors.Wrap(err, "failed to sum up ai calls")
+	}
+
+	return usage, nil
+}
+
+// Price is what a provider model costs, an empty model prices every model
+// of the provider without a price of its own.
+type Price struct {
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model,omitempty"`
+	PromptTokens     float64 `json:"prompt_tokens"`     // 每百万输入 token
+	CompletionTokens float64 `json:"completion_tokens"` // 每百万输出 token
+	Characters       float64 `json:"characters"`        // 每千字语音
+	Images           float64 `json:"images"`            // 每张图片
+}
+
+// PriceTable is the layout of the --prices-config json file.
+type PriceTable struct {
+	Currency string  `json:"currency"`
+	Prices   []Price `json:"prices"`
+}
+
+func LoadPriceTable(path string) (*PriceTable, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read prices config %s", path)
+	}
+
+	var t PriceTable
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse prices config %s", path)
+	}
+
+	return &t, nil
+}
+
+// Price finds the price of a provider model.
+func (t *PriceTable) Price(provider, model string) (Price, bool) {
+	var fallback *Price
+	for i, p := range t.Prices {
+		if p.Provider != provider {
+			continue
+		}
+
+		if p.Model == model {
+			return p, true
+		}
+
+		if p.Model == "" {
+			fallback = &t.Prices[i]
+		}
+	}
+
+	if fallback != nil {
+		return *fallback, true
+	}
+
+	return Price{}, false
+}
+
+// Apply prices every usage and returns the total cost.
+func (t *PriceTable) Apply(usage []*CallUsage) float64 {
+	var total float64
+	for _, u := range usage {
+		p, ok := t.Price(u.Provider, u.Model)
+		u.Priced = ok
+		u.Cost = float64(u.PromptTokens)*p.PromptTokens/1e6 +
+			float64(u.CompletionTokens)*p.CompletionTokens/1e6 +
+			float64(u.Characters)*p.Characters/1e3 +
+			float64(u.Images)*p.Images
+		total += u.Cost
+	}
+
+	return total
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var AssetCreationSchema = `
+CREATE TABLE IF NOT EXISTS assets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER, -- 电影ID，不属于电影的文件为空
+	kind TEXT NOT NULL, -- 类型 voice/image/bgm/render/upload
+	path TEXT NOT NULL, -- 文件，相对 workdir
+	mime TEXT NOT NULL DEFAULT '', -- MIME 类型
+	size INTEGER NOT NULL DEFAULT 0, -- 文件大小，字节
+	sha256 TEXT NOT NULL DEFAULT '', -- 文件内容 sha256
+	duration_ms INTEGER NOT NULL DEFAULT 0, -- 音视频时长，毫秒
+	width INTEGER NOT NULL DEFAULT 0, -- 图片视频宽度
+	height INTEGER NOT NULL DEFAULT 0, -- 图片视频高度
+	provider TEXT NOT NULL DEFAULT '', -- 生成文件的 provider
+	model TEXT NOT NULL DEFAULT '', -- 生成文件的模型
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 创建时间
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_assets_movie_path ON assets(movie_id, kind, path);
+`
+
+// The kinds of files the assets table keeps track of.
+const (
+	AssetVoice  = "voice"  // 配音
+	AssetImage  = "image"  // 配图
+	AssetBgm    = "bgm"    // 背景音乐
+	AssetRender = "render" // 渲染结果
+	AssetUpload = "upload" // 上传的文件
+)
+
+// AssetKinds are the kinds assets can be listed by.
+var AssetKinds = []string{AssetVoice, AssetImage, AssetBgm, AssetRender, AssetUpload}
+
+// Asset is a file generated for or uploaded to the workdir.
+type Asset struct {
+	Id         int64     `db:"id" json:"id"`                   // ID
+	MovieId    *int64    `db:"movie_id" json:"movie_id"`       // 电影ID
+	Kind       string    `db:"kind" json:"kind"`               // 类型
+	Path       string    `db:"path" json:"path"`               // 文件，相对 workdir
+	Mime       string    `db:"mime" json:"mime"`               // MIME 类型
+	Size       int64     `db:"size" json:"size"`               // 文件大小，字节
+	Sha256     string    `db:"sha256" json:"sha256"`           // 文件内容 sha256
+	DurationMs int64     `db:"duration_ms" json:"duration_ms"` // 音视频时长，毫秒
+	Width      int       `db:"width" json:"width"`             // 宽度
+	Height     int       `db:"height" json:"height"`           // 高度
+	Provider   string    `db:"provider" json:"provider"`       // 生成文件的 provider
+	Model      string    `db:"model" json:"model"`             // 生成文件的模型
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`   // 创建时间
+}
+
+// Register records the asset, or brings the metadata of the asset with the
+// same movie, kind and path up to date, and sets its id.
+func (a *Asset) Register() error {
+	rows, err := db.NamedQuery("INSERT INTO assets (movie_id, kind, path, mime, size, sha256, "+
+		"duration_ms, width, height, provider, model) "+
+		"VALUES (:movie_id, :kind, :path, :mime, :size, :sha256, :duration_ms, :width, :height, :provider, :model) "+
+		"ON CONFLICT (movie_id, kind, path) DO UPDATE SET mime = excluded.mime, size = excluded.size, "+
+		"sha256 = excluded.sha256, duration_ms = excluded.duration_ms, width = excluded.width, "+
+		"height = excluded.height, provider = excluded.provider, model = excluded.model "+
+		"RETURNING id, created_at", a)
+	if err != nil {
+		return errors.Wrap(err, "failed to register asset")
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return errors.Wrap(err, "failed to register asset")
+		}
+		return errors.New("failed to register asset: no id returned")
+	}
+
+	return errors.Wrap(rows.Scan(&a.Id, &a.CreatedAt), "failed to register asset")
+}
+
+// GetAsset loads an asset, sql.ErrNoRows tells there is none.
+func GetAsset(id int64) (*Asset, error) {
+	var a Asset
+	if err := db.Get(&a, "SELECT * FROM assets WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// ListAssets lists the assets of a movie, all kinds when kind is empty,
+// oldest first.
+func ListAssets(movieId int64, kind string) ([]*Asset, error) {
+	assets := make([]*Asset, 0)
+	if err := db.Select(&assets, "SELECT * FROM assets WHERE movie_id = ? AND (? = '' OR kind = ?) ORDER BY id",
+		movieId, kind, kind); err != nil {
+		return nil, errors.Wrap(err, "failed to list assets")
+	}
+
+	return assets, nil
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+var AssetCacheCreationSchema = `
+CREATE TABLE IF NOT EXISTS asset_cache (
+	key TEXT PRIMARY KEY, -- provider、模型、声音和输入的 sha256
+	path TEXT NOT NULL, -- cas 中的文件，相对 workdir
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 创建时间
+);
+`
+
+// CachedAsset returns the file generated before for key, empty when there
+// is none.
+func CachedAsset(key string) (string, error) {
+	var path string
+	err := db.Get(&path, "SELECT path FROM asset_cache WHERE key = ?", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to look up asset cache")
+	}
+
+	return path, nil
+}
+
+// CacheAsset remembers path as the file generated for key.
+func CacheAsset(key, path string) error {
+	if _, err := db.Exec("INSERT OR REPLACE INTO asset_cache (key, path) VALUES (?, ?)", key, path); err != nil {
+		return errors.Wrap(err, "failed to cache asset")
+	}
+
+	return nil
+}
+
+// UncacheAsset forgets the file of key.
+func UncacheAsset(key string) error {
+	if _, err := db.Exec("DELETE FROM asset_cache WHERE key = ?", key); err != nil {
+		return errors.Wrap(err, "failed to uncache asset")
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type JobState string
+
+func (s JobState) String() string {
+	return string(s)
+}
+
+const (
+	JobStatePending   JobState = "pending"   // 等待执行
+	JobStateRunning   JobState = "running"   // 执行中
+	JobStateSucceeded JobState = "succeeded" // 执行成功
+	JobStateFailed    JobState = "failed"    // 执行失败
+)
+
+// MaxJobAttempts is how many times a job is picked up before it is given up,
+// a job which keeps crashing the server should not be retried forever.
+const MaxJobAttempts = 3
+
+// ErrJobInterrupted is the error of jobs given up after MaxJobAttempts.
+var ErrJobInterrupted = errors.New("interrupted too many times")
+
+var JobCreationSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER NOT NULL, -- 电影ID
+	kind TEXT NOT NULL, -- 任务类型
+	state TEXT NOT NULL, -- 状态
+	payload TEXT, -- 任务参数
+	progress INTEGER NOT NULL DEFAULT 0, -- 已完成数量
+	total INTEGER NOT NULL DEFAULT 0, -- 总数量
+	error TEXT, -- 错误信息
+	attempts INTEGER NOT NULL DEFAULT 0, -- 执行次数
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- 创建时间
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- 更新时间
+	started_at TIMESTAMP, -- 开始时间
+	finished_at TIMESTAMP -- 结束时间
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_state ON jobs(state);
+CREATE INDEX IF NOT EXISTS idx_jobs_movie_id ON jobs(movie_id);
+`
+
+type Job struct {
+	Id         int64          `db:"id"`          // 任务ID
+	MovieId    int64          `db:"movie_id"`    // 电影ID
+	Kind       string         `db:"kind"`        // 任务类型
+	State      string         `db:"state"`       // 状态
+	Payload    sql.NullString `db:"payload"`     // 任务参数
+	Progress   int            `db:"progress"`    // 已完成数量
+	Total      int            `db:"total"`       // 总数量
+	Error      sql.NullString `db:"error"`       // 错误信息
+	Attempts   int            `db:"attempts"`    // 执行次数
+	CreatedAt  time.Time      `db:"created_at"`  // 创建时间
+	UpdatedAt  time.Time      `db:"updated_at"`  // 更新时间
+	StartedAt  sql.NullTime   `db:"started_at"`  // 开始时间
+	FinishedAt sql.NullTime   `db:"finished_at"` // 结束时间
+}
+
+func NewJob(movieId int64, kind string, payload interface{}) (*Job, error) {
+	j := &Job{
+		MovieId: movieId,
+		Kind:    kind,
+		State:   JobStatePending.String(),
+	}
+
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal job payload")
+		}
+		j.Payload = sql.NullString{String: string(raw), Valid: true}
+	}
+
+	return j, nil
+}
+
+func (j *Job) Create() error {
+	result, err := db.NamedExec("INSERT INTO jobs (movie_id, kind, state, payload, total) "+
+		"VALUES (:movie_id, :kind, :state, :payload, :total)", j)
+	if err != nil {
+		return errors.Wrap(err, "failed to create job")
+	}
+
+	j.Id, _ = result.LastInsertId()
+
+	return j.reload()
+}
+
+func (j *Job) reload() error {
+	if err := db.Get(j, "SELECT * FROM jobs WHERE id = ?", j.Id); err != nil {
+		return errors.Wrapf(err, "failed to reload job %d", j.Id)
+	}
+
+	return nil
+}
+
+// DecodePayload unmarshals the job payload into v.
+func (j *Job) DecodePayload(v interface{}) error {
+	if !j.Payload.Valid {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(j.Payload.String), v); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal payload of job %d", j.Id)
+	}
+
+	return nil
+}
+
+// SetProgress records how many of total units of work are done.
+func (j *Job) SetProgress(progress, total int) error {
+	j.Progress = progress
+	j.Total = total
+
+	if _, err := db.NamedExec("UPDATE jobs SET progress = :progress, total = :total, "+
+		"updated_at = CURRENT_TIMESTAMP WHERE id = :id", j); err != nil {
+		return errors.Wrapf(err, "failed to update progress of job %d", j.Id)
+	}
+
+	return nil
+}
+
+// Requeue puts a job interrupted by a shutdown back into the queue, the
+// attempt does not count against MaxJobAttempts.
+func (j *Job) Requeue() error {
+	if _, err := db.Exec("UPDATE jobs SET state = ?, attempts = MAX(attempts - 1, 0), "+
+		"updated_at = CURRENT_TIMESTAMP WHERE id = ? AND state = ?",
+		JobStatePending.String(), j.Id, JobStateRunning.String()); err != nil {
+		return errors.Wrapf(err, "failed to requeue job %d", j.Id)
+	}
+
+	return j.reload()
+}
+
+// Finish moves the job into a terminal state, a nil cause means success.
+func (j *Job) Finish(cause error) error {
+	j.State = JobStateSucceeded.String()
+	j.Error = sql.NullString{}
+	if cause != nil {
+		j.State = JobStateFailed.String()
+		j.Error = sql.NullString{String: cause.Error(), Valid: true}
+	}
+
+	if _, err := db.NamedExec("UPDATE jobs SET state = :state, error = :error, "+
+		"updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP WHERE id = :id", j); err != nil {
+		return errors.Wrapf(err, "failed to finish job %d", j.Id)
+	}
+
+	return j.reload()
+}
+
+func (j *Job) Finished() bool {
+	return j.State == JobStateSucceeded.String() || j.State == JobStateFailed.String()
+}
+
+// ClaimNextJob atomically marks the oldest pending job as running and
+// returns it, nil is returned when there is nothing to do.
+func ClaimNextJob() (*Job, error) {
+	var job Job
+
+	err := db.Get(&job, `UPDATE jobs SET state = ?, attempts = attempts + 1,
+		started_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (SELECT id FROM jobs WHERE state = ? ORDER BY id LIMIT 1)
+		RETURNING *`, JobStateRunning.String(), JobStatePending.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to claim job")
+	}
+
+	return &job, nil
+}
+
+// RequeueRunningJobs puts jobs which were running when the process died back
+// into the queue, jobs which already used up their attempts are failed and
+// returned so their movies can be cleaned up.
+func RequeueRunningJobs() (int64, []*Job, error) {
+	failed := make([]*Job, 0)
+	if err := db.Select(&failed, `UPDATE jobs SET state = ?, error = ?,
+		updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP
+		WHERE state = ? AND attempts >= ? RETURNING *`,
+		JobStateFailed.String(), ErrJobInterrupted.Error(),
+		JobStateRunning.String(), MaxJobAttempts); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to fail interrupted jobs")
+	}
+
+	result, err := db.Exec("UPDATE jobs SET state = ?, updated_at = CURRENT_TIMESTAMP WHERE state = ?",
+		JobStatePending.String(), JobStateRunning.String())
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to requeue running jobs")
+	}
+
+	requeued, err := result.RowsAffected()
+	return requeued, failed, err
+}
+
+func GetJob(id int64) (*Job, error) {
+	var job Job
+	if err := db.Get(&job, "SELECT * FROM jobs WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func ListMovieJobs(movieId int64) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+
+	if err := db.Select(&jobs, "SELECT * FROM jobs WHERE movie_id = ? ORDER BY id DESC", movieId); err != nil {
+		return nil, errors.Wrap(err, "failed to list jobs")
+	}
+
+	return jobs, nil
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	var payload json.RawMessage
+	if j.Payload.Valid {
+		payload = json.RawMessage(j.Payload.String)
+	}
+
+	var startedAt, finishedAt *time.Time
+	if j.StartedAt.Valid {
+		startedAt = &j.StartedAt.Time
+	}
+	if j.FinishedAt.Valid {
+		finishedAt = &j.FinishedAt.Time
+	}
+
+	return json.Marshal(struct {
+		Id         int64           `json:"id"`
+		MovieId    int64           `json:"movie_id"`
+		Kind       string          `json:"kind"`
+		State      string          `json:"state"`
+		Payload    json.RawMessage `json:"payload,omitempty"`
+		Progress   int             `json:"progress"`
+		Total      int             `json:"total"`
+		Error      string          `json:"error,omitempty"`
+		Attempts   int             `json:"attempts"`
+		CreatedAt  time.Time       `json:"created_at"`
+		UpdatedAt  time.Time       `json:"updated_at"`
+		StartedAt  *time.Time      `json:"started_at,omitempty"`
+		FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	}{
+		Id:         j.Id,
+		MovieId:    j.MovieId,
+		Kind:       j.Kind,
+		State:      j.State,
+		Payload:    payload,
+		Progress:   j.Progress,
+		Total:      j.Total,
+		Error:      j.Error.String,
+		Attempts:   j.Attempts,
+		CreatedAt:  j.CreatedAt,
+		UpdatedAt:  j.UpdatedAt,
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+	})
+}
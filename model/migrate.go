@@ -0,0 +1,251 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Migration is one versioned schema change, Up and Down run inside a
+// transaction together with the schema_migrations bookkeeping.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sqlx.Tx) error
+	Down    func(tx *sqlx.Tx) error
+}
+
+// MigrationStatus is a known migration and whether it is applied.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+var SchemaMigrationCreationSchema = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY, -- 版本号
+	name TEXT NOT NULL, -- 名称
+	applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 执行时间
+);
+`
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// binary, running against it could corrupt data.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// execSQL is a migration step running stmt as is.
+func execSQL(stmt string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// addColumn adds a column unless the table already has it.
+func addColumn(tx *sqlx.Tx, table, column, decl string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// dropColumn drops a column if the table has it.
+func dropColumn(tx *sqlx.Tx, table, column string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column))
+	return err
+}
+
+func hasColumn(tx *sqlx.Tx, table, column string) (bool, error) {
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column); err != nil {
+		return false, errors.Wrapf(err, "failed to inspect table %s", table)
+	}
+
+	return count > 0, nil
+}
+
+// LatestVersion is the schema version this binary expects.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentVersion is the highest applied migration, 0 for an empty database.
+func CurrentVersion() (int, error) {
+	if _, err := db.Exec(SchemaMigrationCreationSchema); err != nil {
+		return 0, errors.Wrap(err, "failed to create schema_migrations table")
+	}
+
+	var version sql.NullInt64
+	if err := db.Get(&version, "SELECT MAX(version) FROM schema_migrations"); err != nil {
+		return 0, errors.Wrap(err, "failed to read schema version")
+	}
+
+	return int(version.Int64), nil
+}
+
+// CheckSchemaVersion fails with ErrSchemaTooNew if the database has
+// migrations this binary does not know about.
+func CheckSchemaVersion() error {
+	current, err := CurrentVersion()
+	if err != nil {
+		return err
+	}
+
+	if current > LatestVersion() {
+		return errors.Wrapf(ErrSchemaTooNew, "database is at version %d, this binary supports up to %d",
+			current, LatestVersion())
+	}
+
+	return nil
+}
+
+// Migrate checks the schema is not too new and applies all pending
+// migrations, it is what the server runs on start.
+func Migrate() error {
+	if err := CheckSchemaVersion(); err != nil {
+		return err
+	}
+
+	_, err := MigrateUp(0)
+	return err
+}
+
+// MigrateUp applies pending migrations in order up to and including target,
+// target 0 means the latest version.
+func MigrateUp(target int) ([]Migration, error) {
+	if target == 0 {
+		target = LatestVersion()
+	}
+
+	current, err := CurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+
+		if err := runMigration(m, true); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first.
+func MigrateDown(steps int) ([]Migration, error) {
+	current, err := CurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if current > LatestVersion() {
+		return nil, errors.Wrapf(ErrSchemaTooNew, "can not revert unknown version %d", current)
+	}
+
+	reverted := make([]Migration, 0)
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+
+		if err := runMigration(m, false); err != nil {
+			return reverted, err
+		}
+
+		reverted = append(reverted, m)
+	}
+
+	return reverted, nil
+}
+
+func runMigration(m Migration, up bool) error {
+	direction, step := "up", m.Up
+	if !up {
+		direction, step = "down", m.Down
+	}
+
+	log.Info().Msgf("Migrating %s %d %s", direction, m.Version, m.Name)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return errors.Wrapf(err, "migration %d %s %s failed", m.Version, m.Name, direction)
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to record migration %d", m.Version)
+	}
+
+	return errors.Wrapf(tx.Commit(), "failed to commit migration %d", m.Version)
+}
+
+// ListMigrationStatus lists every migration known to the binary plus the
+// applied ones it does not know.
+func ListMigrationStatus() ([]*MigrationStatus, error) {
+	if _, err := CurrentVersion(); err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Version   int       `db:"version"`
+		Name      string    `db:"name"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := db.Select(&rows, "SELECT * FROM schema_migrations ORDER BY version"); err != nil {
+		return nil, errors.Wrap(err, "failed to list applied migrations")
+	}
+
+	list := make([]*MigrationStatus, 0, len(migrations))
+	byVersion := map[int]*MigrationStatus{}
+	for _, m := range migrations {
+		s := &MigrationStatus{Version: m.Version, Name: m.Name}
+		byVersion[m.Version] = s
+		list = append(list, s)
+	}
+
+	for _, row := range rows {
+		appliedAt := row.AppliedAt
+		s, ok := byVersion[row.Version]
+		if !ok {
+			s = &MigrationStatus{Version: row.Version, Name: row.Name + " (unknown)"}
+			list = append(list, s)
+		}
+
+		s.Applied = true
+		s.AppliedAt = &appliedAt
+	}
+
+	return list, nil
+}
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	if err := Init(filepath.Join(t.TempDir(), "mpu.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close() })
+}
+
+func TestMigrateUpDownRoundTrip(t *testing.T) {
+	openTestDB(t)
+
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := CurrentVersion(); err != nil || v != LatestVersion() {
+		t.Fatalf("expected version %d, got %d %v", LatestVersion(), v, err)
+	}
+
+	reverted, err := MigrateDown(len(migrations))
+	if err != nil || len(reverted) != len(migrations) {
+		t.Fatalf("failed to revert all migrations: %d %v", len(reverted), err)
+	}
+
+	var tables int
+	if err := db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')"); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("expected no tables after reverting everything, got %d", tables)
+	}
+
+	// applying twice must be a no-op
+	for i := 0; i < 2; i++ {
+		if _, err := MigrateUp(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := GetTemplateByName("sign"); err != nil {
+		t.Fatalf("default template not seeded: %v", err)
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	openTestDB(t)
+
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", LatestVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestMigrateScriptItems(t *testing.T) {
+	openTestDB(t)
+
+	if _, err := MigrateUp(9); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := `{"title":"金牛座","script_items":[` +
+		`{"cn":"第一句","en":"first","voice_path":"/movie/1/audio/a.mp3","image_prompt":"山","duration_ms":1200},` +
+		`{"cn":"第二句","en":"second","image_prompt":"水"}]}`
+	if _, err := db.Exec("INSERT INTO movies (tpl_name, state, script) VALUES ('sign', 'voiced', ?)", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+
+	movie, err := GetMovie(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := movie.Script.ScriptItems
+	if movie.Script.Title != "金牛座" || len(items) != 2 || items[1].ZhSubtitle != "第二句" ||
+		items[0].VoiceStatus != ItemStatusDone || items[1].VoiceStatus != ItemStatusPending || items[0].DurationMs != 1200 {
+		t.Fatalf("unexpected script after migration %s", movie.Script)
+	}
+
+	asset, err := GetAsset(items[0].VoiceAsset)
+	if err != nil || asset.Kind != AssetVoice || asset.Path != "movie/1/audio/a.mp3" || asset.DurationMs != 1200 ||
+		items[0].VoicePath != asset.Path || items[1].VoiceAsset != 0 {
+		t.Fatalf("the voice should be registered as an asset: %+v %v", asset, err)
+	}
+
+	if revisions, err := ListScriptRevisions(1); err != nil || len(revisions) != 1 || revisions[0].Source != RevisionSourceImport {
+		t.Fatalf("the migrated script should be the first revision: %+v %v", revisions, err)
+	}
+
+	if _, err := MigrateDown(LatestVersion() - 9); err != nil {
+		t.Fatal(err)
+	}
+
+	var script string
+	if err := db.Get(&script, "SELECT script FROM movies WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored MovieScript
+	if err := json.Unmarshal([]byte(script), &restored); err != nil || restored.Title != "金牛座" ||
+		len(restored.ScriptItems) != 2 || restored.ScriptItems[0].VoicePath != "movie/1/audio/a.mp3" {
+		t.Fatalf("script not restored: %s %v", script, err)
+	}
+}
@@ -0,0 +1,308 @@
+package model
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// migrations is the schema history, append new migrations at the end and
+// never change one which was released. Version 1 matches what the old
+// InitDB created, so databases from before migrations upgrade in place.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create templates, audios and movies",
+		Up: func(tx *sqlx.Tx) error {
+			for _, stmt := range []string{
+				TemplateCreationSchema,
+				AudioCreationSchema,
+				MovieCreationSchema,
+				TemplateInitializationStat,
+			} {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: execSQL(`
+DROP TABLE IF EXISTS movies;
+DROP TABLE IF EXISTS audios;
+DROP TABLE IF EXISTS templates;
+`),
+	},
+	{
+		Version: 2,
+		Name:    "create jobs",
+		Up:      execSQL(JobCreationSchema),
+		Down:    execSQL("DROP TABLE IF EXISTS jobs;"),
+	},
+	{
+		Version: 3,
+		Name:    "create movie_state_transitions",
+		Up:      execSQL(MovieStateTransitionCreationSchema),
+		Down:    execSQL("DROP TABLE IF EXISTS movie_state_transitions;"),
+	},
+	{
+		Version: 4,
+		Name:    "add movie providers",
+		Up: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"script_provider", "speech_provider", "image_provider"} {
+				if err := addColumn(tx, "movies", column, "TEXT"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"script_provider", "speech_provider", "image_provider"} {
+				if err := dropColumn(tx, "movies", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add movie render output",
+		Up: func(tx *sqlx.Tx) error {
+			if err := addColumn(tx, "movies", "output_path", "TEXT"); err != nil {
+				return err
+			}
+			return addColumn(tx, "movies", "output_duration_ms", "INTEGER")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"output_path", "output_duration_ms"} {
+				if err := dropColumn(tx, "movies", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add movie durations",
+		Up: func(tx *sqlx.Tx) error {
+			if err := addColumn(tx, "movies", "duration_ms", "INTEGER"); err != nil {
+				return err
+			}
+			return addColumn(tx, "movies", "target_duration_ms", "INTEGER")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"duration_ms", "target_duration_ms"} {
+				if err := dropColumn(tx, "movies", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add movie preset",
+		Up: func(tx *sqlx.Tx) error {
+			return addColumn(tx, "movies", "preset", "TEXT")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			return dropColumn(tx, "movies", "preset")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add movie script artifacts",
+		Up: func(tx *sqlx.Tx) error {
+			return addColumn(tx, "movies", "script_artifacts", "TEXT")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			return dropColumn(tx, "movies", "script_artifacts")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add template prompt, style and layout",
+		Up: func(tx *sqlx.Tx) error {
+			for _, column := range templateColumns {
+				if err := addColumn(tx, "templates", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+					return err
+				}
+			}
+
+			// the stick figure style used to be part of the system prompt
+			_, err := tx.Exec("UPDATE templates SET image_style = ? WHERE name = 'sign' AND image_style = ''",
+				"火柴人，矢量图，黑白图标风格，简约，透明底色，线条粗细适中，线条清晰，线条流畅，线条简洁，线条不交叉，线条不重叠")
+			return err
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range templateColumns {
+				if err := dropColumn(tx, "templates", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 10,
+		Name:    "move script items into their own table",
+		Up: func(tx *sqlx.Tx) error {
+			for _, stmt := range []string{
+				ScriptItemCreationSchema,
+				`INSERT INTO script_items (movie_id, position, cn, en, image_prompt, voice_path, duration_ms, image_path, voice_status, image_status)
+SELECT m.id, CAST(j.key AS INTEGER),
+	COALESCE(json_extract(j.value, '$.cn'), ''),
+	COALESCE(json_extract(j.value, '$.en'), ''),
+	COALESCE(json_extract(j.value, '$.image_prompt'), ''),
+	COALESCE(json_extract(j.value, '$.voice_path'), ''),
+	COALESCE(json_extract(j.value, '$.duration_ms'), 0),
+	COALESCE(json_extract(j.value, '$.image_path'), ''),
+	CASE WHEN COALESCE(json_extract(j.value, '$.voice_path'), '') = '' THEN 'pending' ELSE 'done' END,
+	CASE WHEN COALESCE(json_extract(j.value, '$.image_path'), '') = '' THEN 'pending' ELSE 'done' END
+FROM movies m, json_each(m.script, '$.script_items') j
+WHERE json_valid(m.script)`,
+				`UPDATE movies SET title = json_extract(script, '$.title') WHERE json_valid(script)`,
+			} {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return dropColumn(tx, "movies", "script")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			if err := addColumn(tx, "movies", "script", "TEXT"); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(`
+UPDATE movies SET script = (
+	SELECT json_object('title', COALESCE(movies.title, ''), 'script_items', json_group_array(json_object(
+		'cn', i.cn, 'en', i.en, 'voice_path', i.voice_path, 'image_prompt', i.image_prompt,
+		'image_path', i.image_path, 'duration_ms', i.duration_ms)))
+	FROM (SELECT * FROM script_items WHERE movie_id = movies.id ORDER BY position) i
+) WHERE EXISTS (SELECT 1 FROM script_items WHERE movie_id = movies.id);
+DROP TABLE IF EXISTS script_items;
+`)
+			return err
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add movie version",
+		Up: func(tx *sqlx.Tx) error {
+			return addColumn(tx, "movies", "version", "INTEGER NOT NULL DEFAULT 1")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			return dropColumn(tx, "movies", "version")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "create script_revisions",
+		Up: func(tx *sqlx.Tx) error {
+			if _, err := tx.Exec(ScriptRevisionCreationSchema); err != nil {
+				return err
+			}
+
+			// the scripts from before revisions are their first revision
+			_, err := tx.Exec(`
+INSERT INTO script_revisions (movie_id, author, source, script)
+SELECT movies.id, '', 'import', (
+	SELECT json_object('title', COALESCE(movies.title, ''), 'script_items', json_group_array(json_object(
+		'id', i.id, 'cn', i.cn, 'en', i.en, 'voice_path', i.voice_path, 'image_prompt', i.image_prompt,
+		'image_path', i.image_path, 'duration_ms', i.duration_ms)))
+	FROM (SELECT * FROM script_items WHERE movie_id = movies.id ORDER BY position) i
+) FROM movies WHERE EXISTS (SELECT 1 FROM script_items WHERE movie_id = movies.id)`)
+			return err
+		},
+		Down: execSQL("DROP TABLE IF EXISTS script_revisions;"),
+	},
+	{
+		Version: 13,
+		Name:    "add movie script_model",
+		Up: func(tx *sqlx.Tx) error {
+			return addColumn(tx, "movies", "script_model", "TEXT")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			return dropColumn(tx, "movies", "script_model")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "create ai_calls",
+		Up:      execSQL(AICallCreationSchema),
+		Down:    execSQL("DROP TABLE IF EXISTS ai_calls;"),
+	},
+	{
+		Version: 15,
+		Name:    "create asset_cache",
+		Up:      execSQL(AssetCacheCreationSchema),
+		Down:    execSQL("DROP TABLE IF EXISTS asset_cache;"),
+	},
+	{
+		Version: 16,
+		Name:    "create assets",
+		Up: func(tx *sqlx.Tx) error {
+			if _, err := tx.Exec(AssetCreationSchema); err != nil {
+				return err
+			}
+
+			// 配音、配图文件的 asset，没有为 0
+			for _, column := range []string{"voice_asset_id", "image_asset_id"} {
+				if err := addColumn(tx, "script_items", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+					return err
+				}
+			}
+
+			// the files from before are registered without the metadata
+			// only their content tells, some voices were saved with a
+			// leading slash
+			_, err := tx.Exec(`
+UPDATE script_items SET voice_path = ltrim(voice_path, '/'), image_path = ltrim(image_path, '/');
+INSERT OR IGNORE INTO assets (movie_id, kind, path, mime, duration_ms)
+SELECT movie_id, 'voice', voice_path, 'audio/mpeg', MAX(duration_ms) FROM script_items
+WHERE voice_path != '' GROUP BY movie_id, voice_path;
+INSERT OR IGNORE INTO assets (movie_id, kind, path, mime)
+SELECT DISTINCT movie_id, 'image', image_path, 'image/png' FROM script_items WHERE image_path != '';
+INSERT OR IGNORE INTO assets (movie_id, kind, path, mime, duration_ms)
+SELECT id, 'render', ltrim(output_path, '/'), 'video/mp4', COALESCE(output_duration_ms, 0) FROM movies
+WHERE COALESCE(output_path, '') != '';
+UPDATE script_items SET
+	voice_asset_id = COALESCE((SELECT id FROM assets a WHERE a.movie_id = script_items.movie_id
+		AND a.kind = 'voice' AND a.path = script_items.voice_path), 0),
+	image_asset_id = COALESCE((SELECT id FROM assets a WHERE a.movie_id = script_items.movie_id
+		AND a.kind = 'image' AND a.path = script_items.image_path), 0);
+`)
+			return err
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"voice_asset_id", "image_asset_id"} {
+				if err := dropColumn(tx, "script_items", column); err != nil {
+					return err
+				}
+			}
+
+			_, err := tx.Exec("DROP TABLE IF EXISTS assets;")
+			return err
+		},
+	},
+	{
+		Version: 17,
+		Name:    "add template bgm",
+		Up: func(tx *sqlx.Tx) error {
+			if err := addColumn(tx, "templates", "bgm", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return addColumn(tx, "templates", "bgm_volume", "REAL NOT NULL DEFAULT 0.2")
+		},
+		Down: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"bgm", "bgm_volume"} {
+				if err := dropColumn(tx, "templates", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+var templateColumns = []string{"system_prompt", "image_style", "voice", "preset", "layout"}
@@ -4,8 +4,6 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
-
-	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -13,7 +11,9 @@ var (
 )
 
 func Init(dbFile string) error {
-	_db, err := sqlx.Connect("sqlite3", dbFile)
+	// transactions take the write lock when they begin, one which reads
+	// before it writes can not fail on a writer which came in between
+	_db, err := sqlx.Connect("sqlite3", dbFile+"?_txlock=immediate")
 	if err != nil {
 		return errors.Wrapf(err, "failed to connect to database %s", dbFile)
 	}
@@ -26,32 +26,13 @@ func Init(dbFile string) error {
 	return err
 }
 
-func InitDB() error {
-	tx := db.MustBegin()
-	if _, err := tx.Exec(TemplateCreationSchema); err != nil {
-		return errors.Wrapf(err, "failed to create templates table %s", TemplateCreationSchema)
-	}
-
-	if _, err := tx.Exec(AudioCreationSchema); err != nil {
-		return errors.Wrapf(err, "failed to create audios table %s", AudioCreationSchema)
-	}
-
-	if _, err := tx.Exec(MovieCreationSchema); err != nil {
-		return errors.Wrapf(err, "failed to create movies table %s", MovieCreationSchema)
-	}
-
-	if _, err := tx.Exec(TemplateInitializationStat); err != nil {
-		log.Warn().Err(err).Msgf("template initialization stat failed, maybe already initialized: %s", TemplateInitializationStat)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return err
+func Close() error {
+	if db == nil {
+		return nil
 	}
 
-	return nil
-}
-
-func Close() error {
+	err := db.Close()
 	db = nil
-	return nil
+
+	return err
 }
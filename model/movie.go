@@ -4,20 +4,23 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
 type State string
 
 func StateFromString(s string) State {
-	switch s {
-	case "init":
-		return StateInit
-	default:
-		return State(s)
+	for _, state := range stateOrder {
+		if state.String() == s {
+			return state
+		}
 	}
+
+	return State(s)
 }
 
 func (s State) String() string {
@@ -25,9 +28,28 @@ func (s State) String() string {
 }
 
 const (
-	StateInit State = "init" // 正常
+	StateInit        State = "init"        // 正常
+	StateScripted    State = "scripted"    // 已生成脚本
+	StateVoiced      State = "voiced"      // 已生成配音
+	StateIllustrated State = "illustrated" // 已生成配图
+	StateRendering   State = "rendering"   // 渲染中
+	StateRendered    State = "rendered"    // 已渲染
+	StateFailed      State = "failed"      // 渲染失败
 )
 
+// stateOrder is the order a movie normally goes through its states.
+var stateOrder = []State{
+	StateInit,
+	StateScripted,
+	StateVoiced,
+	StateIllustrated,
+	StateRendering,
+	StateRendered,
+	StateFailed,
+}
+
+// MovieCreationSchema is the original movies table, later columns are added
+// by the migrations in migrations.go.
 var MovieCreationSchema = `
 CREATE TABLE IF NOT EXISTS movies (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -50,22 +72,189 @@ type Movie struct {
 	Title     sql.NullString `db:"title" json:"title"`   // 标题
 	Footer    sql.NullString `db:"footer" json:"footer"` // 底部
 	Icon      sql.NullString `db:"icon" json:"icon"`     // 图标
-	Script    sql.NullString `db:"script" json:"script"` // 内容
+	Script    *MovieScript   `db:"-"`                    // 内容，由 script_items 组成
 	CreatedAt time.Time      `db:"created_at"`           // 创建时间
 
+	ScriptProvider sql.NullString `db:"script_provider"` // 文案生成 provider，为空时使用默认
+	SpeechProvider sql.NullString `db:"speech_provider"` // 语音合成 provider，为空时使用默认
+	ImageProvider  sql.NullString `db:"image_provider"`  // 文生图 provider，为空时使用默认
+
+	OutputPath       sql.NullString `db:"output_path"`        // 渲染结果，相对 workdir
+	OutputDurationMs sql.NullInt64  `db:"output_duration_ms"` // 渲染结果时长，毫秒
+
+	DurationMs       sql.NullInt64 `db:"duration_ms"`        // 按配音计算的时长，毫秒
+	TargetDurationMs sql.NullInt64 `db:"target_duration_ms"` // 生成脚本时的目标时长，毫秒，为空时使用 preset 的时长
+
+	Preset sql.NullString `db:"preset"` // 发布平台 preset，为空时使用默认
+
+	ScriptArtifacts sql.NullString `db:"script_artifacts"` // 分阶段生成文案的中间结果，json
+	ScriptModel     sql.NullString `db:"script_model"`     // 写出当前脚本的 provider/model，导入或恢复的脚本为空
+
+	Version int64 `db:"version"` // 版本号，每次修改加一
 }
 
+// ErrMovieChanged is returned when a movie is saved which was changed by
+// someone else since it was loaded.
+var ErrMovieChanged = errors.New("movie was changed by someone else, reload it and try again")
+
+// DefaultTargetDuration is the movie length scripts are written for when
+// the movie does not ask for another one.
+const DefaultTargetDuration = 3 * time.Minute
+
+// DurationTolerance is how far the voiced length may be off the target
+// before the movie carries a warning.
+const DurationTolerance = 0.15
+
+// MovieScript is what the script model writes, the fields it fills are the
+// required ones, the rest are added while the movie is made.
 type MovieScript struct {
-	Title       string        `json:"title"`        // 视频标题
-	ScriptItems []*ScriptItem `json:"script_items"` // 视频脚本内容
+	Title       string        `json:"title" description:"catchy chinese title of at most 20 characters"`  // 视频标题
+	ScriptItems []*ScriptItem `json:"script_items" description:"the script cut into subtitles, in order"` // 视频脚本内容
 }
 
 type ScriptItem struct {
-	ZhSubtitle  string `json:"cn"`                   // Chinese subtitle
-	EnSubtitle  string `json:"en"`                   // English subtitle
-	VoicePath   string `json:"voice_path,omitempty"` // Path to the voice file
-	ImagePrompt string `json:"image_prompt"`         // Image generation prompt
-	ImagePath   string `json:"image_path,omitempty"` // Path to the generated image
+	Id          int64  `db:"id" json:"id,omitempty"`                                                                     // ID
+	MovieId     int64  `db:"movie_id" json:"-"`                                                                          // Movie the item belongs to
+	Position    int    `db:"position" json:"-"`                                                                          // Index of the item in the script
+	ZhSubtitle  string `db:"cn" json:"cn" description:"chinese subtitle"`                                                // Chinese subtitle
+	EnSubtitle  string `db:"en" json:"en" description:"english translation, lowercase without punctuation"`              // English subtitle
+	VoicePath   string `db:"voice_path" json:"voice_path,omitempty"`                                                     // Path to the voice file
+	VoiceAsset  int64  `db:"voice_asset_id" json:"voice_asset_id,omitempty"`                                             // Asset of the voice file
+	ImagePrompt string `db:"image_prompt" json:"image_prompt" description:"chinese prompt for an image of the subtitle"` // Image generation prompt
+	ImagePath   string `db:"image_path" json:"image_path,omitempty"`                                                     // Path to the generated image
+	ImageAsset  int64  `db:"image_asset_id" json:"image_asset_id,omitempty"`                                             // Asset of the generated image
+	DurationMs  int64  `db:"duration_ms" json:"duration_ms,omitempty"`                                                   // Length of the voice
+	StartMs     int64  `db:"-" json:"start_ms,omitempty"`                                                                // Where the item starts in the movie
+
+	VoiceStatus string `db:"voice_status" json:"voice_status,omitempty"` // pending, done or failed
+	VoiceError  string `db:"voice_error" json:"voice_error,omitempty"`   // Why the voice failed
+	ImageStatus string `db:"image_status" json:"image_status,omitempty"` // pending, done or failed
+	ImageError  string `db:"image_error" json:"image_error,omitempty"`   // Why the image failed
+}
+
+var (
+	scriptSchemaOnce sync.Once
+	scriptSchema     *Schema
+	scriptSchemaErr  error
+)
+
+// ScriptSchema is the JSON Schema of the part of MovieScript a script model
+// writes, models which support structured output are held to it.
+func ScriptSchema() (*Schema, error) {
+	scriptSchemaOnce.Do(func() {
+		var full *Schema
+		full, scriptSchemaErr = GenerateSchema(MovieScript{})
+		if scriptSchemaErr != nil {
+			return
+		}
+
+		scriptSchema = full.RequiredOnly()
+		scriptSchema.Title = "MovieScript"
+	})
+
+	return scriptSchema, scriptSchemaErr
+}
+
+// AllVoiced reports whether every item has a voice file.
+func (s *MovieScript) AllVoiced() bool {
+	for _, item := range s.ScriptItems {
+		if item.VoicePath == "" {
+			return false
+		}
+	}
+
+	return len(s.ScriptItems) > 0
+}
+
+// AllIllustrated reports whether every item has an image.
+func (s *MovieScript) AllIllustrated() bool {
+	for _, item := range s.ScriptItems {
+		if item.ImagePath == "" {
+			return false
+		}
+	}
+
+	return len(s.ScriptItems) > 0
+}
+
+// AssetState is the furthest state the assets of the script support.
+func (s *MovieScript) AssetState() State {
+	switch {
+	case !s.AllVoiced():
+		return StateScripted
+	case !s.AllIllustrated():
+		return StateVoiced
+	default:
+		return StateIllustrated
+	}
+}
+
+// Retime lays the items out one after another with pauseMs of silence in
+// between, items without a voice take no time. It returns the total length.
+func (s *MovieScript) Retime(pauseMs int64) int64 {
+	var cursor, end int64
+	for _, item := range s.ScriptItems {
+		item.StartMs = cursor
+		if item.DurationMs > 0 {
+			end = cursor + item.DurationMs
+			cursor = end + pauseMs
+		}
+	}
+
+	return end
+}
+
+// GetPreset returns the preset of the movie, presets which are gone fall
+// back to the default one.
+func (m *Movie) GetPreset() *Preset {
+	if p, ok := GetPreset(m.Preset.String); ok {
+		return p
+	}
+
+	return DefaultPreset
+}
+
+// GetTemplate returns the template the movie is made with, movies whose
+// template no longer exists are made with the defaults.
+func (m *Movie) GetTemplate() (*Template, error) {
+	tpl, err := GetTemplateByName(m.TplName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewTemplate(m.TplName), nil
+	}
+
+	return tpl, err
+}
+
+// TargetDuration is the length the script is written for.
+func (m *Movie) TargetDuration() time.Duration {
+	if m.TargetDurationMs.Valid && m.TargetDurationMs.Int64 > 0 {
+		return time.Duration(m.TargetDurationMs.Int64) * time.Millisecond
+	}
+
+	return m.GetPreset().TargetDuration
+}
+
+// DurationWarning explains how the voiced length misses the target, it is
+// empty while the length is unknown or close enough.
+func (m *Movie) DurationWarning() string {
+	if !m.DurationMs.Valid || m.DurationMs.Int64 <= 0 {
+		return ""
+	}
+
+	actual := time.Duration(m.DurationMs.Int64) * time.Millisecond
+	target := m.TargetDuration()
+	off := float64(actual-target) / float64(target)
+	if off > -DurationTolerance && off < DurationTolerance {
+		return ""
+	}
+
+	word := "longer"
+	if off < 0 {
+		word, off = "shorter", -off
+	}
+
+	return fmt.Sprintf("movie is %s, %.0f%% %s than the target %s",
+		actual.Round(100*time.Millisecond), off*100, word, target)
 }
 
 func NewMovie() *Movie {
@@ -76,13 +265,14 @@ func NewMovie() *Movie {
 		Title:   sql.NullString{},
 		Footer:  sql.NullString{},
 		Icon:    sql.NullString{},
-		Script:  sql.NullString{},
 	}
 }
 
 func (m *Movie) Create() error {
-	result, err := db.NamedExec("INSERT INTO movies (tpl_name, state, idea, title, footer, icon, script)"+
-		"VALUES (:tpl_name, :state, :idea, :title, :footer, :icon, :script)", m)
+	result, err := db.NamedExec("INSERT INTO movies (tpl_name, state, idea, title, footer, icon, "+
+		"script_provider, speech_provider, image_provider, target_duration_ms, preset) "+
+		"VALUES (:tpl_name, :state, :idea, :title, :footer, :icon, "+
+		":script_provider, :speech_provider, :image_provider, :target_duration_ms, :preset)", m)
 	if err != nil {
 		return errors.Wrap(err, "failed to create movie")
 	}
@@ -91,29 +281,44 @@ func (m *Movie) Create() error {
 	return nil
 }
 
+// Update saves the settings of the movie unless it was changed since it
+// was loaded, then it returns ErrMovieChanged. The script, the state and the
+// results of jobs have writers of their own.
 func (m *Movie) Update() error {
-	if _, err := db.NamedExec("UPDATE movies SET state = :state, idea = :idea, title = :title, footer = :footer, icon = :icon, script = :script WHERE id = :id", m); err != nil {
+	result, err := db.NamedExec("UPDATE movies SET idea = :idea, footer = :footer, icon = :icon, "+
+		"script_provider = :script_provider, speech_provider = :speech_provider, image_provider = :image_provider, "+
+		"target_duration_ms = :target_duration_ms, preset = :preset, version = version + 1 "+
+		"WHERE id = :id AND version = :version", m)
+	if err != nil {
 		return errors.Wrap(err, "failed to update movie")
 	}
 
-	fmt.Println("11111111111111")
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrMovieChanged
+	}
 
+	m.Version++
 	return nil
 }
 
-func (m *Movie) GetScript() (*MovieScript, error) {
-	var script MovieScript
-	script.ScriptItems = make([]*ScriptItem, 0)
+// SaveOutput stores the render result of the movie.
+func (m *Movie) SaveOutput() error {
+	return bumpVersion(db, &m.Version, "UPDATE movies SET output_path = ?, output_duration_ms = ?, "+
+		"version = version + 1 WHERE id = ? RETURNING version", m.OutputPath, m.OutputDurationMs, m.Id)
+}
 
-	if !m.Script.Valid {
-		return &script, nil // No script content available
-	}
+// ETag names the version of the movie for http caching and If-Match.
+func (m *Movie) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, m.Id, m.Version)
+}
 
-	if err := json.Unmarshal([]byte(m.Script.String), &script); err != nil {
-		return &script, errors.Wrap(err, "failed to unmarshal script content")
+// bumpVersion runs an update of the movie returning its new version.
+func bumpVersion(q sqlx.Queryer, version *int64, query string, args ...interface{}) error {
+	if err := sqlx.Get(q, version, query, args...); err != nil {
+		return errors.Wrap(err, "failed to update movie")
 	}
 
-	return &script, nil
+	return nil
 }
 
 func ListMovies() ([]*Movie, error) {
@@ -123,6 +328,10 @@ func ListMovies() ([]*Movie, error) {
 		return nil, errors.Wrap(err, "failed to list movies")
 	}
 
+	if err := loadScripts(movies); err != nil {
+		return nil, err
+	}
+
 	return movies, nil
 }
 
@@ -142,6 +351,11 @@ func GetMovie(id int64) (*Movie, error) {
 	if err := db.Get(&movie, "SELECT * FROM movies WHERE id = ?", id); err != nil {
 		return nil, err
 	}
+
+	if err := loadScripts([]*Movie{&movie}); err != nil {
+		return nil, err
+	}
+
 	return &movie, nil
 }
 
@@ -156,6 +370,21 @@ func (m *Movie) MarshalJSON() ([]byte, error) {
 		Icon      string    `json:"icon"`
 		Script    string    `json:"script"`
 		CreatedAt time.Time `json:"created_at"`
+
+		ScriptProvider string `json:"script_provider"`
+		SpeechProvider string `json:"speech_provider"`
+		ImageProvider  string `json:"image_provider"`
+		ScriptModel    string `json:"script_model"`
+
+		OutputPath       string `json:"output_path"`
+		OutputDurationMs int64  `json:"output_duration_ms"`
+
+		DurationMs       int64  `json:"duration_ms"`
+		TargetDurationMs int64  `json:"target_duration_ms"`
+		DurationWarning  string `json:"duration_warning,omitempty"`
+
+		Preset  string `json:"preset"`
+		Version int64  `json:"version"`
 	}{
 		Id:        m.Id,
 		TplName:   m.TplName,
@@ -164,7 +393,22 @@ func (m *Movie) MarshalJSON() ([]byte, error) {
 		Title:     m.Title.String,
 		Footer:    m.Footer.String,
 		Icon:      m.Icon.String,
-		Script:    m.Script.String,
+		Script:    m.Script.String(),
 		CreatedAt: m.CreatedAt,
+
+		ScriptProvider: m.ScriptProvider.String,
+		SpeechProvider: m.SpeechProvider.String,
+		ImageProvider:  m.ImageProvider.String,
+		ScriptModel:    m.ScriptModel.String,
+
+		OutputPath:       m.OutputPath.String,
+		OutputDurationMs: m.OutputDurationMs.Int64,
+
+		DurationMs:       m.DurationMs.Int64,
+		TargetDurationMs: m.TargetDuration().Milliseconds(),
+		DurationWarning:  m.DurationWarning(),
+
+		Preset:  m.GetPreset().Name,
+		Version: m.Version,
 	})
 }
@@ -0,0 +1,249 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// transitions lists the states a movie may move to from each state.
+// Regenerating the script is allowed from every state but rendering and
+// throws away all assets, so it always leads back to scripted.
+var transitions = map[State][]State{
+	StateInit:        {StateScripted},
+	StateScripted:    {StateScripted, StateVoiced},
+	StateVoiced:      {StateScripted, StateIllustrated},
+	StateIllustrated: {StateScripted, StateRendering},
+	StateRendering:   {StateRendered, StateFailed},
+	StateRendered:    {StateScripted, StateRendering},
+	StateFailed:      {StateScripted, StateRendering},
+}
+
+var MovieStateTransitionCreationSchema = `
+CREATE TABLE IF NOT EXISTS movie_state_transitions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER NOT NULL, -- 电影ID
+	from_state TEXT NOT NULL, -- 原状态
+	to_state TEXT NOT NULL, -- 新状态
+	reason TEXT, -- 原因
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 创建时间
+);
+CREATE INDEX IF NOT EXISTS idx_movie_state_transitions_movie_id ON movie_state_transitions(movie_id);
+`
+
+type StateTransition struct {
+	Id        int64     `db:"id" json:"id"`                 // ID
+	MovieId   int64     `db:"movie_id" json:"movie_id"`     // 电影ID
+	FromState string    `db:"from_state" json:"from_state"` // 原状态
+	ToState   string    `db:"to_state" json:"to_state"`     // 新状态
+	Reason    string    `db:"reason" json:"reason"`         // 原因
+	CreatedAt time.Time `db:"created_at" json:"created_at"` // 创建时间
+}
+
+// StateError is returned when an operation or a transition is not allowed
+// in the current state of a movie.
+type StateError struct {
+	Op      string  // 操作
+	State   State   // 当前状态
+	Allowed []State // 允许的状态
+}
+
+func (e *StateError) Error() string {
+	allowed := make([]string, 0, len(e.Allowed))
+	for _, s := range e.Allowed {
+		allowed = append(allowed, s.String())
+	}
+
+	if len(allowed) == 0 {
+		return fmt.Sprintf("cannot %s while movie is in state %s", e.Op, e.State)
+	}
+
+	return fmt.Sprintf("cannot %s while movie is in state %s, requires state %s",
+		e.Op, e.State, strings.Join(allowed, "/"))
+}
+
+func IsStateError(err error) bool {
+	var e *StateError
+	return errors.As(err, &e)
+}
+
+// CanTransition reports whether a movie in state from may move to state to.
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Require returns a StateError describing op unless the movie is in one of
+// the given states.
+func (m *Movie) Require(op string, states ...State) error {
+	current := StateFromString(m.State)
+	for _, s := range states {
+		if s == current {
+			return nil
+		}
+	}
+
+	return &StateError{Op: op, State: current, Allowed: states}
+}
+
+// Transition moves the movie into state to and records it in the
+// transition history. The update only applies if nobody changed the state
+// in between, otherwise the movie is reloaded and a StateError returned.
+func (m *Movie) Transition(to State, reason string) error {
+	from := StateFromString(m.State)
+	if !CanTransition(from, to) {
+		return &StateError{Op: "move to " + to.String(), State: from, Allowed: allowedFrom(to)}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	err = m.transitionTx(tx, from, to, reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		if latest, err := GetMovie(m.Id); err == nil {
+			m.State, m.Version = latest.State, latest.Version
+		}
+		return &StateError{Op: "move to " + to.String(), State: StateFromString(m.State), Allowed: allowedFrom(to)}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit movie state transition")
+	}
+
+	return nil
+}
+
+// transitionTx moves the movie from state from to state to within tx and
+// records it, it returns sql.ErrNoRows when the movie is no longer in from.
+func (m *Movie) transitionTx(tx *sqlx.Tx, from, to State, reason string) error {
+	var version int64
+	err := tx.Get(&version, "UPDATE movies SET state = ?, version = version + 1 WHERE id = ? AND state = ? RETURNING version",
+		to.String(), m.Id, from.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to update movie state")
+	}
+
+	if _, err := tx.Exec("INSERT INTO movie_state_transitions (movie_id, from_state, to_state, reason) VALUES (?, ?, ?, ?)",
+		m.Id, from.String(), to.String(), reason); err != nil {
+		return errors.Wrap(err, "failed to record movie state transition")
+	}
+
+	m.State, m.Version = to.String(), version
+	return nil
+}
+
+// StateGuard is what a script write asks of the state of the movie: it
+// only happens in one of States, and the movie then moves to the state the
+// assets of the new script support, recorded with Reason.
+type StateGuard struct {
+	Op     string
+	States []State
+	Reason string
+}
+
+// require checks the state of the movie as it is in tx against the guard.
+func (g StateGuard) require(tx *sqlx.Tx, m *Movie) error {
+	var state string
+	if err := tx.Get(&state, "SELECT state FROM movies WHERE id = ?", m.Id); err != nil {
+		return errors.Wrap(err, "failed to load movie state")
+	}
+
+	m.State = state
+	return m.Require(g.Op, g.States...)
+}
+
+// settle moves the movie to the state the assets of script support within
+// tx. A rendered movie no longer matches its script, and a movie whose
+// items lost their voice or image goes back to scripted and only forward
+// as far as the remaining assets reach.
+func (g StateGuard) settle(tx *sqlx.Tx, m *Movie, script *MovieScript) error {
+	target := script.AssetState()
+	if StateFromString(m.State) == target {
+		return nil
+	}
+
+	for _, to := range []State{StateScripted, StateVoiced, StateIllustrated} {
+		from := StateFromString(m.State)
+		if from == target {
+			break
+		}
+
+		if from == to {
+			continue
+		}
+
+		if !CanTransition(from, to) {
+			return &StateError{Op: "move to " + to.String(), State: from, Allowed: allowedFrom(to)}
+		}
+
+		if err := m.transitionTx(tx, from, to, g.Reason); err != nil {
+			return errors.Wrap(err, "failed to settle movie state")
+		}
+	}
+
+	return nil
+}
+
+// Advance moves the movie forward to state to, a movie which is already
+// further along or can not reach state to in one step is left alone.
+func (m *Movie) Advance(to State, reason string) error {
+	from := StateFromString(m.State)
+	if stateRank(from) >= stateRank(to) || !CanTransition(from, to) {
+		return nil
+	}
+
+	return m.Transition(to, reason)
+}
+
+func stateRank(s State) int {
+	for i, o := range stateOrder {
+		if o == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// allowedFrom lists the states which may move to state to.
+func allowedFrom(to State) []State {
+	var states []State
+	for _, from := range stateOrder {
+		if CanTransition(from, to) {
+			states = append(states, from)
+		}
+	}
+
+	return states
+}
+
+func ListStateTransitions(movieId int64) ([]*StateTransition, error) {
+	list := make([]*StateTransition, 0)
+
+	if err := db.Select(&list, "SELECT * FROM movie_state_transitions WHERE movie_id = ? ORDER BY id", movieId); err != nil {
+		return nil, errors.Wrap(err, "failed to list movie state transitions")
+	}
+
+	return list, nil
+}
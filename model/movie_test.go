@@ -0,0 +1,53 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMovieVersion(t *testing.T) {
+	openTestDB(t)
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	movie := NewMovie()
+	if err := movie.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Idea.String, first.Idea.Valid = "金牛座", true
+	if err := first.Update(); err != nil || first.Version != 2 {
+		t.Fatalf("update failed: %v, version %d", err, first.Version)
+	}
+
+	second.Idea.String, second.Idea.Valid = "双子座", true
+	if err := second.Update(); !errors.Is(err, ErrMovieChanged) {
+		t.Fatalf("expected ErrMovieChanged, got %v", err)
+	}
+	if _, err := second.EditScript(NewRevision(RevisionSourceEdit, "", ""), nil, func(*MovieScript) error { return nil }); !errors.Is(err, ErrMovieChanged) {
+		t.Fatalf("expected ErrMovieChanged editing the script, got %v", err)
+	}
+
+	if err := first.Transition(StateScripted, "test"); err != nil || first.Version != 3 {
+		t.Fatalf("transition failed: %v, version %d", err, first.Version)
+	}
+
+	latest, err := GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Idea.String != "金牛座" || latest.Version != 3 || latest.ETag() != first.ETag() {
+		t.Fatalf("unexpected movie %+v", latest)
+	}
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// BaseWordsPerSecond is how many chinese characters a voice reads per second
+// at speed 1.
+const BaseWordsPerSecond = 6
+
+// Preset is a publishing platform a movie is made for, it decides the
+// length of the script, how fast it is read and the shape of the video.
+type Preset struct {
+	Name           string        // 名称，电影通过名称选择 preset
+	Title          string        // 平台名称
+	TargetDuration time.Duration // 目标时长
+	Width          int           // 视频宽度
+	Height         int           // 视频高度
+
+	MinSubtitleChars int     // 每条中文字幕最少字数
+	MaxSubtitleChars int     // 每条中文字幕最多字数
+	MaxSubtitleWords int     // 每条英文字幕最多单词数
+	SpeechSpeed      float64 // 语音合成语速，1 为正常
+}
+
+const DefaultPresetName = "default"
+
+// DefaultPreset is what movies without a preset are made with, a 3 minute
+// vertical video.
+var DefaultPreset = &Preset{
+	Name:             DefaultPresetName,
+	Title:            "默认",
+	TargetDuration:   DefaultTargetDuration,
+	Width:            1080,
+	Height:           1920,
+	MinSubtitleChars: 10,
+	MaxSubtitleChars: 28,
+	MaxSubtitleWords: 14,
+	SpeechSpeed:      1,
+}
+
+var presets = []*Preset{
+	DefaultPreset,
+	{
+		Name:             "douyin",
+		Title:            "抖音",
+		TargetDuration:   60 * time.Second,
+		Width:            1080,
+		Height:           1920,
+		MinSubtitleChars: 6,
+		MaxSubtitleChars: 16,
+		MaxSubtitleWords: 10,
+		SpeechSpeed:      1.2,
+	},
+	{
+		Name:             "shorts",
+		Title:            "YouTube Shorts",
+		TargetDuration:   45 * time.Second,
+		Width:            1080,
+		Height:           1920,
+		MinSubtitleChars: 6,
+		MaxSubtitleChars: 16,
+		MaxSubtitleWords: 10,
+		SpeechSpeed:      1.1,
+	},
+	{
+		Name:             "bilibili",
+		Title:            "哔哩哔哩",
+		TargetDuration:   3 * time.Minute,
+		Width:            1920,
+		Height:           1080,
+		MinSubtitleChars: 10,
+		MaxSubtitleChars: 28,
+		MaxSubtitleWords: 14,
+		SpeechSpeed:      1,
+	},
+}
+
+// ListPresets returns every preset, the default one first.
+func ListPresets() []*Preset {
+	return presets
+}
+
+// GetPreset finds a preset by name, the empty name is the default preset.
+func GetPreset(name string) (*Preset, bool) {
+	if name == "" {
+		return DefaultPreset, true
+	}
+
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// WordsPerSecond is how many chinese characters are read per second.
+func (p *Preset) WordsPerSecond() float64 {
+	return BaseWordsPerSecond * p.SpeechSpeed
+}
+
+// Aspect is the aspect ratio, e.g. 9:16.
+func (p *Preset) Aspect() string {
+	a, b := p.Width, p.Height
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return strconv.Itoa(p.Width/a) + ":" + strconv.Itoa(p.Height/a)
+}
+
+// RenderSpec is the render spec movies of the preset start from.
+func (p *Preset) RenderSpec() *RenderSpec {
+	return NewRenderSpec(p.Width, p.Height)
+}
+
+func (p *Preset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name             string  `json:"name"`
+		Title            string  `json:"title"`
+		TargetDurationMs int64   `json:"target_duration_ms"`
+		Width            int     `json:"width"`
+		Height           int     `json:"height"`
+		Aspect           string  `json:"aspect"`
+		MinSubtitleChars int     `json:"min_subtitle_chars"`
+		MaxSubtitleChars int     `json:"max_subtitle_chars"`
+		MaxSubtitleWords int     `json:"max_subtitle_words"`
+		SpeechSpeed      float64 `json:"speech_speed"`
+		WordsPerSecond   float64 `json:"words_per_second"`
+	}{
+		Name:             p.Name,
+		Title:            p.Title,
+		TargetDurationMs: p.TargetDuration.Milliseconds(),
+		Width:            p.Width,
+		Height:           p.Height,
+		Aspect:           p.Aspect(),
+		MinSubtitleChars: p.MinSubtitleChars,
+		MaxSubtitleChars: p.MaxSubtitleChars,
+		MaxSubtitleWords: p.MaxSubtitleWords,
+		SpeechSpeed:      p.SpeechSpeed,
+		WordsPerSecond:   p.WordsPerSecond(),
+	})
+}
@@ -0,0 +1,229 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RenderSpecVersion is bumped whenever RenderSpec changes in a way the
+// composer has to know about, composer/main.py refuses other versions.
+const RenderSpecVersion = 1
+
+// RenderSpec is everything composer/main.py needs to render a movie. Paths
+// are relative to the movie directory, times are milliseconds and sizes are
+// pixels of the output video.
+type RenderSpec struct {
+	Version int    `json:"version" jsonschema:"minimum=1" description:"render spec version"`
+	Title   string `json:"title" description:"movie title shown in the band"`
+
+	Width      int    `json:"width" jsonschema:"minimum=16,maximum=7680"`
+	Height     int    `json:"height" jsonschema:"minimum=16,maximum=7680"`
+	Fps        int    `json:"fps" jsonschema:"minimum=1,maximum=120"`
+	Background string `json:"background" jsonschema:"pattern=^#[0-9a-fA-F]{6}$" description:"canvas color"`
+
+	Layout      RenderLayout      `json:"layout"`
+	Styles      RenderStyles      `json:"styles"`
+	Transitions RenderTransitions `json:"transitions"`
+
+	VoiceVolume float64    `json:"voice_volume" jsonschema:"minimum=0,maximum=2"`
+	Bgm         *RenderBgm `json:"bgm,omitempty" description:"background music, none when absent"`
+
+	Output RenderOutput `json:"output"`
+
+	Items []RenderItem `json:"items" jsonschema:"minItems=1"`
+}
+
+// RenderLayout places the elements on the canvas.
+type RenderLayout struct {
+	Padding     int        `json:"padding" jsonschema:"minimum=0"`
+	Band        RenderRect `json:"band" description:"highlighted band holding title, image and subtitles"`
+	BandColor   string     `json:"band_color" jsonschema:"pattern=^#[0-9a-fA-F]{6}$"`
+	MarkerSize  int        `json:"marker_size" jsonschema:"minimum=0" description:"corner markers of the band, 0 hides them"`
+	MarkerColor string     `json:"marker_color" jsonschema:"pattern=^#[0-9a-fA-F]{6}$"`
+
+	Title       RenderPosition `json:"title"`
+	Image       RenderRect     `json:"image" description:"images are resized to width x height"`
+	Subtitle    RenderPosition `json:"subtitle"`
+	Translation RenderPosition `json:"translation"`
+}
+
+type RenderRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width" jsonschema:"minimum=1"`
+	Height int `json:"height" jsonschema:"minimum=1"`
+}
+
+// RenderPosition is where a text goes, with align center x is ignored and
+// the text is centered horizontally.
+type RenderPosition struct {
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Align string `json:"align" jsonschema:"enum=left|center"`
+}
+
+type RenderStyles struct {
+	Title       RenderTextStyle `json:"title"`
+	Subtitle    RenderTextStyle `json:"subtitle"`    // 中文字幕
+	Translation RenderTextStyle `json:"translation"` // 英文字幕
+}
+
+type RenderTextStyle struct {
+	Font       string `json:"font" jsonschema:"minLength=1" description:"font file, relative to the composer"`
+	FontSize   int    `json:"font_size" jsonschema:"minimum=1"`
+	LineHeight int    `json:"line_height" jsonschema:"minimum=1"`
+	Color      string `json:"color" jsonschema:"pattern=^#[0-9a-fA-F]{6}$"`
+	Background string `json:"background" jsonschema:"pattern=^#[0-9a-fA-F]{6}$"`
+}
+
+const (
+	TransitionSlideLeft  = "slide_left"
+	TransitionSlideTop   = "slide_top"
+	TransitionSlideRight = "slide_right"
+	TransitionCrossfade  = "crossfade"
+	TransitionNone       = "none"
+)
+
+// RenderTransitions are the effects items appear with, every image picks
+// one of Image at random.
+type RenderTransitions struct {
+	Image      []string `json:"image" jsonschema:"minItems=1,enum=slide_left|slide_top|slide_right|crossfade|none"`
+	Text       string   `json:"text" jsonschema:"enum=crossfade|none"`
+	DurationMs int      `json:"duration_ms" jsonschema:"minimum=0"`
+}
+
+type RenderBgm struct {
+	Path   string  `json:"path" jsonschema:"minLength=1"`
+	Volume float64 `json:"volume" jsonschema:"minimum=0,maximum=2"`
+}
+
+type RenderOutput struct {
+	File       string `json:"file" jsonschema:"minLength=1"`
+	VideoCodec string `json:"video_codec" jsonschema:"enum=libx264|libx265|mpeg4"`
+	AudioCodec string `json:"audio_codec" jsonschema:"enum=aac|libmp3lame"`
+}
+
+// RenderItem is one script item. StartMs and DurationMs are optional, by
+// default items follow each other with PauseMs in between and last as long
+// as their voice.
+type RenderItem struct {
+	ZhSubtitle string `json:"cn" jsonschema:"minLength=1"`
+	EnSubtitle string `json:"en" jsonschema:"minLength=1"`
+	VoicePath  string `json:"voice_path" jsonschema:"minLength=1"`
+	ImagePath  string `json:"image_path" jsonschema:"minLength=1"`
+	PauseMs    int    `json:"pause_ms" jsonschema:"minimum=0" description:"silence after the item"`
+	StartMs    int64  `json:"start_ms,omitempty" jsonschema:"minimum=0"`
+	DurationMs int64  `json:"duration_ms,omitempty" jsonschema:"minimum=0"`
+}
+
+const defaultFont = "fonts/ZCOOLQingKeHuangYou-Regular.ttf"
+
+// DefaultRenderSpec is the vertical 1080x1920 layout the composer always
+// used, without items.
+func DefaultRenderSpec() *RenderSpec {
+	return NewRenderSpec(1080, 1920)
+}
+
+// NewRenderSpec lays out a width x height video without items. Vertical
+// videos get a band of the golden ratio across the middle, horizontal ones
+// use the whole canvas as band.
+func NewRenderSpec(width, height int) *RenderSpec {
+	const (
+		padding    = 20
+		lineHeight = 60
+	)
+
+	band := RenderRect{Width: width, Height: height}
+	image := RenderRect{Width: width / 2, Height: height / 2}
+	if height > width {
+		band.Height = height * 382 / 1000 // golden ratio, 1 - 0.618
+		band.Y = height/2 - band.Height/2
+		image = RenderRect{Width: height / 3, Height: width / 3}
+		image.Y = height/2 - image.Height/2
+	} else {
+		// leave room for the subtitles below
+		image.Y = height/2 - image.Height/2 - lineHeight
+	}
+	image.X = (width - image.Width) / 2
+	bandBottom := band.Y + band.Height
+
+	return &RenderSpec{
+		Version:    RenderSpecVersion,
+		Width:      width,
+		Height:     height,
+		Fps:        24,
+		Background: "#000000",
+		Layout: RenderLayout{
+			Padding:     padding,
+			Band:        band,
+			BandColor:   "#ffffff",
+			MarkerSize:  50,
+			MarkerColor: "#ff0000",
+			Title:       RenderPosition{X: padding, Y: band.Y + padding, Align: "left"},
+			Image:       image,
+			Subtitle:    RenderPosition{Y: bandBottom - 2*lineHeight - padding, Align: "center"},
+			Translation: RenderPosition{Y: bandBottom - lineHeight - padding, Align: "center"},
+		},
+		Styles: RenderStyles{
+			Title:       RenderTextStyle{Font: defaultFont, FontSize: 30, LineHeight: lineHeight, Color: "#000000", Background: "#ffffff"},
+			Subtitle:    RenderTextStyle{Font: defaultFont, FontSize: 50, LineHeight: lineHeight, Color: "#000000", Background: "#ffffff"},
+			Translation: RenderTextStyle{Font: defaultFont, FontSize: 30, LineHeight: lineHeight, Color: "#000000", Background: "#ffffff"},
+		},
+		Transitions: RenderTransitions{
+			Image:      []string{TransitionSlideLeft, TransitionSlideTop, TransitionSlideRight, TransitionCrossfade},
+			Text:       TransitionCrossfade,
+			DurationMs: 300,
+		},
+		VoiceVolume: 0.9,
+		Output: RenderOutput{
+			File:       "output.mp4",
+			VideoCodec: "libx264",
+			AudioCodec: "aac",
+		},
+		Items: []RenderItem{},
+	}
+}
+
+// DefaultItemPauseMs is the silence between two items.
+const DefaultItemPauseMs = 300
+
+var (
+	renderSpecSchemaOnce sync.Once
+	renderSpecSchema     *Schema
+	renderSpecSchemaErr  error
+)
+
+// RenderSpecSchema is the JSON Schema of RenderSpec, composer/
+// render_spec.schema.json is generated from it by `mpu schema render-spec`.
+func RenderSpecSchema() (*Schema, error) {
+	renderSpecSchemaOnce.Do(func() {
+		renderSpecSchema, renderSpecSchemaErr = GenerateSchema(RenderSpec{})
+		if renderSpecSchemaErr != nil {
+			return
+		}
+
+		renderSpecSchema.Title = "RenderSpec"
+	})
+
+	return renderSpecSchema, renderSpecSchemaErr
+}
+
+// Validate checks the spec against its schema and that the composer
+// understands its version.
+func (s *RenderSpec) Validate() error {
+	if s.Version != RenderSpecVersion {
+		return errors.Errorf("unsupported render spec version %d, expected %d", s.Version, RenderSpecVersion)
+	}
+
+	schema, err := RenderSpecSchema()
+	if err != nil {
+		return err
+	}
+
+	if err := schema.ValidateValue(s); err != nil {
+		return errors.Wrap(err, "invalid render spec")
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderSpecSchemaUpToDate(t *testing.T) {
+	schema, err := RenderSpecSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := os.ReadFile("../composer/render_spec.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(bytes.TrimSpace(committed), raw) {
+		t.Fatal("composer/render_spec.schema.json is stale, run `mpu schema render-spec > composer/render_spec.schema.json`")
+	}
+}
+
+func TestRenderSpecValidate(t *testing.T) {
+	valid := func() *RenderSpec {
+		spec := DefaultRenderSpec()
+		spec.Title = "星座小知识"
+		spec.Items = append(spec.Items, RenderItem{
+			ZhSubtitle: "金牛座的人做事踏实稳重",
+			EnSubtitle: "taurus people are steady",
+			VoicePath:  "audio/0.mp3",
+			ImagePath:  "image/0.png",
+		})
+		return spec
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("default spec should be valid: %v", err)
+	}
+
+	for name, c := range map[string]struct {
+		mutate func(*RenderSpec)
+		want   string
+	}{
+		"version":    {func(s *RenderSpec) { s.Version = 2 }, "unsupported render spec version 2"},
+		"no items":   {func(s *RenderSpec) { s.Items = nil }, "/items: expected array"},
+		"color":      {func(s *RenderSpec) { s.Styles.Subtitle.Color = "red" }, "/styles/subtitle/color"},
+		"fps":        {func(s *RenderSpec) { s.Fps = 0 }, "/fps: 0 is less than 1"},
+		"transition": {func(s *RenderSpec) { s.Transitions.Image = []string{"spin"} }, "/transitions/image/0"},
+		"codec":      {func(s *RenderSpec) { s.Output.VideoCodec = "vp9" }, "/output/video_codec"},
+		"voice":      {func(s *RenderSpec) { s.Items[0].VoicePath = "" }, "/items/0/voice_path"},
+	} {
+		spec := valid()
+		c.mutate(spec)
+
+		err := spec.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", name, c.want, err)
+		}
+	}
+}
+
+func TestPresetRenderSpecs(t *testing.T) {
+	for _, p := range ListPresets() {
+		spec := p.RenderSpec()
+		spec.Items = append(spec.Items, RenderItem{ZhSubtitle: "中文", EnSubtitle: "en", VoicePath: "a.mp3", ImagePath: "a.png"})
+		if err := spec.Validate(); err != nil {
+			t.Fatalf("%s: %v", p.Name, err)
+		}
+
+		l := spec.Layout
+		if spec.Width != p.Width || spec.Height != p.Height ||
+			l.Image.Y < l.Band.Y || l.Image.Y+l.Image.Height > l.Subtitle.Y ||
+			l.Translation.Y+spec.Styles.Translation.LineHeight > l.Band.Y+l.Band.Height ||
+			l.Image.X < 0 || l.Image.X+l.Image.Width > spec.Width {
+			t.Fatalf("%s: elements do not fit %+v", p.Name, l)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := RenderSpecSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.Marshal(DefaultRenderSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "fps")
+	doc["extra"] = true
+	doc["width"] = 1.5
+	raw, _ = json.Marshal(doc)
+
+	err = schema.Validate(raw)
+	var serr *SchemaError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a SchemaError, got %v", err)
+	}
+
+	want := []string{
+		"/: missing property fps",
+		"/: unknown property extra",
+		"/items: expected at least 1 items, got 0",
+		"/width: expected integer, got 1.5",
+	}
+	if strings.Join(serr.Violations, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected violations:\n%s", strings.Join(serr.Violations, "\n"))
+	}
+
+	if err := schema.Validate([]byte("{")); err == nil {
+		t.Fatal("invalid json should not validate")
+	}
+}
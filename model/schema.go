@@ -0,0 +1,365 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Schema is the subset of JSON Schema (draft 2020-12) GenerateSchema
+// produces and Validate understands.
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false or *Schema
+	Items                *Schema            `json:"items,omitempty"`
+
+	Enum      []string `json:"enum,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MinItems  *int     `json:"minItems,omitempty"`
+	MaxItems  *int     `json:"maxItems,omitempty"`
+}
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// GenerateSchema builds the JSON Schema of v from its json tags. Fields
+// without omitempty are required, objects allow no other properties.
+// Constraints come from the jsonschema tag, e.g.
+// `jsonschema:"minimum=1,maximum=60"` or `jsonschema:"enum=a|b"`, and the
+// description from the description tag.
+func GenerateSchema(v interface{}) (*Schema, error) {
+	s, err := schemaOf(reflect.TypeOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	s.Schema = schemaDraft
+	return s, nil
+}
+
+func schemaOf(t reflect.Type) (*Schema, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := schemaOf(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, errors.Errorf("unsupported map key type %s", t.Key())
+		}
+		values, err := schemaOf(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	}
+
+	return nil, errors.Errorf("unsupported schema type %s", t)
+}
+
+func structSchema(t reflect.Type) (*Schema, error) {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		Required:             []string{},
+		AdditionalProperties: false,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fs, err := schemaOf(field.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s.%s", t.Name(), field.Name)
+		}
+
+		fs.Description = field.Tag.Get("description")
+		if err := applySchemaTag(fs, field.Tag.Get("jsonschema")); err != nil {
+			return nil, errors.Wrapf(err, "field %s.%s", t.Name(), field.Name)
+		}
+
+		s.Properties[name] = fs
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return s, nil
+}
+
+// RequiredOnly returns a copy of s without the optional properties of its
+// objects.
+func (s *Schema) RequiredOnly() *Schema {
+	c := *s
+	if s.Items != nil {
+		c.Items = s.Items.RequiredOnly()
+	}
+
+	if s.Properties != nil {
+		c.Properties = make(map[string]*Schema, len(s.Required))
+		for _, name := range s.Required {
+			if p, ok := s.Properties[name]; ok {
+				c.Properties[name] = p.RequiredOnly()
+			}
+		}
+	}
+
+	return &c
+}
+
+func applySchemaTag(s *Schema, tag string) error {
+	if tag == "" {
+		return nil
+	}
+
+	for _, opt := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "enum":
+			// on slices the enum restricts the items
+			if s.Type == "array" {
+				s.Items.Enum = strings.Split(value, "|")
+			} else {
+				s.Enum = strings.Split(value, "|")
+			}
+		case "pattern":
+			if _, err := regexp.Compile(value); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q", value)
+			}
+			s.Pattern = value
+		case "minimum", "maximum":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s %q", key, value)
+			}
+			if key == "minimum" {
+				s.Minimum = &f
+			} else {
+				s.Maximum = &f
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s %q", key, value)
+			}
+			switch key {
+			case "minLength":
+				s.MinLength = &n
+			case "maxLength":
+				s.MaxLength = &n
+			case "minItems":
+				s.MinItems = &n
+			default:
+				s.MaxItems = &n
+			}
+		default:
+			return errors.Errorf("unknown jsonschema option %q", key)
+		}
+	}
+
+	return nil
+}
+
+// SchemaError lists every place a document breaks its schema.
+type SchemaError struct {
+	Violations []string
+}
+
+func (e *SchemaError) Error() string {
+	return "schema violation: " + strings.Join(e.Violations, "; ")
+}
+
+// Validate checks the json document raw against s.
+func (s *Schema) Validate(raw []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return errors.Wrap(err, "invalid json")
+	}
+
+	var violations []string
+	s.validate("", doc, &violations)
+	if len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+// ValidateValue marshals v and checks it against s.
+func (s *Schema) ValidateValue(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal")
+	}
+
+	return s.Validate(raw)
+}
+
+func (s *Schema) validate(path string, v interface{}, violations *[]string) {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		*violations = append(*violations, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected object")
+			return
+		}
+
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				fail("missing property %s", name)
+			}
+		}
+
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ps, ok := s.Properties[name]; ok {
+				ps.validate(path+"/"+name, obj[name], violations)
+				continue
+			}
+
+			switch extra := s.AdditionalProperties.(type) {
+			case *Schema:
+				extra.validate(path+"/"+name, obj[name], violations)
+			case bool:
+				if !extra {
+					fail("unknown property %s", name)
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			fail("expected array")
+			return
+		}
+
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			fail("expected at least %d items, got %d", *s.MinItems, len(arr))
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			fail("expected at most %d items, got %d", *s.MaxItems, len(arr))
+		}
+
+		if s.Items != nil {
+			for i, item := range arr {
+				s.Items.validate(fmt.Sprintf("%s/%d", path, i), item, violations)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("expected string")
+			return
+		}
+
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("expected at least %d characters, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("expected at most %d characters, got %d", *s.MaxLength, n)
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			fail("%q does not match %s", str, s.Pattern)
+		}
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				found = found || e == str
+			}
+			if !found {
+				fail("%q is not one of %s", str, strings.Join(s.Enum, ", "))
+			}
+		}
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			fail("expected %s", s.Type)
+			return
+		}
+
+		f, err := num.Float64()
+		if err != nil {
+			fail("invalid number %s", num)
+			return
+		}
+
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				fail("expected integer, got %s", num)
+				return
+			}
+		}
+
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("%s is less than %v", num, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("%s is greater than %v", num, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected boolean")
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ScriptItemPatch changes some fields of an item, nil fields are kept.
+type ScriptItemPatch struct {
+	ZhSubtitle  *string `json:"cn"`
+	EnSubtitle  *string `json:"en"`
+	ImagePrompt *string `json:"image_prompt"`
+}
+
+// SetZhSubtitle changes the chinese subtitle, the voice reads the old one
+// and is dropped.
+func (item *ScriptItem) SetZhSubtitle(cn string) {
+	if item.ZhSubtitle == cn {
+		return
+	}
+
+	item.ZhSubtitle = cn
+	item.dropVoice()
+}
+
+// SetImagePrompt changes the image prompt, the image shows the old one and
+// is dropped.
+func (item *ScriptItem) SetImagePrompt(prompt string) {
+	if item.ImagePrompt == prompt {
+		return
+	}
+
+	item.ImagePrompt = prompt
+	item.dropImage()
+}
+
+func (item *ScriptItem) dropVoice() {
+	item.VoicePath, item.VoiceAsset = "", 0
+	item.DurationMs = 0
+	item.StartMs = 0
+	item.VoiceStatus, item.VoiceError = ItemStatusPending, ""
+}
+
+func (item *ScriptItem) dropImage() {
+	item.ImagePath, item.ImageAsset = "", 0
+	item.ImageStatus, item.ImageError = ItemStatusPending, ""
+}
+
+// Apply changes the item by p, assets of changed texts are dropped.
+func (item *ScriptItem) Apply(p ScriptItemPatch) {
+	if p.ZhSubtitle != nil {
+		item.SetZhSubtitle(*p.ZhSubtitle)
+	}
+	if p.EnSubtitle != nil {
+		item.EnSubtitle = *p.EnSubtitle
+	}
+	if p.ImagePrompt != nil {
+		item.SetImagePrompt(*p.ImagePrompt)
+	}
+}
+
+// CheckIndex returns an error unless i is the index of an item.
+func (s *MovieScript) CheckIndex(i int) error {
+	if i < 0 || i >= len(s.ScriptItems) {
+		return errors.Errorf("script index %d out of range", i)
+	}
+
+	return nil
+}
+
+// InsertItem puts a new item without assets at index i, i may be the
+// length of the script to append.
+func (s *MovieScript) InsertItem(i int, item *ScriptItem) error {
+	if i < 0 || i > len(s.ScriptItems) {
+		return errors.Errorf("script index %d out of range", i)
+	}
+
+	item.Id = 0
+	item.dropVoice()
+	item.dropImage()
+
+	s.ScriptItems = append(s.ScriptItems, nil)
+	copy(s.ScriptItems[i+1:], s.ScriptItems[i:])
+	s.ScriptItems[i] = item
+	return nil
+}
+
+// DeleteItem removes item i, the last item can not be removed.
+func (s *MovieScript) DeleteItem(i int) error {
+	if err := s.CheckIndex(i); err != nil {
+		return err
+	}
+	if len(s.ScriptItems) == 1 {
+		return errors.New("a script needs at least one item")
+	}
+
+	s.ScriptItems = append(s.ScriptItems[:i], s.ScriptItems[i+1:]...)
+	return nil
+}
+
+// Reorder puts the items in order, order lists every old index once.
+func (s *MovieScript) Reorder(order []int) error {
+	if len(order) != len(s.ScriptItems) {
+		return errors.Errorf("order has %d indexes, script has %d items", len(order), len(s.ScriptItems))
+	}
+
+	seen := make([]bool, len(order))
+	items := make([]*ScriptItem, 0, len(order))
+	for _, i := range order {
+		if err := s.CheckIndex(i); err != nil {
+			return err
+		}
+		if seen[i] {
+			return errors.Errorf("script index %d given twice", i)
+		}
+		seen[i] = true
+		items = append(items, s.ScriptItems[i])
+	}
+
+	s.ScriptItems = items
+	return nil
+}
+
+// SplitItem cuts the chinese subtitle of item i after at characters into
+// two items with the english subtitles en. Both keep the image, neither
+// the voice.
+func (s *MovieScript) SplitItem(i, at int, en [2]string) error {
+	if err := s.CheckIndex(i); err != nil {
+		return err
+	}
+
+	item := s.ScriptItems[i]
+	cn := []rune(item.ZhSubtitle)
+	if at <= 0 || at >= len(cn) {
+		return errors.Errorf("split position %d outside of the %d characters of item %d", at, len(cn), i)
+	}
+
+	second := &ScriptItem{
+		ZhSubtitle:  strings.TrimSpace(string(cn[at:])),
+		EnSubtitle:  en[1],
+		ImagePrompt: item.ImagePrompt,
+		ImagePath:   item.ImagePath,
+		ImageAsset:  item.ImageAsset,
+		ImageStatus: item.ImageStatus,
+		ImageError:  item.ImageError,
+	}
+	item.SetZhSubtitle(strings.TrimSpace(string(cn[:at])))
+	item.EnSubtitle = en[0]
+
+	s.ScriptItems = append(s.ScriptItems, nil)
+	copy(s.ScriptItems[i+2:], s.ScriptItems[i+1:])
+	s.ScriptItems[i+1] = second
+	return nil
+}
+
+// MergeItems joins item i and the one after it, the image of item i is
+// kept and the voice dropped.
+func (s *MovieScript) MergeItems(i int) error {
+	if err := s.CheckIndex(i); err != nil {
+		return err
+	}
+	if i+1 >= len(s.ScriptItems) {
+		return errors.Errorf("script item %d is the last one, nothing to merge with", i)
+	}
+
+	item, next := s.ScriptItems[i], s.ScriptItems[i+1]
+	item.SetZhSubtitle(item.ZhSubtitle + next.ZhSubtitle)
+	item.EnSubtitle = strings.TrimSpace(item.EnSubtitle + " " + next.EnSubtitle)
+
+	s.ScriptItems = append(s.ScriptItems[:i+1], s.ScriptItems[i+2:]...)
+	return nil
+}
@@ -0,0 +1,379 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+var ScriptItemCreationSchema = `
+CREATE TABLE IF NOT EXISTS script_items (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER NOT NULL, -- 电影ID
+	position INTEGER NOT NULL, -- 在脚本中的位置，从 0 开始
+	cn TEXT NOT NULL DEFAULT '', -- 中文字幕
+	en TEXT NOT NULL DEFAULT '', -- 英文字幕
+	image_prompt TEXT NOT NULL DEFAULT '', -- 配图提示词
+	voice_path TEXT NOT NULL DEFAULT '', -- 配音文件，相对 workdir
+	duration_ms INTEGER NOT NULL DEFAULT 0, -- 配音时长，毫秒
+	image_path TEXT NOT NULL DEFAULT '', -- 配图文件，相对 workdir
+	voice_status TEXT NOT NULL DEFAULT 'pending', -- 配音状态
+	voice_error TEXT NOT NULL DEFAULT '', -- 配音失败原因
+	image_status TEXT NOT NULL DEFAULT 'pending', -- 配图状态
+	image_error TEXT NOT NULL DEFAULT '' -- 配图失败原因
+);
+CREATE INDEX IF NOT EXISTS idx_script_items_movie_id ON script_items(movie_id, position);
+`
+
+// The status of the voice and the image of an item.
+const (
+	ItemStatusPending = "pending" // 未生成
+	ItemStatusDone    = "done"    // 已生成
+	ItemStatusFailed  = "failed"  // 生成失败
+)
+
+// ErrItemChanged is returned when an asset is saved for an item whose text
+// was edited or which was removed while the asset was generated.
+var ErrItemChanged = errors.New("script item changed while its asset was generated")
+
+// String is the script as json, empty while the movie has none.
+func (s *MovieScript) String() string {
+	if s == nil || (s.Title == "" && len(s.ScriptItems) == 0) {
+		return ""
+	}
+
+	raw, _ := json.Marshal(s)
+	return string(raw)
+}
+
+// normalize derives missing statuses from the asset paths.
+func (item *ScriptItem) normalize() {
+	for _, asset := range []struct {
+		path   string
+		status *string
+	}{
+		{item.VoicePath, &item.VoiceStatus},
+		{item.ImagePath, &item.ImageStatus},
+	} {
+		switch {
+		case asset.path != "":
+			*asset.status = ItemStatusDone
+		case *asset.status == "" || *asset.status == ItemStatusDone:
+			*asset.status = ItemStatusPending
+		}
+	}
+}
+
+func queryScript(q sqlx.Queryer, movieId int64, title string) (*MovieScript, error) {
+	script := &MovieScript{Title: title, ScriptItems: make([]*ScriptItem, 0)}
+	if err := sqlx.Select(q, &script.ScriptItems, "SELECT * FROM script_items WHERE movie_id = ? ORDER BY position", movieId); err != nil {
+		return nil, errors.Wrap(err, "failed to load script items")
+	}
+
+	script.Retime(DefaultItemPauseMs)
+	return script, nil
+}
+
+// loadScripts fills in the scripts of movies.
+func loadScripts(movies []*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(movies))
+	scripts := make(map[int64]*MovieScript, len(movies))
+	for _, m := range movies {
+		ids = append(ids, m.Id)
+		m.Script = &MovieScript{Title: m.Title.String, ScriptItems: make([]*ScriptItem, 0)}
+		scripts[m.Id] = m.Script
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM script_items WHERE movie_id IN (?) ORDER BY movie_id, position", ids)
+	if err != nil {
+		return errors.Wrap(err, "failed to build script items query")
+	}
+
+	var items []*ScriptItem
+	if err := db.Select(&items, query, args...); err != nil {
+		return errors.Wrap(err, "failed to load script items")
+	}
+
+	for _, item := range items {
+		scripts[item.MovieId].ScriptItems = append(scripts[item.MovieId].ScriptItems, item)
+	}
+
+	for _, script := range scripts {
+		script.Retime(DefaultItemPauseMs)
+	}
+
+	return nil
+}
+
+// GetScript loads the current script of the movie, along with its title,
+// duration and version.
+func (m *Movie) GetScript() (*MovieScript, error) {
+	var row struct {
+		Title      sql.NullString `db:"title"`
+		DurationMs sql.NullInt64  `db:"duration_ms"`
+		Version    int64          `db:"version"`
+	}
+	if err := db.Get(&row, "SELECT title, duration_ms, version FROM movies WHERE id = ?", m.Id); err != nil {
+		return nil, errors.Wrap(err, "failed to load movie")
+	}
+
+	script, err := queryScript(db, m.Id, row.Title.String)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Title, m.DurationMs, m.Version, m.Script = row.Title, row.DurationMs, row.Version, script
+	return script, nil
+}
+
+// SetScript replaces the script of the movie and records it as rev, the
+// items of the old one are removed with their assets. m.ScriptModel is
+// saved as the model which wrote it. A guard works as with EditScript.
+func (m *Movie) SetScript(script *MovieScript, rev *ScriptRevision, guard *StateGuard) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if guard != nil {
+		if err := guard.require(tx, m); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM script_items WHERE movie_id = ?", m.Id); err != nil {
+		return errors.Wrap(err, "failed to delete script items")
+	}
+
+	if _, err := tx.Exec("UPDATE movies SET script_model = ? WHERE id = ?", m.ScriptModel, m.Id); err != nil {
+		return errors.Wrap(err, "failed to save script model")
+	}
+
+	for _, item := range script.ScriptItems {
+		item.Id = 0
+	}
+
+	if err := m.saveScript(tx, script, nil); err != nil {
+		return err
+	}
+
+	if err := rev.record(tx, m.Id, script); err != nil {
+		return err
+	}
+
+	if guard != nil {
+		if err := guard.settle(tx, m, script); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit script")
+	}
+
+	m.Script = script
+	return nil
+}
+
+// EditScript applies edit to the current script of the movie, saves the
+// items it changed and records the result as rev, nobody else writes the
+// script in between. A guard checks the state of the movie and settles it
+// in the same write. It returns
+// ErrMovieChanged when the movie was changed since it was loaded, errors of
+// edit are returned as is.
+func (m *Movie) EditScript(rev *ScriptRevision, guard *StateGuard, edit func(script *MovieScript) error) (*MovieScript, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		Title   sql.NullString `db:"title"`
+		Version int64          `db:"version"`
+	}
+	if err := tx.Get(&row, "SELECT title, version FROM movies WHERE id = ?", m.Id); err != nil {
+		return nil, errors.Wrap(err, "failed to load movie")
+	}
+
+	if row.Version != m.Version {
+		return nil, ErrMovieChanged
+	}
+
+	if guard != nil {
+		if err := guard.require(tx, m); err != nil {
+			return nil, err
+		}
+	}
+
+	script, err := queryScript(tx, m.Id, row.Title.String)
+	if err != nil {
+		return nil, err
+	}
+
+	before := make(map[int64]ScriptItem, len(script.ScriptItems))
+	for _, item := range script.ScriptItems {
+		before[item.Id] = *item
+	}
+
+	if err := edit(script); err != nil {
+		return nil, err
+	}
+
+	if err := m.saveScript(tx, script, before); err != nil {
+		return nil, err
+	}
+
+	if err := rev.record(tx, m.Id, script); err != nil {
+		return nil, err
+	}
+
+	if guard != nil {
+		if err := guard.settle(tx, m, script); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit script")
+	}
+
+	m.Script = script
+	return script, nil
+}
+
+// saveScript writes the items of script which differ from before, items
+// without an id are new and items of before left out are removed. The
+// title and the duration of the movie follow the script, its version goes
+// up.
+func (m *Movie) saveScript(tx *sqlx.Tx, script *MovieScript, before map[int64]ScriptItem) error {
+	kept := make(map[int64]bool, len(script.ScriptItems))
+	for i, item := range script.ScriptItems {
+		item.MovieId, item.Position = m.Id, i
+		item.normalize()
+
+		if item.Id == 0 {
+			result, err := tx.NamedExec("INSERT INTO script_items (movie_id, position, cn, en, image_prompt, "+
+				"voice_path, voice_asset_id, duration_ms, image_path, image_asset_id, "+
+				"voice_status, voice_error, image_status, image_error) "+
+				"VALUES (:movie_id, :position, :cn, :en, :image_prompt, "+
+				":voice_path, :voice_asset_id, :duration_ms, :image_path, :image_asset_id, "+
+				":voice_status, :voice_error, :image_status, :image_error)", item)
+			if err != nil {
+				return errors.Wrap(err, "failed to create script item")
+			}
+
+			item.Id, _ = result.LastInsertId()
+			kept[item.Id] = true
+			continue
+		}
+
+		old, ok := before[item.Id]
+		if !ok {
+			return errors.Errorf("script item %d is not part of movie %d", item.Id, m.Id)
+		}
+
+		kept[item.Id] = true
+		if old.StartMs = item.StartMs; old == *item {
+			continue
+		}
+
+		if _, err := tx.NamedExec("UPDATE script_items SET position = :position, cn = :cn, en = :en, "+
+			"image_prompt = :image_prompt, voice_path = :voice_path, voice_asset_id = :voice_asset_id, "+
+			"duration_ms = :duration_ms, image_path = :image_path, image_asset_id = :image_asset_id, "+
+			"voice_status = :voice_status, voice_error = :voice_error, "+
+			"image_status = :image_status, image_error = :image_error WHERE id = :id", item); err != nil {
+			return errors.Wrap(err, "failed to update script item")
+		}
+	}
+
+	for id := range before {
+		if kept[id] {
+			continue
+		}
+
+		if _, err := tx.Exec("DELETE FROM script_items WHERE id = ?", id); err != nil {
+			return errors.Wrap(err, "failed to delete script item")
+		}
+	}
+
+	total := script.Retime(DefaultItemPauseMs)
+	m.Title = sql.NullString{String: script.Title, Valid: script.Title != ""}
+	m.DurationMs = sql.NullInt64{Int64: total, Valid: total > 0}
+	return bumpVersion(tx, &m.Version, "UPDATE movies SET title = ?, duration_ms = ?, version = version + 1 WHERE id = ? RETURNING version",
+		m.Title, m.DurationMs, m.Id)
+}
+
+// SaveVoice stores the voice of the item, it returns ErrItemChanged when
+// the chinese subtitle was edited in the meantime.
+func (item *ScriptItem) SaveVoice() error {
+	item.VoiceStatus, item.VoiceError = ItemStatusDone, ""
+	return item.saveAsset("UPDATE script_items SET voice_path = ?, voice_asset_id = ?, duration_ms = ?, voice_status = ?, "+
+		"voice_error = '' WHERE id = ? AND cn = ?", item.VoicePath, item.VoiceAsset, item.DurationMs, item.VoiceStatus,
+		item.Id, item.ZhSubtitle)
+}
+
+// SaveImage stores the image of the item, it returns ErrItemChanged when
+// the image prompt was edited in the meantime.
+func (item *ScriptItem) SaveImage() error {
+	item.ImageStatus, item.ImageError = ItemStatusDone, ""
+	return item.saveAsset("UPDATE script_items SET image_path = ?, image_asset_id = ?, image_status = ?, image_error = '' "+
+		"WHERE id = ? AND image_prompt = ?", item.ImagePath, item.ImageAsset, item.ImageStatus, item.Id, item.ImagePrompt)
+}
+
+// FailVoice records why the voice of the item could not be generated.
+func (item *ScriptItem) FailVoice(cause error) error {
+	item.VoiceStatus, item.VoiceError = ItemStatusFailed, cause.Error()
+	return item.saveAsset("UPDATE script_items SET voice_status = ?, voice_error = ? WHERE id = ? AND cn = ?",
+		item.VoiceStatus, item.VoiceError, item.Id, item.ZhSubtitle)
+}
+
+// FailImage records why the image of the item could not be generated.
+func (item *ScriptItem) FailImage(cause error) error {
+	item.ImageStatus, item.ImageError = ItemStatusFailed, cause.Error()
+	return item.saveAsset("UPDATE script_items SET image_status = ?, image_error = ? WHERE id = ? AND image_prompt = ?",
+		item.ImageStatus, item.ImageError, item.Id, item.ImagePrompt)
+}
+
+// saveAsset runs the conditional update of one item and brings the
+// duration of the movie up to date.
+func (item *ScriptItem) saveAsset(query string, args ...interface{}) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to update script item")
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrItemChanged
+	}
+
+	script, err := queryScript(tx, item.MovieId, "")
+	if err != nil {
+		return err
+	}
+
+	total := script.Retime(DefaultItemPauseMs)
+	if _, err := tx.Exec("UPDATE movies SET duration_ms = ?, version = version + 1 WHERE id = ?",
+		sql.NullInt64{Int64: total, Valid: total > 0}, item.MovieId); err != nil {
+		return errors.Wrap(err, "failed to update movie duration")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit script item")
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestScriptItems(t *testing.T) {
+	openTestDB(t)
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	movie := NewMovie()
+	if err := movie.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := movie.SetScript(&MovieScript{Title: "标题", ScriptItems: []*ScriptItem{
+		{ZhSubtitle: "第一句", ImagePrompt: "山"},
+		{ZhSubtitle: "第二句", ImagePrompt: "水"},
+	}}, NewRevision(RevisionSourceLLM, "fake", "金牛座"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := movie.GetScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the voice of the old text arrives after the edit
+	if _, err := movie.EditScript(NewRevision(RevisionSourceEdit, "tester", ""), nil, func(s *MovieScript) error {
+		s.ScriptItems[0].SetZhSubtitle("新的第一句")
+		return s.MergeItems(0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	item := stale.ScriptItems[0]
+	item.VoicePath, item.DurationMs = "movie/1/audio/old.mp3", 1000
+	if err := item.SaveVoice(); !errors.Is(err, ErrItemChanged) {
+		t.Fatalf("expected ErrItemChanged, got %v", err)
+	}
+	if err := stale.ScriptItems[1].FailImage(errors.New("boom")); !errors.Is(err, ErrItemChanged) {
+		t.Fatalf("the second item was merged away, got %v", err)
+	}
+
+	script, err := movie.GetScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := script.ScriptItems[0]
+	if len(script.ScriptItems) != 1 || got.ZhSubtitle != "新的第一句第二句" || got.VoicePath != "" ||
+		got.VoiceStatus != ItemStatusPending || got.Id != item.Id {
+		t.Fatalf("unexpected script %s", script)
+	}
+
+	got.VoicePath, got.DurationMs = "movie/1/audio/new.mp3", 1500
+	if err := got.SaveVoice(); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.FailImage(errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	movie, err = GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = movie.Script.ScriptItems[0]
+	if movie.DurationMs.Int64 != 1500 || got.VoiceStatus != ItemStatusDone ||
+		got.ImageStatus != ItemStatusFailed || got.ImageError != "boom" || movie.Script.Title != "标题" {
+		t.Fatalf("unexpected movie %+v %s", movie, movie.Script)
+	}
+
+	revisions, err := ListScriptRevisions(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Source != RevisionSourceEdit || revisions[1].Prompt != "金牛座" {
+		t.Fatalf("unexpected revisions %+v", revisions)
+	}
+}
+
+func TestScriptStateGuard(t *testing.T) {
+	openTestDB(t)
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	movie := NewMovie()
+	if err := movie.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &StateGuard{Op: "import script", States: []State{StateInit, StateScripted}, Reason: "imported"}
+	if err := movie.SetScript(&MovieScript{Title: "标题", ScriptItems: []*ScriptItem{
+		{ZhSubtitle: "第一句", VoicePath: "movie/1/audio/1.mp3"},
+	}}, NewRevision(RevisionSourceImport, "tester", ""), imported); err != nil {
+		t.Fatal(err)
+	}
+	if movie.State != StateVoiced.String() {
+		t.Fatalf("expected the import to settle at voiced, got %s", movie.State)
+	}
+
+	// the state is checked and settled in the write of the edit
+	edited := &StateGuard{Op: "edit script", States: []State{StateScripted, StateVoiced}, Reason: "edited"}
+	stale, err := GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := movie.EditScript(NewRevision(RevisionSourceEdit, "tester", ""), edited, func(s *MovieScript) error {
+		s.ScriptItems[0].SetZhSubtitle("新的第一句")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := GetMovie(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.State != StateScripted.String() || latest.Version != movie.Version || latest.State != movie.State {
+		t.Fatalf("unexpected movie %s v%d, edited copy %s v%d", latest.State, latest.Version, movie.State, movie.Version)
+	}
+
+	if _, err := stale.EditScript(NewRevision(RevisionSourceEdit, "tester", ""), edited, func(*MovieScript) error { return nil }); !errors.Is(err, ErrMovieChanged) {
+		t.Fatalf("expected ErrMovieChanged, got %v", err)
+	}
+
+	voicedOnly := &StateGuard{Op: "edit script", States: []State{StateVoiced}, Reason: "edited"}
+	if _, err := movie.EditScript(NewRevision(RevisionSourceEdit, "tester", ""), voicedOnly, func(*MovieScript) error { return nil }); !IsStateError(err) {
+		t.Fatalf("expected a state error, got %v", err)
+	}
+
+	revisions, err := ListScriptRevisions(movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("rejected edits are not recorded, got %d revisions", len(revisions))
+	}
+}
@@ -0,0 +1,223 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+var ScriptRevisionCreationSchema = `
+CREATE TABLE IF NOT EXISTS script_revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id INTEGER NOT NULL, -- 电影ID
+	author TEXT NOT NULL DEFAULT '', -- 作者，模型或用户
+	source TEXT NOT NULL, -- 来源 llm/edit/import/restore
+	prompt TEXT NOT NULL DEFAULT '', -- 生成时使用的提示词
+	script TEXT NOT NULL, -- 脚本快照，json
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- 创建时间
+);
+CREATE INDEX IF NOT EXISTS idx_script_revisions_movie_id ON script_revisions(movie_id);
+`
+
+// Where a script revision comes from.
+const (
+	RevisionSourceLLM     = "llm"     // 模型生成
+	RevisionSourceEdit    = "edit"    // 手工编辑
+	RevisionSourceImport  = "import"  // 导入
+	RevisionSourceRestore = "restore" // 恢复历史版本
+)
+
+// ScriptRevision is a snapshot of the script of a movie taken whenever the
+// script changes.
+type ScriptRevision struct {
+	Id        int64     `db:"id" json:"id"`                 // ID
+	MovieId   int64     `db:"movie_id" json:"movie_id"`     // 电影ID
+	Author    string    `db:"author" json:"author"`         // 作者
+	Source    string    `db:"source" json:"source"`         // 来源
+	Prompt    string    `db:"prompt" json:"prompt"`         // 提示词
+	Script    string    `db:"script" json:"-"`              // 脚本快照
+	CreatedAt time.Time `db:"created_at" json:"created_at"` // 创建时间
+}
+
+// NewRevision describes a change of the script made by author, the snapshot
+// is taken when the script is saved.
+func NewRevision(source, author, prompt string) *ScriptRevision {
+	return &ScriptRevision{Source: source, Author: author, Prompt: prompt}
+}
+
+func (r *ScriptRevision) MarshalJSON() ([]byte, error) {
+	type revision ScriptRevision
+	var script json.RawMessage
+	if r.Script != "" {
+		script = json.RawMessage(r.Script)
+	}
+
+	return json.Marshal(struct {
+		*revision
+		Script json.RawMessage `json:"script,omitempty"`
+	}{(*revision)(r), script})
+}
+
+// GetScript returns the script as it was at the revision.
+func (r *ScriptRevision) GetScript() (*MovieScript, error) {
+	script := MovieScript{ScriptItems: make([]*ScriptItem, 0)}
+	if err := json.Unmarshal([]byte(r.Script), &script); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal script revision")
+	}
+
+	return &script, nil
+}
+
+// record stores the revision with a snapshot of script.
+func (r *ScriptRevision) record(tx *sqlx.Tx, movieId int64, script *MovieScript) error {
+	raw, err := json.Marshal(script)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal script revision")
+	}
+
+	r.MovieId, r.Script, r.CreatedAt = movieId, string(raw), time.Now()
+	result, err := tx.NamedExec("INSERT INTO script_revisions (movie_id, author, source, prompt, script, created_at) "+
+		"VALUES (:movie_id, :author, :source, :prompt, :script, :created_at)", r)
+	if err != nil {
+		return errors.Wrap(err, "failed to record script revision")
+	}
+
+	r.Id, _ = result.LastInsertId()
+	return nil
+}
+
+// ListScriptRevisions lists the revisions of a movie newest first, without
+// their scripts.
+func ListScriptRevisions(movieId int64) ([]*ScriptRevision, error) {
+	revisions := make([]*ScriptRevision, 0)
+	if err := db.Select(&revisions, "SELECT id, movie_id, author, source, prompt, created_at FROM script_revisions "+
+		"WHERE movie_id = ? ORDER BY id DESC", movieId); err != nil {
+		return nil, errors.Wrap(err, "failed to list script revisions")
+	}
+
+	return revisions, nil
+}
+
+// GetScriptRevision returns revision id of a movie.
+func GetScriptRevision(movieId, id int64) (*ScriptRevision, error) {
+	var r ScriptRevision
+	if err := db.Get(&r, "SELECT * FROM script_revisions WHERE movie_id = ? AND id = ?", movieId, id); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// The change of an item between two revisions.
+const (
+	DiffUnchanged = "unchanged"
+	DiffChanged   = "changed"
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+)
+
+// ItemDiff is how one item changed, indexes are nil on the side the item is
+// missing from.
+type ItemDiff struct {
+	Op        string      `json:"op"`
+	FromIndex *int        `json:"from_index"`
+	ToIndex   *int        `json:"to_index"`
+	From      *ScriptItem `json:"from,omitempty"`
+	To        *ScriptItem `json:"to,omitempty"`
+	Fields    []string    `json:"fields,omitempty"` // 变化的字段
+}
+
+// ScriptDiff is the change from one script to another.
+type ScriptDiff struct {
+	FromTitle string      `json:"from_title"`
+	ToTitle   string      `json:"to_title"`
+	Items     []*ItemDiff `json:"items"`
+}
+
+// changedFields lists the text fields which differ between a and b.
+func changedFields(a, b *ScriptItem) []string {
+	var fields []string
+	for _, f := range []struct {
+		name string
+		a, b string
+	}{
+		{"cn", a.ZhSubtitle, b.ZhSubtitle},
+		{"en", a.EnSubtitle, b.EnSubtitle},
+		{"image_prompt", a.ImagePrompt, b.ImagePrompt},
+	} {
+		if f.a != f.b {
+			fields = append(fields, f.name)
+		}
+	}
+
+	return fields
+}
+
+// DiffScripts lines up the items of two scripts by their longest common
+// run of unchanged items. Items between two unchanged ones are paired up
+// as changed in order, the rest are added or removed.
+func DiffScripts(from, to *MovieScript) *ScriptDiff {
+	a, b := from.ScriptItems, to.ScriptItems
+	same := func(i, j int) bool { return len(changedFields(a[i], b[j])) == 0 }
+
+	// lcs[i][j] is the length of the common run of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case same(i, j):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := &ScriptDiff{FromTitle: from.Title, ToTitle: to.Title, Items: make([]*ItemDiff, 0)}
+	var removed, added []int
+	flush := func() {
+		for k := 0; k < len(removed) || k < len(added); k++ {
+			d := &ItemDiff{}
+			if k < len(removed) {
+				i := removed[k]
+				d.Op, d.FromIndex, d.From = DiffRemoved, &i, a[i]
+			}
+			if k < len(added) {
+				j := added[k]
+				d.Op, d.ToIndex, d.To = DiffAdded, &j, b[j]
+			}
+			if d.From != nil && d.To != nil {
+				d.Op, d.Fields = DiffChanged, changedFields(d.From, d.To)
+			}
+			diff.Items = append(diff.Items, d)
+		}
+		removed, added = removed[:0], added[:0]
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && same(i, j):
+			flush()
+			fi, tj := i, j
+			diff.Items = append(diff.Items, &ItemDiff{Op: DiffUnchanged, FromIndex: &fi, ToIndex: &tj, From: a[i], To: b[j]})
+			i, j = i+1, j+1
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, i)
+			i++
+		default:
+			added = append(added, j)
+			j++
+		}
+	}
+	flush()
+
+	return diff
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffScripts(t *testing.T) {
+	script := func(cns ...string) *MovieScript {
+		s := &MovieScript{}
+		for _, cn := range cns {
+			s.ScriptItems = append(s.ScriptItems, &ScriptItem{ZhSubtitle: cn, EnSubtitle: "en " + cn})
+		}
+		return s
+	}
+
+	to := script("一", "二改", "四", "五")
+	to.ScriptItems[3].EnSubtitle = "five"
+
+	diff := DiffScripts(script("一", "二", "三", "四", "五"), to)
+	var ops []string
+	for _, d := range diff.Items {
+		ops = append(ops, d.Op)
+	}
+
+	// 二 became 二改 and 三 was dropped, 五 got a new translation
+	want := []string{DiffUnchanged, DiffChanged, DiffRemoved, DiffUnchanged, DiffChanged}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("expected %v, got %v", want, ops)
+	}
+
+	if d := diff.Items[1]; *d.FromIndex != 1 || *d.ToIndex != 1 || !reflect.DeepEqual(d.Fields, []string{"cn", "en"}) {
+		t.Fatalf("unexpected change %+v", d)
+	}
+	if d := diff.Items[2]; *d.FromIndex != 2 || d.ToIndex != nil {
+		t.Fatalf("unexpected removal %+v", d)
+	}
+	if d := diff.Items[4]; !reflect.DeepEqual(d.Fields, []string{"en"}) {
+		t.Fatalf("unexpected change %+v", d)
+	}
+
+	if added := DiffScripts(script(), script("一")); len(added.Items) != 1 || added.Items[0].Op != DiffAdded {
+		t.Fatalf("unexpected diff %+v", added.Items)
+	}
+}
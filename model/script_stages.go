@@ -0,0 +1,160 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// The stages of the staged script pipeline, in the order they run.
+const (
+	ScriptStageOutline      = "outline"       // 从创意列出大纲
+	ScriptStageDraft        = "draft"         // 按字数写中文旁白
+	ScriptStageSegment      = "segment"       // 切分为字幕
+	ScriptStageTranslate    = "translate"     // 逐条翻译为英文
+	ScriptStageImagePrompts = "image_prompts" // 逐条写文生图提示词
+)
+
+var ScriptStages = []string{
+	ScriptStageOutline,
+	ScriptStageDraft,
+	ScriptStageSegment,
+	ScriptStageTranslate,
+	ScriptStageImagePrompts,
+}
+
+// scriptStageNeeds is the stage whose artifact each stage works on.
+var scriptStageNeeds = map[string]string{
+	ScriptStageDraft:        ScriptStageOutline,
+	ScriptStageSegment:      ScriptStageDraft,
+	ScriptStageTranslate:    ScriptStageSegment,
+	ScriptStageImagePrompts: ScriptStageSegment,
+}
+
+// IsScriptStage reports whether stage is one of ScriptStages.
+func IsScriptStage(stage string) bool {
+	for _, s := range ScriptStages {
+		if s == stage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScriptStageNeeds returns the stage which has to be done before stage, ""
+// for the first one.
+func ScriptStageNeeds(stage string) string {
+	return scriptStageNeeds[stage]
+}
+
+// ScriptArtifacts are the intermediate results of the staged script
+// pipeline, stored on the movie so every stage can be run again alone.
+type ScriptArtifacts struct {
+	Title        string   `json:"title,omitempty"`         // 视频标题
+	Outline      []string `json:"outline,omitempty"`       // 大纲
+	Draft        string   `json:"draft,omitempty"`         // 中文旁白
+	Segments     []string `json:"segments,omitempty"`      // 中文字幕
+	Translations []string `json:"translations,omitempty"`  // 英文字幕，与 Segments 一一对应
+	ImagePrompts []string `json:"image_prompts,omitempty"` // 文生图提示词，与 Segments 一一对应
+}
+
+// Done reports whether stage left its artifact.
+func (a *ScriptArtifacts) Done(stage string) bool {
+	switch stage {
+	case ScriptStageOutline:
+		return len(a.Outline) > 0
+	case ScriptStageDraft:
+		return a.Draft != ""
+	case ScriptStageSegment:
+		return len(a.Segments) > 0
+	case ScriptStageTranslate:
+		return len(a.Translations) > 0
+	case ScriptStageImagePrompts:
+		return len(a.ImagePrompts) > 0
+	}
+
+	return false
+}
+
+// Complete reports whether every stage is done.
+func (a *ScriptArtifacts) Complete() bool {
+	for _, stage := range ScriptStages {
+		if !a.Done(stage) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Clear drops the artifact of stage and of every stage built on it.
+func (a *ScriptArtifacts) Clear(stage string) {
+	switch stage {
+	case ScriptStageOutline:
+		a.Title, a.Outline = "", nil
+	case ScriptStageDraft:
+		a.Draft = ""
+	case ScriptStageSegment:
+		a.Segments = nil
+	case ScriptStageTranslate:
+		a.Translations = nil
+	case ScriptStageImagePrompts:
+		a.ImagePrompts = nil
+	}
+
+	for next, needs := range scriptStageNeeds {
+		if needs == stage {
+			a.Clear(next)
+		}
+	}
+}
+
+// Script assembles the script once every stage is done.
+func (a *ScriptArtifacts) Script() (*MovieScript, error) {
+	if !a.Complete() {
+		return nil, errors.New("script stages are not done")
+	}
+
+	if len(a.Translations) != len(a.Segments) || len(a.ImagePrompts) != len(a.Segments) {
+		return nil, errors.Errorf("%d segments but %d translations and %d image prompts",
+			len(a.Segments), len(a.Translations), len(a.ImagePrompts))
+	}
+
+	script := &MovieScript{Title: a.Title, ScriptItems: make([]*ScriptItem, 0, len(a.Segments))}
+	for i, cn := range a.Segments {
+		script.ScriptItems = append(script.ScriptItems, &ScriptItem{
+			ZhSubtitle:  cn,
+			EnSubtitle:  a.Translations[i],
+			ImagePrompt: a.ImagePrompts[i],
+		})
+	}
+
+	return script, nil
+}
+
+func (m *Movie) GetScriptArtifacts() (*ScriptArtifacts, error) {
+	var a ScriptArtifacts
+	if !m.ScriptArtifacts.Valid {
+		return &a, nil
+	}
+
+	if err := json.Unmarshal([]byte(m.ScriptArtifacts.String), &a); err != nil {
+		return &a, errors.Wrap(err, "failed to unmarshal script artifacts")
+	}
+
+	return &a, nil
+}
+
+// SetScriptArtifacts stores the artifacts of the staged script pipeline.
+func (m *Movie) SetScriptArtifacts(a *ScriptArtifacts) error {
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal script artifacts")
+	}
+
+	m.ScriptArtifacts = sql.NullString{String: string(raw), Valid: true}
+	return bumpVersion(db, &m.Version, "UPDATE movies SET script_artifacts = ?, version = version + 1 WHERE id = ? RETURNING version",
+		m.ScriptArtifacts, m.Id)
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"encoding/json"
+	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
@@ -24,38 +25,123 @@ CREATE UNIQUE INDEX IF NOT EXISTS idx_templates_name ON templates(name);
 `
 
 var TemplateInitializationStat = `
-INSERT INTO templates (name, created_at)VALUES('sign', current_timestamp);
+INSERT OR IGNORE INTO templates (name, created_at)VALUES('sign', current_timestamp);
 `
 
 type Template struct {
 	Id        int64     `json:"id" db:"id"`                 // 模板ID
 	Name      string    `json:"name" db:"name"`             // 模板名称
 	CreatedAt time.Time `json:"created_at" db:"created_at"` // 创建时间
+
+	SystemPrompt string  `db:"system_prompt"` // 文案系统提示词，text/template，为空时使用默认提示词
+	ImageStyle   string  `db:"image_style"`   // 画风，追加在每条文生图提示词之后
+	Voice        string  `db:"voice"`         // 默认声音，为空时使用 provider 配置的声音
+	Preset       string  `db:"preset"`        // 默认发布平台 preset，为空时使用默认
+	Layout       string  `db:"layout"`        // 合成布局，RenderLayout json，为空时使用 preset 的布局
+	Bgm          string  `db:"bgm"`           // 背景音乐文件，相对 workdir，为空时没有背景音乐
+	BgmVolume    float64 `db:"bgm_volume"`    // 背景音乐音量
 }
 
+// DefaultBgmVolume keeps the background music under the voices.
+const DefaultBgmVolume = 0.2
+
+// DefaultTemplateName is the template seeded with the database.
+const DefaultTemplateName = string(Sign)
+
+// ErrTemplateInUse is returned when deleting a template movies are made
+// with.
+var ErrTemplateInUse = errors.New("template is used by movies")
+
 func NewTemplate(name string) *Template {
 	return &Template{
-		Name: name,
+		Name:      name,
+		BgmVolume: DefaultBgmVolume,
+	}
+}
+
+// Validate checks the preset and layout of the template, the system prompt
+// is checked by the ai package which runs it.
+func (t *Template) Validate() error {
+	if t.Name == "" {
+		return errors.New("template name is required")
+	}
+
+	if _, ok := GetPreset(t.Preset); !ok {
+		return errors.Errorf("unknown preset %q", t.Preset)
+	}
+
+	if t.Bgm != "" && !filepath.IsLocal(t.Bgm) {
+		return errors.Errorf("bgm %q is not a path inside the workdir", t.Bgm)
 	}
+
+	if t.BgmVolume < 0 || t.BgmVolume > 2 {
+		return errors.Errorf("bgm volume %g is not between 0 and 2", t.BgmVolume)
+	}
+
+	if t.Layout == "" {
+		return nil
+	}
+
+	schema, err := RenderSpecSchema()
+	if err != nil {
+		return err
+	}
+
+	if err := schema.Properties["layout"].Validate([]byte(t.Layout)); err != nil {
+		return errors.Wrap(err, "invalid layout")
+	}
+
+	return nil
+}
+
+// GetLayout returns the layout of the template, nil when it uses the one of
+// the preset.
+func (t *Template) GetLayout() (*RenderLayout, error) {
+	if t.Layout == "" {
+		return nil, nil
+	}
+
+	var layout RenderLayout
+	if err := json.Unmarshal([]byte(t.Layout), &layout); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal template layout")
+	}
+
+	return &layout, nil
 }
 
 func (t *Template) Create() error {
-	if _, err := db.NamedExec("INSERT INTO templates (name, createdAt) VALUES (:name, current_timestamp())", t); err != nil {
+	result, err := db.NamedExec("INSERT INTO templates (name, system_prompt, image_style, voice, preset, layout, bgm, bgm_volume, created_at) "+
+		"VALUES (:name, :system_prompt, :image_style, :voice, :preset, :layout, :bgm, :bgm_volume, current_timestamp)", t)
+	if err != nil {
 		return errors.Wrap(err, "failed to create template")
 	}
 
+	t.Id, _ = result.LastInsertId()
 	return nil
 }
 
 func (t *Template) Update() error {
-	err := db.Get(t, "SELECT * FROM templates WHERE name = ?", t.Name)
+	if _, err := db.NamedExec("UPDATE templates SET name = :name, system_prompt = :system_prompt, image_style = :image_style, "+
+		"voice = :voice, preset = :preset, layout = :layout, bgm = :bgm, bgm_volume = :bgm_volume WHERE id = :id", t); err != nil {
+		return errors.Wrap(err, "failed to update template")
+	}
 
-	if err != nil {
-		return errors.Wrap(err, "failed to get template")
+	return nil
+}
+
+// Delete removes the template, templates of existing movies are kept.
+func (t *Template) Delete() error {
+	var count int64
+	if err := db.Get(&count, "SELECT COUNT(*) FROM movies WHERE tpl_name = ?", t.Name); err != nil {
+		return errors.Wrap(err, "failed to count movies of template")
 	}
 
-	if _, err := db.NamedExec("UPDATE templates SET createdAt = current_timestamp() WHERE name = :name", t); err != nil {
-		return errors.Wrap(err, "failed to update template")
+	if count > 0 {
+		return ErrTemplateInUse
+	}
+
+	if _, err := db.Exec("DELETE FROM templates WHERE id = ?", t.Id); err != nil {
+		return errors.Wrap(err, "failed to delete template")
 	}
 
 	return nil
@@ -92,23 +178,36 @@ func GetTemplateByName(name string) (*Template, error) {
 }
 
 func DefaultTemplates() (*Template, error) {
-	d := &Template{}
-
-	if err := db.Get(d, "SELECT * FROM templates where name = 'sign'"); err != nil {
-		return nil, err
-	}
-
-	return d, nil
+	return GetTemplateByName(DefaultTemplateName)
 }
 
 func (t Template) MarshalJSON() ([]byte, error) {
+	var layout json.RawMessage
+	if t.Layout != "" {
+		layout = json.RawMessage(t.Layout)
+	}
+
 	return json.Marshal(struct {
-		Id        int64     `json:"id"`
-		Name      string    `json:"name"`
-		CreatedAt time.Time `json:"created_at"`
+		Id           int64           `json:"id"`
+		Name         string          `json:"name"`
+		SystemPrompt string          `json:"system_prompt"`
+		ImageStyle   string          `json:"image_style"`
+		Voice        string          `json:"voice"`
+		Preset       string          `json:"preset"`
+		Layout       json.RawMessage `json:"layout"`
+		Bgm          string          `json:"bgm"`
+		BgmVolume    float64         `json:"bgm_volume"`
+		CreatedAt    time.Time       `json:"created_at"`
 	}{
-		Id:        t.Id,
-		Name:      t.Name,
-		CreatedAt: t.CreatedAt,
+		Id:           t.Id,
+		Name:         t.Name,
+		SystemPrompt: t.SystemPrompt,
+		ImageStyle:   t.ImageStyle,
+		Voice:        t.Voice,
+		Preset:       t.Preset,
+		Layout:       layout,
+		Bgm:          t.Bgm,
+		BgmVolume:    t.BgmVolume,
+		CreatedAt:    t.CreatedAt,
 	})
 }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetMimes are the types of the files the server writes itself, others
+// are looked up by extension.
+var assetMimes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".mp4":  "video/mp4",
+}
+
+// imageExt is the extension of the image format of content, providers may
+// answer png, jpeg, gif or webp. It is empty for other content, whose
+// detected type is returned for the error.
+func imageExt(content []byte) (ext, detected string) {
+	detected = http.DetectContentType(content)
+	for e, typ := range assetMimes {
+		if typ == detected && strings.HasPrefix(typ, "image/") {
+			return e, detected
+		}
+	}
+
+	return "", detected
+}
+
+// registerAsset fills in the metadata of a, whose path is relative to the
+// workdir, from its file and records it in the assets table.
+func (s *Server) registerAsset(a *model.Asset) error {
+	content, err := os.ReadFile(filepath.Join(s.workdir, a.Path))
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+	a.Path = filepath.ToSlash(strings.TrimPrefix(a.Path, "/"))
+	a.Size, a.Sha256 = int64(len(content)), hex.EncodeToString(sum[:])
+
+	ext := strings.ToLower(filepath.Ext(a.Path))
+	if a.Mime = assetMimes[ext]; a.Mime == "" {
+		if a.Mime = mime.TypeByExtension(ext); a.Mime == "" {
+			a.Mime = http.DetectContentType(content)
+		}
+	}
+
+	if strings.HasPrefix(a.Mime, "image/") && a.Width == 0 {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(content)); err == nil {
+			a.Width, a.Height = cfg.Width, cfg.Height
+		}
+	}
+
+	return a.Register()
+}
+
+func (s *Server) assetRoutes(api *gin.RouterGroup) {
+	api.GET("/movies/:movie_id/assets", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
+		}
+
+		kind := c.Query("kind")
+		if kind != "" && !validAssetKind(kind) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset kind " + strconv.Quote(kind) +
+				", expected one of " + strings.Join(model.AssetKinds, ", ")})
+			return
+		}
+
+		if assets, err := model.ListAssets(movie.Id, kind); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"data": assets})
+		}
+	})
+
+	api.GET("/assets/:asset_id", func(c *gin.Context) {
+		if asset, ok := assetParam(c); ok {
+			c.JSON(200, gin.H{"data": asset})
+		}
+	})
+
+	api.GET("/assets/:asset_id/file", func(c *gin.Context) {
+		if asset, ok := assetParam(c); ok {
+			s.serveMovieFile(c, asset.Path, asset.Mime)
+		}
+	})
+}
+
+func validAssetKind(kind string) bool {
+	for _, k := range model.AssetKinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// assetParam loads the asset named by the asset_id route parameter, it
+// writes the error response itself and reports whether to go on.
+func assetParam(c *gin.Context) (*model.Asset, bool) {
+	id, err := strconv.Atoi(c.Param("asset_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset ID"})
+		return nil, false
+	}
+
+	asset, err := model.GetAsset(int64(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return asset, true
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// casDir is where generated assets are stored under the workdir, every
+// file is named after the sha256 of its content so equal results are kept
+// once.
+const casDir = "cas"
+
+// cacheKey identifies a generated asset by everything its content depends
+// on: kind, provider, model, voice or style settings and the input.
+func cacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedAsset returns the file cached for key, keys whose file is gone are
+// forgotten.
+func (s *Server) cachedAsset(key string) (string, bool) {
+	fp, err := model.CachedAsset(key)
+	if err != nil {
+		log.Warn().Err(err).Msg("asset cache unavailable")
+		return "", false
+	}
+
+	if fp == "" {
+		return "", false
+	}
+
+	if _, err := os.Stat(filepath.Join(s.workdir, fp)); err != nil {
+		log.Warn().Msgf("cached asset %s is gone", fp)
+		if err := model.UncacheAsset(key); err != nil {
+			log.Warn().Err(err).Msg("failed to forget missing asset")
+		}
+		return "", false
+	}
+
+	return fp, true
+}
+
+// storeAsset stores content in the cas unless it is there already and
+// caches it under key. It returns the path relative to the workdir.
+func (s *Server) storeAsset(key string, content []byte, ext string) (string, error) {
+	sum := sha256.Sum256(content)
+	name := hex.EncodeToString(sum[:])
+	fp := filepath.ToSlash(filepath.Join(casDir, name[:2], name+ext))
+
+	abspath := filepath.Join(s.workdir, fp)
+	if _, err := os.Stat(abspath); os.IsNotExist(err) {
+		if err := writeFileAtomic(abspath, content); err != nil {
+			return "", err
+		}
+	}
+
+	if err := model.CacheAsset(key, fp); err != nil {
+		return "", err
+	}
+
+	return fp, nil
+}
+
+// writeFileAtomic writes content to a temp file next to path and renames
+// it, readers never see half a file.
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return errors.Wrap(err, "failed to create asset directory")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create asset file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write asset file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write asset file")
+	}
+
+	if err := os.Chmod(tmp.Name(), 0666); err != nil {
+		return errors.Wrap(err, "failed to write asset file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "failed to store asset file")
+}
+
+// forceParam reads ?force=true, which bypasses the asset cache.
+func forceParam(c *gin.Context) bool {
+	force, _ := strconv.ParseBool(c.Query("force"))
+	return force
+}
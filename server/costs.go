@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultCostDays is how many days the daily costs cover without from.
+	defaultCostDays = 30
+	// maxCallsListed caps the calls listed for a movie.
+	maxCallsListed = 500
+)
+
+// SetPrices changes the price table costs are reported with.
+func (s *Server) SetPrices(t *model.PriceTable) {
+	if t == nil {
+		t = &model.PriceTable{}
+	}
+	s.prices = t
+}
+
+// recordCall is the ledger of the provider calls.
+func recordCall(call *ai.Call) {
+	c := &model.AICall{
+		Kind:             call.Kind,
+		Provider:         call.Provider,
+		Model:            call.Model,
+		PromptHash:       call.PromptHash,
+		LatencyMs:        call.Latency.Milliseconds(),
+		Status:           model.CallStatusOK,
+		PromptTokens:     int64(call.PromptTokens),
+		CompletionTokens: int64(call.CompletionTokens),
+		Characters:       int64(call.Characters),
+		Images:           int64(call.Images),
+	}
+
+	if call.MovieId != 0 {
+		c.MovieId = &call.MovieId
+	}
+	if call.Item != ai.NoItem {
+		item := int64(call.Item)
+		c.ItemIndex = &item
+	}
+	if call.Err != nil {
+		c.Status, c.Error = model.CallStatusFailed, call.Err.Error()
+	}
+
+	if err := c.Create(); err != nil {
+		log.Error().Err(err).Msgf("failed to record %s call of %s", call.Kind, call.Provider)
+	}
+}
+
+func (s *Server) costRoutes(api *gin.RouterGroup) {
+	api.GET("/movies/:movie_id/ai_calls", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
+		}
+
+		if calls, err := model.ListAICalls(movie.Id, maxCallsListed); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"data": calls})
+		}
+	})
+
+	api.GET("/movies/:movie_id/costs", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
+		}
+
+		usage, err := model.MovieUsage(movie.Id)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		cost := s.prices.Apply(usage)
+		c.JSON(200, gin.H{"data": usage, "cost": cost, "currency": s.prices.Currency})
+	})
+
+	api.GET("/costs", s.dailyCosts)
+}
+
+// dayCost is the cost of one UTC day.
+type dayCost struct {
+	Day   string             `json:"day"`
+	Cost  float64            `json:"cost"`
+	Usage []*model.CallUsage `json:"usage"`
+}
+
+// dailyCosts reports the costs of the days from to to, YYYY-MM-DD, they
+// default to the last defaultCostDays days.
+func (s *Server) dailyCosts(c *gin.Context) {
+	today := time.Now().UTC()
+	from := c.DefaultQuery("from", today.AddDate(0, 0, 1-defaultCostDays).Format(time.DateOnly))
+	to := c.DefaultQuery("to", today.Format(time.DateOnly))
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid day " + strconv.Quote(day) + ", expected YYYY-MM-DD"})
+			return
+		}
+	}
+
+	usage, err := model.DailyUsage(from, to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	days := make([]*dayCost, 0)
+	var cost float64
+	for _, u := range usage {
+		if len(days) == 0 || days[len(days)-1].Day != u.Day {
+			days = append(days, &dayCost{Day: u.Day})
+		}
+
+		day := days[len(days)-1]
+		day.Usage = append(day.Usage, u)
+		day.Cost += s.prices.Apply([]*model.CallUsage{u})
+	}
+	for _, day := range days {
+		cost += day.Cost
+	}
+
+	c.JSON(200, gin.H{"data": days, "cost": cost, "currency": s.prices.Currency})
+}
@@ -0,0 +1,573 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/media"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// The states each kind of generation is allowed in, a movie needs a
+// script before voices and voices before images.
+var (
+	scriptStates = []model.State{model.StateInit, model.StateScripted, model.StateVoiced,
+		model.StateIllustrated, model.StateRendered, model.StateFailed}
+	voiceStates = []model.State{model.StateScripted, model.StateVoiced,
+		model.StateIllustrated, model.StateRendered, model.StateFailed}
+	imageStates = []model.State{model.StateVoiced, model.StateIllustrated,
+		model.StateRendered, model.StateFailed}
+)
+
+const (
+	opGenerateScript = "generate script"
+	opGenerateVoice  = "generate voice"
+	opGenerateImage  = "generate image"
+)
+
+// SetScriptAttempts changes how often a script is generated before its
+// rule violations fail the job.
+func (s *Server) SetScriptAttempts(n int) {
+	if n <= 0 {
+		n = ai.DefaultScriptAttempts
+	}
+	s.scriptAttempts = n
+}
+
+// DefaultItemWorkers is how many items of a script the bulk voice and image
+// jobs generate at once.
+const DefaultItemWorkers = 4
+
+// SetItemWorkers changes how many items of a script the bulk voice and
+// image jobs generate at once, providers may allow fewer calls.
+func (s *Server) SetItemWorkers(n int) {
+	if n <= 0 {
+		n = DefaultItemWorkers
+	}
+	s.itemWorkers = n
+}
+
+// assetPayload is the payload of the bulk voice and image jobs, Force
+// generates every asset again instead of reusing cached ones.
+type assetPayload struct {
+	Force bool `json:"force,omitempty"`
+}
+
+// itemPayload is the payload of the per script item jobs.
+type itemPayload struct {
+	Index int  `json:"index"`
+	Force bool `json:"force,omitempty"`
+}
+
+func (s *Server) generateScript(ctx context.Context, job *model.Job) error {
+	movie, err := model.GetMovie(job.MovieId)
+	if err != nil {
+		return err
+	}
+
+	if err := movie.Require(opGenerateScript, scriptStates...); err != nil {
+		return err
+	}
+
+	if err := job.SetProgress(0, 1); err != nil {
+		return err
+	}
+
+	chain, err := s.providers.ScriptChain(movie.ScriptProvider.String)
+	if err != nil {
+		return err
+	}
+
+	req, err := scriptRequest(movie)
+	if err != nil {
+		return err
+	}
+
+	// scripts of every provider are checked against the prompt rules and
+	// asked for again when they break them, before the chain moves on
+	ctx = ai.WithCallTags(ctx, movie.Id, ai.NoItem)
+	scripts, link, err := chain.GenerateScript(ctx, req, func(g ai.ScriptGenerator) ai.ScriptGenerator {
+		return ai.NewValidatingScriptGenerator(g, s.scriptAttempts)
+	})
+	if err != nil {
+		return err
+	}
+
+	script, err := ai.ParseScript(scripts)
+	if err != nil {
+		return err
+	}
+
+	system, err := ai.BuildSystemPrompt(req)
+	if err != nil {
+		return err
+	}
+
+	movie.ScriptModel = sql.NullString{String: link.String(), Valid: true}
+	rev := model.NewRevision(model.RevisionSourceLLM, link.String(), chatPrompt(system, req.Idea))
+	if err := replaceScript(movie, script, rev); err != nil {
+		return err
+	}
+
+	return job.SetProgress(1, 1)
+}
+
+// scriptRequest asks for a script of movie's idea sized by its preset, in
+// the system prompt of its template.
+func scriptRequest(movie *model.Movie) (ai.ScriptRequest, error) {
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return ai.ScriptRequest{}, err
+	}
+
+	preset := movie.GetPreset()
+	return ai.ScriptRequest{
+		Idea:             movie.Idea.String,
+		Duration:         movie.TargetDuration(),
+		WordsPerSecond:   preset.WordsPerSecond(),
+		MinSubtitleChars: preset.MinSubtitleChars,
+		MaxSubtitleChars: preset.MaxSubtitleChars,
+		MaxSubtitleWords: preset.MaxSubtitleWords,
+		SystemPrompt:     tpl.SystemPrompt,
+	}, nil
+}
+
+// replaceScript saves a freshly generated script as rev, voices and images
+// of the old one no longer apply.
+func replaceScript(movie *model.Movie, script *model.MovieScript, rev *model.ScriptRevision) error {
+	if err := movie.SetScript(script, rev, nil); err != nil {
+		return err
+	}
+
+	return movie.Transition(model.StateScripted, "script generated")
+}
+
+func (s *Server) generateVoiceItem(ctx context.Context, job *model.Job) error {
+	var payload itemPayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	movie, script, err := loadScript(job.MovieId, opGenerateVoice, voiceStates)
+	if err != nil {
+		return err
+	}
+
+	if payload.Index < 0 || payload.Index >= len(script.ScriptItems) {
+		return errors.Errorf("script index %d out of range", payload.Index)
+	}
+
+	if err := job.SetProgress(0, 1); err != nil {
+		return err
+	}
+
+	if err := s.voiceItem(ctx, movie, script.ScriptItems[payload.Index], payload.Force); err != nil {
+		return err
+	}
+
+	if err := voicesDone(movie); err != nil {
+		return err
+	}
+
+	return job.SetProgress(1, 1)
+}
+
+func (s *Server) generateVoice(ctx context.Context, job *model.Job) error {
+	var payload assetPayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	movie, script, err := loadScript(job.MovieId, opGenerateVoice, voiceStates)
+	if err != nil {
+		return err
+	}
+
+	err = s.eachItem(ctx, job, script, func(i int, item *model.ScriptItem) error {
+		log.Info().Msgf("Generating voice for item %d: %s", i, item.ZhSubtitle)
+		return s.voiceItem(ctx, movie, item, payload.Force)
+	})
+	if ctx.Err() != nil {
+		return err
+	}
+
+	// the voices which made it are saved, the movie still moves on when
+	// they complete the script
+	if derr := voicesDone(movie); derr != nil {
+		return derr
+	}
+
+	return err
+}
+
+// eachItem runs gen on every item of script, up to s.itemWorkers at once.
+// Each item saves its asset as soon as it has it, so a failed item does not
+// stop the others. The failures are returned together once all items ran.
+func (s *Server) eachItem(ctx context.Context, job *model.Job, script *model.MovieScript,
+	gen func(i int, item *model.ScriptItem) error) error {
+	total := len(script.ScriptItems)
+	if err := job.SetProgress(0, total); err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     int
+		failures []string
+		indexes  = make(chan int)
+	)
+
+	for w := 0; w < s.itemWorkers && w < total; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				err := gen(i, script.ScriptItems[i])
+
+				mu.Lock()
+				done++
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("item %d: %s", i, err))
+				}
+				if perr := job.SetProgress(done, total); perr != nil {
+					log.Warn().Err(perr).Msgf("failed to update progress of job %d", job.Id)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range script.ScriptItems {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	sort.Strings(failures)
+	return errors.Errorf("%d of %d items failed: %s", len(failures), total, strings.Join(failures, "; "))
+}
+
+// voiceKey is the cache key of the voice of text as synthesizer speaks it
+// for movie.
+func (s *Server) voiceKey(movie *model.Movie, tpl *model.Template, synthesizer ai.SpeechSynthesizer, text string) string {
+	return cacheKey(ai.KindSpeech, s.providers.Resolve(ai.KindSpeech, movie.SpeechProvider.String),
+		ai.ModelOf(synthesizer), tpl.Voice, fmt.Sprint(movie.GetPreset().SpeechSpeed), text)
+}
+
+// voiceItem generates and saves the voice of item, a voice whose item was
+// edited in the meantime is dropped. Voices generated before for the same
+// text and settings are reused unless force is set.
+func (s *Server) voiceItem(ctx context.Context, movie *model.Movie, item *model.ScriptItem, force bool) error {
+	synthesizer, err := s.providers.SpeechSynthesizer(movie.SpeechProvider.String)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return err
+	}
+
+	key := s.voiceKey(movie, tpl, synthesizer, item.ZhSubtitle)
+	fp, cached := "", false
+	if !force {
+		fp, cached = s.cachedAsset(key)
+	}
+
+	if !cached {
+		release, err := s.providers.Acquire(ctx, ai.KindSpeech, movie.SpeechProvider.String)
+		if err != nil {
+			return err
+		}
+		ctx = ai.WithCallTags(ctx, movie.Id, item.Position)
+
+		rawMp3, err := synthesizer.GenerateAudio(ctx, item.ZhSubtitle, ai.SpeechOptions{
+			Speed: movie.GetPreset().SpeechSpeed,
+			Voice: tpl.Voice,
+		})
+		release()
+		if err != nil {
+			return failItem(item.FailVoice, err)
+		}
+
+		if _, err := media.ParseMp3(rawMp3); err != nil {
+			return failItem(item.FailVoice, errors.Wrap(err, "speech provider returned no usable mp3"))
+		}
+
+		if fp, err = s.storeAsset(key, rawMp3, ".mp3"); err != nil {
+			return err
+		}
+	}
+
+	d, err := media.Mp3Duration(filepath.Join(s.workdir, fp))
+	if err != nil {
+		return failItem(item.FailVoice, err)
+	}
+
+	asset := &model.Asset{
+		MovieId:    &movie.Id,
+		Kind:       model.AssetVoice,
+		Path:       fp,
+		DurationMs: d.Milliseconds(),
+		Provider:   s.providers.Resolve(ai.KindSpeech, movie.SpeechProvider.String),
+		Model:      ai.ModelOf(synthesizer),
+	}
+	if err := s.registerAsset(asset); err != nil {
+		return err
+	}
+
+	item.VoicePath, item.VoiceAsset = fp, asset.Id
+	item.DurationMs = d.Milliseconds()
+	return dropChanged(movie, item.SaveVoice())
+}
+
+// voicesDone moves the movie to voiced once every item of its current
+// script has a voice.
+func voicesDone(movie *model.Movie) error {
+	script, err := movie.GetScript()
+	if err != nil {
+		return err
+	}
+
+	if !script.AllVoiced() {
+		return nil
+	}
+
+	warnDuration(movie)
+	return movie.Advance(model.StateVoiced, "all voices generated")
+}
+
+// failItem records why an asset of an item failed and returns the cause.
+func failItem(record func(cause error) error, cause error) error {
+	if err := record(cause); err != nil && !errors.Is(err, model.ErrItemChanged) {
+		log.Error().Err(err).Msg("failed to record script item failure")
+	}
+
+	return cause
+}
+
+// dropChanged turns saving an asset for an item edited in the meantime into
+// a no-op, the edited item waits for an asset of its own.
+func dropChanged(movie *model.Movie, err error) error {
+	if errors.Is(err, model.ErrItemChanged) {
+		log.Warn().Msgf("movie %d: script item changed during generation, asset dropped", movie.Id)
+		return nil
+	}
+
+	return err
+}
+
+// timeScript measures voices saved before durations were recorded.
+func (s *Server) timeScript(script *model.MovieScript) error {
+	for i, item := range script.ScriptItems {
+		if item.VoicePath == "" || item.DurationMs > 0 {
+			continue
+		}
+
+		d, err := media.Mp3Duration(filepath.Join(s.workdir, item.VoicePath))
+		if err != nil {
+			return errors.Wrapf(err, "script item %d", i)
+		}
+
+		item.DurationMs = d.Milliseconds()
+		if err := item.SaveVoice(); err != nil {
+			return err
+		}
+	}
+
+	script.Retime(model.DefaultItemPauseMs)
+	return nil
+}
+
+func warnDuration(movie *model.Movie) {
+	if warning := movie.DurationWarning(); warning != "" {
+		log.Warn().Msgf("movie %d: %s", movie.Id, warning)
+	}
+}
+
+func (s *Server) generateImageItem(ctx context.Context, job *model.Job) error {
+	var payload itemPayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	movie, script, err := loadScript(job.MovieId, opGenerateImage, imageStates)
+	if err != nil {
+		return err
+	}
+
+	if payload.Index < 0 || payload.Index >= len(script.ScriptItems) {
+		return errors.Errorf("script index %d out of range", payload.Index)
+	}
+
+	if err := job.SetProgress(0, 1); err != nil {
+		return err
+	}
+
+	if err := s.imageItem(ctx, movie, script.ScriptItems[payload.Index], payload.Force); err != nil {
+		return err
+	}
+
+	if err := imagesDone(movie); err != nil {
+		return err
+	}
+
+	return job.SetProgress(1, 1)
+}
+
+func (s *Server) generateImage(ctx context.Context, job *model.Job) error {
+	var payload assetPayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	movie, script, err := loadScript(job.MovieId, opGenerateImage, imageStates)
+	if err != nil {
+		return err
+	}
+
+	err = s.eachItem(ctx, job, script, func(i int, item *model.ScriptItem) error {
+		log.Info().Msgf("Generating image for item %d: %s", i, item.ImagePrompt)
+		return s.imageItem(ctx, movie, item, payload.Force)
+	})
+	if ctx.Err() != nil {
+		return err
+	}
+
+	if derr := imagesDone(movie); derr != nil {
+		return derr
+	}
+
+	return err
+}
+
+// imagesDone moves the movie to illustrated once every item of its current
+// script has an image.
+func imagesDone(movie *model.Movie) error {
+	script, err := movie.GetScript()
+	if err != nil {
+		return err
+	}
+
+	if !script.AllIllustrated() {
+		return nil
+	}
+
+	return movie.Advance(model.StateIllustrated, "all images generated")
+}
+
+// styledPrompt appends the image style of the template to prompt.
+func styledPrompt(prompt, style string) string {
+	if style == "" {
+		return prompt
+	}
+
+	return prompt + "，" + style
+}
+
+// imageKey is the cache key of the image generator draws for prompt. The
+// size of the movie is part of it, an image drawn for another aspect ratio
+// is not reused. Providers draw with a fixed seed, it is covered by the
+// provider and model.
+func (s *Server) imageKey(movie *model.Movie, generator ai.ImageGenerator, prompt string) string {
+	preset := movie.GetPreset()
+	return cacheKey(ai.KindImage, s.providers.Resolve(ai.KindImage, movie.ImageProvider.String),
+		ai.ModelOf(generator), ai.SizeOf(generator), fmt.Sprintf("%dx%d", preset.Width, preset.Height), prompt)
+}
+
+// imageItem generates and saves the image of item, an image whose item was
+// edited in the meantime is dropped. Images generated before for the same
+// styled prompt are reused unless force is set.
+func (s *Server) imageItem(ctx context.Context, movie *model.Movie, item *model.ScriptItem, force bool) error {
+	generator, err := s.providers.ImageGenerator(movie.ImageProvider.String)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return err
+	}
+
+	prompt := styledPrompt(item.ImagePrompt, tpl.ImageStyle)
+	key := s.imageKey(movie, generator, prompt)
+	fp, cached := "", false
+	if !force {
+		fp, cached = s.cachedAsset(key)
+	}
+
+	if !cached {
+		release, err := s.providers.Acquire(ctx, ai.KindImage, movie.ImageProvider.String)
+		if err != nil {
+			return err
+		}
+		ctx = ai.WithCallTags(ctx, movie.Id, item.Position)
+
+		content, err := generator.GenerateImage(ctx, prompt)
+		release()
+		if err != nil {
+			return failItem(item.FailImage, err)
+		}
+
+		ext, detected := imageExt(content)
+		if ext == "" {
+			return failItem(item.FailImage, errors.Errorf("image provider returned %s instead of an image", detected))
+		}
+
+		if fp, err = s.storeAsset(key, content, ext); err != nil {
+			return err
+		}
+	}
+
+	asset := &model.Asset{
+		MovieId:  &movie.Id,
+		Kind:     model.AssetImage,
+		Path:     fp,
+		Provider: s.providers.Resolve(ai.KindImage, movie.ImageProvider.String),
+		Model:    ai.ModelOf(generator),
+	}
+	if err := s.registerAsset(asset); err != nil {
+		return err
+	}
+
+	item.ImagePath, item.ImageAsset = fp, asset.Id
+	return dropChanged(movie, item.SaveImage())
+}
+
+// loadScript loads the movie and its script for operation op, which is only
+// allowed while the movie is in one of states.
+func loadScript(movieId int64, op string, states []model.State) (*model.Movie, *model.MovieScript, error) {
+	movie, err := model.GetMovie(movieId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := movie.Require(op, states...); err != nil {
+		return nil, nil, err
+	}
+
+	return movie, movie.Script, nil
+}
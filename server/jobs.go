@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	JobGenerateScript    = "generate_script"
+	JobGenerateVoice     = "generate_voice"
+	JobGenerateVoiceItem = "generate_voice_item"
+	JobGenerateImage     = "generate_image"
+	JobGenerateImageItem = "generate_image_item"
+)
+
+// jobPollInterval is how often idle workers look for jobs enqueued by
+// somebody else, jobs enqueued through this server wake a worker at once.
+const jobPollInterval = 2 * time.Second
+
+// JobFunc does the actual work of a job, it is called by a worker with the
+// server lifetime context, never with the context of the http request.
+type JobFunc func(ctx context.Context, job *model.Job) error
+
+func (s *Server) registerJobs() {
+	s.jobFuncs = map[string]JobFunc{
+		JobGenerateScript:    s.generateScript,
+		JobGenerateVoice:     s.generateVoice,
+		JobGenerateVoiceItem: s.generateVoiceItem,
+		JobGenerateImage:     s.generateImage,
+		JobGenerateImageItem: s.generateImageItem,
+		JobRender:            s.render,
+		JobScriptStages:      s.scriptStages,
+	}
+}
+
+// enqueue persists a new job and wakes an idle worker.
+func (s *Server) enqueue(movieId int64, kind string, payload interface{}) (*model.Job, error) {
+	if _, ok := s.jobFuncs[kind]; !ok {
+		return nil, errors.Errorf("unknown job kind %s", kind)
+	}
+
+	job, err := model.NewJob(movieId, kind, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := job.Create(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// startWorkers requeues jobs interrupted by a previous crash and starts the
+// worker pool, workers stop when ctx is done.
+func (s *Server) startWorkers(ctx context.Context) error {
+	requeued, failed, err := model.RequeueRunningJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range failed {
+		log.Error().Msgf("job %d %s given up after %d attempts", job.Id, job.Kind, job.Attempts)
+		s.jobFailed(job, model.ErrJobInterrupted)
+	}
+
+	if requeued > 0 {
+		log.Warn().Msgf("Requeued %d interrupted jobs", requeued)
+	}
+
+	log.Info().Msgf("Starting %d job workers", s.workers)
+	for i := 0; i < s.workers; i++ {
+		s.workerWg.Add(1)
+		go s.runWorker(ctx, i)
+	}
+
+	return nil
+}
+
+func (s *Server) runWorker(ctx context.Context, id int) {
+	defer s.workerWg.Done()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := model.ClaimNextJob()
+		if err != nil {
+			log.Error().Err(err).Msgf("worker %d failed to claim job", id)
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		s.runJob(ctx, id, job)
+	}
+}
+
+func (s *Server) runJob(ctx context.Context, workerId int, job *model.Job) {
+	log.Info().Msgf("worker %d running job %d %s for movie %d (attempt %d)",
+		workerId, job.Id, job.Kind, job.MovieId, job.Attempts)
+
+	fn, ok := s.jobFuncs[job.Kind]
+	if !ok {
+		s.finishJob(job, errors.Errorf("unknown job kind %s", job.Kind))
+		return
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+
+		return fn(ctx, job)
+	}()
+
+	// the server is shutting down, the job is put back into the queue and
+	// picked up again on next start
+	if ctx.Err() != nil {
+		log.Warn().Msgf("job %d interrupted by shutdown, requeued", job.Id)
+		if err := job.Requeue(); err != nil {
+			log.Error().Err(err).Msgf("failed to requeue job %d", job.Id)
+		}
+		return
+	}
+
+	s.finishJob(job, err)
+}
+
+func (s *Server) finishJob(job *model.Job, cause error) {
+	if cause != nil {
+		log.Error().Err(cause).Msgf("job %d %s failed", job.Id, job.Kind)
+	} else {
+		log.Info().Msgf("job %d %s succeeded", job.Id, job.Kind)
+	}
+
+	// the movie is cleaned up first, whoever sees the job finished sees
+	// the movie as it is left
+	if cause != nil {
+		s.jobFailed(job, cause)
+	}
+
+	if err := job.Finish(cause); err != nil {
+		log.Error().Err(err).Msgf("failed to record result of job %d", job.Id)
+	}
+}
+
+// jobFailed cleans up after a job which ended as failed, a failed render
+// leaves its movie failed instead of rendering for good.
+func (s *Server) jobFailed(job *model.Job, cause error) {
+	if job.Kind == JobRender {
+		failRender(job.MovieId, cause)
+	}
+}
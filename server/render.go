@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/cmingxu/mpu/media"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	JobRender = "render"
+
+	opRender = "render"
+
+	renderSpecFile = "spec.json"
+	renderLogFile  = "render.log"
+)
+
+// renderStates are the states a render may be started from.
+var renderStates = []model.State{model.StateIllustrated, model.StateRendered, model.StateFailed}
+
+// Composer is how the python composer is started, Script is composer/main.py.
+type Composer struct {
+	Python string // python 解释器
+	Script string // composer/main.py 路径
+}
+
+var DefaultComposer = Composer{
+	Python: "python3",
+	Script: "composer/main.py",
+}
+
+// SetComposer changes how the python composer is started.
+func (s *Server) SetComposer(c Composer) {
+	s.composer = c
+}
+
+var (
+	// tqdm progress bar moviepy prints while writing frames, e.g.
+	// "frame_index:  45%|████▌     | 540/1200 [00:10<00:12, 52.34it/s]"
+	frameProgressRe = regexp.MustCompile(`frame_index:\s*\d+%\|.*?\|\s*(\d+)/(\d+)`)
+	// printed by composer/main.py once all clips are laid out
+	totalDurationRe = regexp.MustCompile(`^Total duration: ([0-9.]+) seconds`)
+)
+
+func movieDir(movieId int64) string {
+	return fmt.Sprintf("movie/%d", movieId)
+}
+
+// movieRenderSpec is the render spec of the preset of movie in the layout
+// of its template.
+func movieRenderSpec(movie *model.Movie) (*model.RenderSpec, error) {
+	spec := movie.GetPreset().RenderSpec()
+
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := tpl.GetLayout()
+	if err != nil {
+		return nil, err
+	}
+	if layout != nil {
+		spec.Layout = *layout
+	}
+
+	return spec, nil
+}
+
+// buildRenderSpec checks every item has its texts and asset files and
+// lays them out on the spec of the movie preset, with the background music
+// of its template. Asset paths become relative to the movie directory.
+func (s *Server) buildRenderSpec(movie *model.Movie, script *model.MovieScript) (*model.RenderSpec, error) {
+	if len(script.ScriptItems) == 0 {
+		return nil, errors.New("script has no items")
+	}
+
+	dir := filepath.Join(s.workdir, movieDir(movie.Id))
+	spec, err := movieRenderSpec(movie)
+	if err != nil {
+		return nil, err
+	}
+	spec.Title = script.Title
+
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	if tpl.Bgm != "" {
+		abspath := filepath.Join(s.workdir, tpl.Bgm)
+		if _, err := os.Stat(abspath); err != nil {
+			return nil, errors.Wrapf(err, "bgm of template %s missing", tpl.Name)
+		}
+
+		rel, err := filepath.Rel(dir, abspath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bgm of template %s outside of workdir", tpl.Name)
+		}
+		spec.Bgm = &model.RenderBgm{Path: filepath.ToSlash(rel), Volume: tpl.BgmVolume}
+	}
+
+	for i, item := range script.ScriptItems {
+		if item.ZhSubtitle == "" || item.EnSubtitle == "" {
+			return nil, errors.Errorf("script item %d has no subtitle", i)
+		}
+
+		paths := make([]string, 2)
+		for j, fp := range []string{item.VoicePath, item.ImagePath} {
+			if fp == "" {
+				return nil, errors.Errorf("script item %d has no voice or image", i)
+			}
+
+			abspath := filepath.Join(s.workdir, fp)
+			if _, err := os.Stat(abspath); err != nil {
+				return nil, errors.Wrapf(err, "script item %d asset missing", i)
+			}
+
+			rel, err := filepath.Rel(dir, abspath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "script item %d asset outside of movie directory", i)
+			}
+			paths[j] = filepath.ToSlash(rel)
+		}
+
+		pause := model.DefaultItemPauseMs
+		if i == len(script.ScriptItems)-1 {
+			pause = 0
+		}
+
+		spec.Items = append(spec.Items, model.RenderItem{
+			ZhSubtitle: item.ZhSubtitle,
+			EnSubtitle: item.EnSubtitle,
+			VoicePath:  paths[0],
+			ImagePath:  paths[1],
+			PauseMs:    pause,
+			StartMs:    item.StartMs,
+			DurationMs: item.DurationMs,
+		})
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+func (s *Server) render(ctx context.Context, job *model.Job) error {
+	movie, script, err := loadScript(job.MovieId, opRender, []model.State{model.StateRendering})
+	if err != nil {
+		return err
+	}
+
+	err = s.runComposer(ctx, job, movie, script)
+	if ctx.Err() != nil {
+		// shutting down, the job is picked up again with the movie still
+		// rendering
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// errors returned from here on fail the movie along with the job
+	if err := movie.SaveOutput(); err != nil {
+		return errors.Wrap(err, "failed to save render output")
+	}
+
+	return movie.Transition(model.StateRendered, "render finished")
+}
+
+// failRender moves the movie of a failed render job from rendering to
+// failed, from where it can be rendered again.
+func failRender(movieId int64, cause error) {
+	movie, err := model.GetMovie(movieId)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to load movie %d of failed render", movieId)
+		return
+	}
+
+	if movie.State != model.StateRendering.String() {
+		return
+	}
+
+	if err := movie.Transition(model.StateFailed, cause.Error()); err != nil {
+		log.Error().Err(err).Msgf("failed to mark movie %d as failed", movieId)
+	}
+}
+
+func (s *Server) runComposer(ctx context.Context, job *model.Job, movie *model.Movie, script *model.MovieScript) error {
+	if err := s.timeScript(script); err != nil {
+		return err
+	}
+
+	spec, err := s.buildRenderSpec(movie, script)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.workdir, movieDir(movie.Id))
+	raw, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal render spec")
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "failed to create movie directory")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, renderSpecFile), raw, 0666); err != nil {
+		return errors.Wrap(err, "failed to write render spec")
+	}
+
+	output := filepath.Join(dir, spec.Output.File)
+	if err := os.RemoveAll(output); err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, renderLogFile))
+	if err != nil {
+		return errors.Wrap(err, "failed to create render log")
+	}
+	defer logFile.Close()
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	entry, err := filepath.Abs(s.composer.Script)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, s.composer.Python, entry)
+	cmd.Dir = filepath.Dir(entry)
+	cmd.Env = append(os.Environ(),
+		"WORKDIR="+absDir,
+		"METAFILE="+renderSpecFile,
+		"ENV=prod",
+		"PYTHONUNBUFFERED=1",
+	)
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	if err := job.SetProgress(0, 100); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Rendering movie %d: %s %s in %s", movie.Id, s.composer.Python, entry, absDir)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start composer")
+	}
+
+	var (
+		wg       sync.WaitGroup
+		duration float64
+		tail     = newTailBuffer(20)
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		duration = s.scanComposerOutput(pr, logFile, job, tail)
+	}()
+
+	waitErr := cmd.Wait()
+	pw.Close()
+	wg.Wait()
+
+	if waitErr != nil {
+		return errors.Wrapf(waitErr, "composer failed: %s", tail.String())
+	}
+
+	if _, err := os.Stat(output); err != nil {
+		return errors.Wrap(err, "composer finished without output")
+	}
+
+	movie.OutputPath.String, movie.OutputPath.Valid = filepath.ToSlash(filepath.Join(movieDir(movie.Id), spec.Output.File)), true
+	movie.OutputDurationMs.Int64, movie.OutputDurationMs.Valid = int64(duration*1000), duration > 0
+
+	if err := s.registerAsset(&model.Asset{
+		MovieId:    &movie.Id,
+		Kind:       model.AssetRender,
+		Path:       movie.OutputPath.String,
+		DurationMs: movie.OutputDurationMs.Int64,
+		Width:      spec.Width,
+		Height:     spec.Height,
+	}); err != nil {
+		return err
+	}
+
+	if spec.Bgm != nil {
+		bgm := &model.Asset{MovieId: &movie.Id, Kind: model.AssetBgm,
+			Path: filepath.ToSlash(filepath.Join(movieDir(movie.Id), spec.Bgm.Path))}
+		if d, err := media.Mp3Duration(filepath.Join(dir, spec.Bgm.Path)); err == nil {
+			bgm.DurationMs = d.Milliseconds()
+		}
+		if err := s.registerAsset(bgm); err != nil {
+			return err
+		}
+	}
+
+	return job.SetProgress(100, 100)
+}
+
+// scanComposerOutput copies the composer output into the render log, keeps
+// the job progress up to date and returns the duration the composer
+// reported. tqdm redraws its bar with \r so both \r and \n end a line.
+func (s *Server) scanComposerOutput(r io.Reader, w io.Writer, job *model.Job, tail *tailBuffer) float64 {
+	var duration float64
+	lastPercent := -1
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanLinesOrCR)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(w, line)
+		tail.Add(line)
+
+		if m := totalDurationRe.FindStringSubmatch(line); m != nil {
+			duration, _ = strconv.ParseFloat(m[1], 64)
+		}
+
+		if m := frameProgressRe.FindStringSubmatch(line); m != nil {
+			done, _ := strconv.Atoi(m[1])
+			total, _ := strconv.Atoi(m[2])
+			if total == 0 {
+				continue
+			}
+
+			// keep 100 for after the output is verified
+			percent := done * 99 / total
+			if percent != lastPercent {
+				lastPercent = percent
+				if err := job.SetProgress(percent, 100); err != nil {
+					log.Warn().Err(err).Msgf("failed to update render progress of job %d", job.Id)
+				}
+			}
+		}
+	}
+
+	// drain whatever is left so the composer never blocks on a full pipe
+	io.Copy(io.Discard, r)
+
+	return duration
+}
+
+func scanLinesOrCR(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// tailBuffer keeps the last lines of the composer output for the error.
+type tailBuffer struct {
+	lines []string
+	max   int
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Add(line string) {
+	if line == "" {
+		return
+	}
+
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+func (t *tailBuffer) String() string {
+	var buf bytes.Buffer
+	for _, line := range t.lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	return buf.String()
+}
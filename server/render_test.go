@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeComposer stands in for composer/main.py, it checks spec.json points
+// at existing files, prints moviepy style progress and writes output.mp4.
+const fakeComposer = `
+cd "$WORKDIR" || exit 1
+test -f "$METAFILE" || exit 1
+for f in $(sed -n 's/.*"\(voice_path\|image_path\|path\)": "\(.*\)".*/\2/p' "$METAFILE"); do
+	test -f "$f" || { echo "missing $f"; exit 1; }
+done
+echo "Total duration: 3.25 seconds"
+printf 'frame_index:   0%%|          | 0/4 [00:00<?, ?it/s]\r'
+printf 'frame_index:  50%%|#####     | 2/4 [00:00<00:00, 9.1it/s]\r'
+printf 'frame_index: 100%%|##########| 4/4 [00:00<00:00, 9.1it/s]\n'
+echo mp4 > output.mp4
+`
+
+const brokenComposer = `
+echo "Traceback (most recent call last):"
+echo "OSError: ffmpeg not found" >&2
+exit 1
+`
+
+func (e *testEnv) useComposer(script string) {
+	e.t.Helper()
+
+	fp := filepath.Join(e.t.TempDir(), "main.sh")
+	mustNil(e.t, os.WriteFile(fp, []byte(script), 0666))
+	e.server.SetComposer(Composer{Python: "/bin/sh", Script: fp})
+}
+
+// illustrate runs script, voice and image generation for a new movie.
+func (e *testEnv) illustrate() (*movieView, string) {
+	e.t.Helper()
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	for _, path := range []string{"/generate_script", "/generate_voice", "/generate_image"} {
+		e.mustSucceed(e.runJob(base+path, gin.H{}))
+	}
+
+	return movie, base
+}
+
+func TestRender(t *testing.T) {
+	e := newTestEnv(t)
+	e.useComposer(fakeComposer)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.expect(http.StatusConflict, http.MethodPost, base+"/render", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, base+"/render/output", nil, nil)
+
+	movie, base = e.illustrate()
+	job := e.runJob(base+"/render", nil)
+	e.mustSucceed(job)
+	if job.Progress != 100 || job.Total != 100 {
+		t.Fatalf("unexpected render job progress %+v", job)
+	}
+
+	var got struct {
+		State            string `json:"state"`
+		OutputPath       string `json:"output_path"`
+		OutputDurationMs int64  `json:"output_duration_ms"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &got)
+	if got.State != model.StateRendered.String() || got.OutputDurationMs != 3250 ||
+		got.OutputPath != fmt.Sprintf("movie/%d/output.mp4", movie.Id) {
+		t.Fatalf("unexpected movie after render %+v", got)
+	}
+
+	var renders []model.Asset
+	e.expect(http.StatusOK, http.MethodGet, base+"/assets?kind=render", nil, &renders)
+	if len(renders) != 1 || renders[0].Path != got.OutputPath || renders[0].DurationMs != 3250 || renders[0].Width == 0 {
+		t.Fatalf("the output should be registered as an asset: %+v", renders)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(e.workdir, movieDir(movie.Id), renderSpecFile))
+	mustNil(t, err)
+
+	var spec model.RenderSpec
+	mustNil(t, json.Unmarshal(raw, &spec))
+	mustNil(t, spec.Validate())
+	if len(spec.Items) == 0 || !strings.HasPrefix(spec.Items[1].VoicePath, "../../cas/") ||
+		!strings.HasPrefix(spec.Items[1].ImagePath, "../../cas/") || spec.Items[len(spec.Items)-1].PauseMs != 0 {
+		t.Fatalf("unexpected render spec %s", raw)
+	}
+
+	resp, err := http.Get(e.http.URL + base + "/render/log")
+	mustNil(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("render log not served: %d", resp.StatusCode)
+	}
+
+	// a rendered movie can be rendered again
+	e.mustSucceed(e.runJob(base+"/render", nil))
+}
+
+func TestRenderBgm(t *testing.T) {
+	e := newTestEnv(t)
+	e.useComposer(fakeComposer)
+
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/templates", gin.H{"name": "music", "bgm": "../calm.mp3"}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/templates", gin.H{"name": "music", "bgm_volume": 3}, nil)
+	var tpl struct {
+		Bgm       string  `json:"bgm"`
+		BgmVolume float64 `json:"bgm_volume"`
+	}
+	e.expect(http.StatusCreated, http.MethodPost, "/api/templates", gin.H{"name": "music", "bgm": "bgm/calm.mp3"}, &tpl)
+	if tpl.Bgm != "bgm/calm.mp3" || tpl.BgmVolume != model.DefaultBgmVolume {
+		t.Fatalf("unexpected template %+v", tpl)
+	}
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "music"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	for _, path := range []string{"/generate_script", "/generate_voice", "/generate_image"} {
+		e.mustSucceed(e.runJob(base+path, gin.H{}))
+	}
+
+	// the music has to be there before the movie renders
+	if job := e.runJob(base+"/render", nil); job.State != model.JobStateFailed.String() || !strings.Contains(job.Error, "bgm") {
+		t.Fatalf("rendering without the bgm file should fail: %+v", job)
+	}
+
+	voice := e.movie(movie.Id).script(t).ScriptItems[0].VoicePath
+	raw, err := os.ReadFile(filepath.Join(e.workdir, voice))
+	mustNil(t, err)
+	mustNil(t, os.MkdirAll(filepath.Join(e.workdir, "bgm"), 0777))
+	mustNil(t, os.WriteFile(filepath.Join(e.workdir, "bgm/calm.mp3"), raw, 0666))
+	e.mustSucceed(e.runJob(base+"/render", nil))
+
+	raw, err = os.ReadFile(filepath.Join(e.workdir, movieDir(movie.Id), renderSpecFile))
+	mustNil(t, err)
+	var spec model.RenderSpec
+	mustNil(t, json.Unmarshal(raw, &spec))
+	if spec.Bgm == nil || spec.Bgm.Path != "../../bgm/calm.mp3" || spec.Bgm.Volume != model.DefaultBgmVolume {
+		t.Fatalf("the render spec should carry the bgm of the template: %s", raw)
+	}
+
+	var bgms []model.Asset
+	e.expect(http.StatusOK, http.MethodGet, base+"/assets?kind=bgm", nil, &bgms)
+	if len(bgms) != 1 || bgms[0].Path != "bgm/calm.mp3" || bgms[0].Mime != "audio/mpeg" || bgms[0].DurationMs == 0 {
+		t.Fatalf("the bgm should be registered as an asset: %+v", bgms)
+	}
+}
+
+func TestRenderFailure(t *testing.T) {
+	e := newTestEnv(t)
+	e.useComposer(brokenComposer)
+
+	_, base := e.illustrate()
+	job := e.runJob(base+"/render", nil)
+	if job.State != model.JobStateFailed.String() || job.Error == "" {
+		t.Fatalf("composer failure should fail the job: %+v", job)
+	}
+
+	if got := e.movie(job.MovieId); got.State != model.StateFailed.String() {
+		t.Fatalf("composer failure should fail the movie: %+v", got)
+	}
+
+	// failed renders can be retried
+	if job := e.runJob(base+"/render", nil); job.State != model.JobStateFailed.String() {
+		t.Fatalf("unexpected retried render job %+v", job)
+	}
+}
+
+func TestRenderGivenUp(t *testing.T) {
+	e := newIdleTestEnv(t)
+	created := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	movie, err := model.GetMovie(created.Id)
+	mustNil(t, err)
+	for _, state := range []model.State{model.StateScripted, model.StateVoiced, model.StateIllustrated, model.StateRendering} {
+		mustNil(t, movie.Transition(state, "test"))
+	}
+
+	// a render which crashed the server on every attempt
+	job, err := model.NewJob(movie.Id, JobRender, nil)
+	mustNil(t, err)
+	mustNil(t, job.Create())
+	for i := 0; i < model.MaxJobAttempts; i++ {
+		if i > 0 {
+			_, _, err := model.RequeueRunningJobs()
+			mustNil(t, err)
+		}
+		claimed, err := model.ClaimNextJob()
+		mustNil(t, err)
+		if claimed == nil || claimed.Id != job.Id {
+			t.Fatalf("expected to claim job %d, got %+v", job.Id, claimed)
+		}
+	}
+
+	e.startWorkers()
+	job, err = model.GetJob(job.Id)
+	mustNil(t, err)
+	if job.State != model.JobStateFailed.String() || job.Error.String != model.ErrJobInterrupted.Error() {
+		t.Fatalf("the render should be given up: %+v", job)
+	}
+
+	if got := e.movie(movie.Id); got.State != model.StateFailed.String() {
+		t.Fatalf("a given up render should fail the movie, got %s", got.State)
+	}
+}
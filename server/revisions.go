@@ -0,0 +1,255 @@
+package server
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/media"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// authorHeader names who makes a change to a script, it is recorded with
+// the revision.
+const authorHeader = "X-Author"
+
+const (
+	opImportScript  = "import script"
+	opRestoreScript = "restore script"
+)
+
+func author(c *gin.Context) string {
+	return c.GetHeader(authorHeader)
+}
+
+// chatPrompt is the prompt of a generated revision as the model got it.
+func chatPrompt(system, user string) string {
+	return "[system]\n" + system + "\n\n[user]\n" + user
+}
+
+func (s *Server) revisionRoutes(api *gin.RouterGroup) {
+	api.GET("/movies/:movie_id/script_revisions", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
+		}
+
+		if list, err := model.ListScriptRevisions(movie.Id); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"data": list})
+		}
+	})
+
+	api.GET("/movies/:movie_id/script_revisions/diff", s.diffRevisions)
+
+	api.GET("/movies/:movie_id/script_revisions/:revision_id", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
+		}
+
+		if rev, ok := revisionParam(c, movie, c.Param("revision_id")); ok {
+			c.JSON(200, gin.H{"data": rev})
+		}
+	})
+
+	api.POST("/movies/:movie_id/script_revisions/:revision_id/restore", s.restoreRevision)
+	api.PUT("/movies/:movie_id/script", s.importScript)
+}
+
+// revisionParam loads revision id of movie, it writes the error response
+// itself and reports whether to go on.
+func revisionParam(c *gin.Context, movie *model.Movie, id string) (*model.ScriptRevision, bool) {
+	revId, err := strconv.Atoi(id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid revision ID"})
+		return nil, false
+	}
+
+	rev, err := model.GetScriptRevision(movie.Id, int64(revId))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Revision not found"})
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return rev, true
+}
+
+// diffRevisions compares the revisions from and to item by item, to
+// defaults to the newest revision.
+func (s *Server) diffRevisions(c *gin.Context) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	to := c.Query("to")
+	if to == "" {
+		list, err := model.ListScriptRevisions(movie.Id)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(list) == 0 {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+		to = strconv.FormatInt(list[0].Id, 10)
+	}
+
+	var scripts [2]*model.MovieScript
+	var ids [2]int64
+	for i, id := range []string{c.Query("from"), to} {
+		rev, ok := revisionParam(c, movie, id)
+		if !ok {
+			return
+		}
+
+		script, err := rev.GetScript()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		scripts[i], ids[i] = script, rev.Id
+	}
+
+	c.JSON(200, gin.H{"from": ids[0], "to": ids[1], "data": model.DiffScripts(scripts[0], scripts[1])})
+}
+
+// restoreRevision makes a revision the current script, as a new revision.
+func (s *Server) restoreRevision(c *gin.Context) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	rev, ok := revisionParam(c, movie, c.Param("revision_id"))
+	if !ok {
+		return
+	}
+
+	script, err := rev.GetScript()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	prompt := "restored revision " + strconv.FormatInt(rev.Id, 10)
+	s.setScript(c, movie, script, model.NewRevision(model.RevisionSourceRestore, author(c), prompt), opRestoreScript)
+}
+
+// importScript replaces the script by one written elsewhere, asset paths
+// it brings along are ignored.
+func (s *Server) importScript(c *gin.Context) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	var binding model.MovieScript
+	if err := c.ShouldBindJSON(&binding); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if len(binding.ScriptItems) == 0 {
+		c.JSON(400, gin.H{"error": "a script needs at least one item"})
+		return
+	}
+
+	script := &model.MovieScript{Title: binding.Title}
+	for i, item := range binding.ScriptItems {
+		if item == nil || item.ZhSubtitle == "" {
+			c.JSON(400, gin.H{"error": "script item " + strconv.Itoa(i) + " has no subtitle"})
+			return
+		}
+
+		script.ScriptItems = append(script.ScriptItems, &model.ScriptItem{
+			ZhSubtitle:  item.ZhSubtitle,
+			EnSubtitle:  item.EnSubtitle,
+			ImagePrompt: item.ImagePrompt,
+		})
+	}
+
+	s.setScript(c, movie, script, model.NewRevision(model.RevisionSourceImport, author(c), ""), opImportScript)
+}
+
+// setScript replaces the script of the movie as op and moves it to the
+// state the assets of the new script support in the same write. It writes
+// the response itself.
+func (s *Server) setScript(c *gin.Context, movie *model.Movie, script *model.MovieScript, rev *model.ScriptRevision, op string) {
+	if err := s.findAssets(movie, script); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the script no longer is what a model wrote
+	movie.ScriptModel = sql.NullString{}
+	guard := &model.StateGuard{Op: op, States: scriptStates, Reason: rev.Source + " script"}
+	if err := movie.SetScript(script, rev, guard); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", movie.ETag())
+	c.JSON(200, gin.H{"data": script, "revision": rev.Id})
+}
+
+// findAssets gives the items of script the voices and images generated for
+// their text before, looked up in the asset cache with the providers of the
+// movie. Paths the items bring along are dropped, the files found are
+// registered as assets of the movie.
+func (s *Server) findAssets(movie *model.Movie, script *model.MovieScript) error {
+	tpl, err := movie.GetTemplate()
+	if err != nil {
+		return err
+	}
+
+	// providers which are no longer configured have nothing cached
+	synthesizer, _ := s.providers.SpeechSynthesizer(movie.SpeechProvider.String)
+	generator, _ := s.providers.ImageGenerator(movie.ImageProvider.String)
+
+	for _, item := range script.ScriptItems {
+		item.VoicePath, item.VoiceAsset, item.DurationMs, item.VoiceStatus = "", 0, 0, ""
+		if synthesizer != nil {
+			if fp, ok := s.cachedAsset(s.voiceKey(movie, tpl, synthesizer, item.ZhSubtitle)); ok {
+				voice := &model.Asset{MovieId: &movie.Id, Kind: model.AssetVoice, Path: fp, Model: ai.ModelOf(synthesizer),
+					Provider: s.providers.Resolve(ai.KindSpeech, movie.SpeechProvider.String)}
+				if d, err := media.Mp3Duration(filepath.Join(s.workdir, fp)); err == nil {
+					voice.DurationMs = d.Milliseconds()
+					if err := s.registerAsset(voice); err != nil {
+						return err
+					}
+					item.VoicePath, item.VoiceAsset, item.DurationMs = voice.Path, voice.Id, voice.DurationMs
+				}
+			}
+		}
+
+		item.ImagePath, item.ImageAsset, item.ImageStatus = "", 0, ""
+		if generator != nil {
+			prompt := styledPrompt(item.ImagePrompt, tpl.ImageStyle)
+			if fp, ok := s.cachedAsset(s.imageKey(movie, generator, prompt)); ok {
+				image := &model.Asset{MovieId: &movie.Id, Kind: model.AssetImage, Path: fp, Model: ai.ModelOf(generator),
+					Provider: s.providers.Resolve(ai.KindImage, movie.ImageProvider.String)}
+				if err := s.registerAsset(image); err != nil {
+					return err
+				}
+				item.ImagePath, item.ImageAsset = image.Path, image.Id
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+const opEditScript = "edit script"
+
+// editStates are the states a script may be edited in, the same as for
+// generating voices since both only need a script.
+var editStates = voiceStates
+
+// editAttempts is how often an edit without If-Match is tried against the
+// latest version of the movie.
+const editAttempts = 3
+
+// insertBinding is the body of the insert endpoint, index defaults to
+// appending the item.
+type insertBinding struct {
+	Index       *int   `json:"index"`
+	ZhSubtitle  string `json:"cn" binding:"required"`
+	EnSubtitle  string `json:"en"`
+	ImagePrompt string `json:"image_prompt"`
+}
+
+type reorderBinding struct {
+	Order []int `json:"order" binding:"required"`
+}
+
+// splitBinding cuts the chinese subtitle after at characters, en are the
+// english subtitles of the two halves.
+type splitBinding struct {
+	At int       `json:"at" binding:"required"`
+	En [2]string `json:"en"`
+}
+
+func (s *Server) scriptEditRoutes(api *gin.RouterGroup) {
+	api.POST("/movies/:movie_id/scripts", func(c *gin.Context) {
+		var binding insertBinding
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			index := len(script.ScriptItems)
+			if binding.Index != nil {
+				index = *binding.Index
+			}
+
+			return script.InsertItem(index, &model.ScriptItem{
+				ZhSubtitle:  binding.ZhSubtitle,
+				EnSubtitle:  binding.EnSubtitle,
+				ImagePrompt: binding.ImagePrompt,
+			})
+		})
+	})
+
+	api.POST("/movies/:movie_id/scripts/reorder", func(c *gin.Context) {
+		var binding reorderBinding
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			return script.Reorder(binding.Order)
+		})
+	})
+
+	api.PUT("/movies/:movie_id/scripts/:scirpt_index", func(c *gin.Context) {
+		index, ok := scriptIndexParam(c)
+		if !ok {
+			return
+		}
+
+		var patch model.ScriptItemPatch
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			if err := script.CheckIndex(index); err != nil {
+				return err
+			}
+
+			script.ScriptItems[index].Apply(patch)
+			return nil
+		})
+	})
+
+	api.DELETE("/movies/:movie_id/scripts/:scirpt_index", func(c *gin.Context) {
+		index, ok := scriptIndexParam(c)
+		if !ok {
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			return script.DeleteItem(index)
+		})
+	})
+
+	api.POST("/movies/:movie_id/scripts/:scirpt_index/split", func(c *gin.Context) {
+		index, ok := scriptIndexParam(c)
+		if !ok {
+			return
+		}
+
+		var binding splitBinding
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			return script.SplitItem(index, binding.At, binding.En)
+		})
+	})
+
+	api.POST("/movies/:movie_id/scripts/:scirpt_index/merge", func(c *gin.Context) {
+		index, ok := scriptIndexParam(c)
+		if !ok {
+			return
+		}
+
+		editScript(c, func(script *model.MovieScript) error {
+			return script.MergeItems(index)
+		})
+	})
+}
+
+func scriptIndexParam(c *gin.Context) (int, bool) {
+	index, err := strconv.Atoi(c.Param("scirpt_index"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid script index"})
+		return 0, false
+	}
+
+	return index, true
+}
+
+// editScript applies edit to the script of the movie and saves the items it
+// changed, edits which can not be applied answer 400. Without If-Match the
+// edit applies to the latest version, so it is retried when a job saved a
+// voice or image in the meantime. It writes the response itself.
+func editScript(c *gin.Context, edit func(script *model.MovieScript) error) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	guard := &model.StateGuard{Op: opEditScript, States: editStates, Reason: "script edited"}
+	for attempt := 1; ; attempt++ {
+		// errors of the edit itself are the caller's, the rest are ours
+		var editErr error
+		script, err := movie.EditScript(model.NewRevision(model.RevisionSourceEdit, author(c), ""), guard, func(script *model.MovieScript) error {
+			editErr = edit(script)
+			return editErr
+		})
+		if editErr != nil {
+			c.JSON(400, gin.H{"error": editErr.Error()})
+			return
+		}
+
+		if errors.Is(err, model.ErrMovieChanged) && c.GetHeader("If-Match") == "" && attempt < editAttempts {
+			if movie, err = model.GetMovie(movie.Id); err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("ETag", movie.ETag())
+		c.JSON(200, gin.H{"data": script})
+		return
+	}
+}
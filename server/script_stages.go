@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const JobScriptStages = "script_stages"
+
+// scriptStagesPayload lists the stages a script_stages job runs, in
+// pipeline order.
+type scriptStagesPayload struct {
+	Stages []string `json:"stages"`
+}
+
+// orderStages validates stages and sorts them into pipeline order, no
+// stages means all of them.
+func orderStages(stages []string) ([]string, error) {
+	if len(stages) == 0 {
+		return model.ScriptStages, nil
+	}
+
+	wanted := map[string]bool{}
+	for _, stage := range stages {
+		if !model.IsScriptStage(stage) {
+			return nil, errors.Errorf("unknown script stage %q, expected one of %v", stage, model.ScriptStages)
+		}
+		wanted[stage] = true
+	}
+
+	ordered := make([]string, 0, len(wanted))
+	for _, stage := range model.ScriptStages {
+		if wanted[stage] {
+			ordered = append(ordered, stage)
+		}
+	}
+
+	return ordered, nil
+}
+
+func (s *Server) getScriptStages(c *gin.Context) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	artifacts, err := movie.GetScriptArtifacts()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	stages := make([]gin.H, 0, len(model.ScriptStages))
+	for _, stage := range model.ScriptStages {
+		stages = append(stages, gin.H{"name": stage, "done": artifacts.Done(stage)})
+	}
+
+	c.JSON(200, gin.H{"data": gin.H{"stages": stages, "artifacts": artifacts}})
+}
+
+func (s *Server) runScriptStages(c *gin.Context) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	if err := movie.Require(opGenerateScript, scriptStates...); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	var binding scriptStagesPayload
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	stages, err := orderStages(binding.Stages)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := s.providers.ScriptStager(movie.ScriptProvider.String); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.respondJob(c, movie.Id, JobScriptStages, scriptStagesPayload{Stages: stages})
+}
+
+// scriptStages runs the stages of the payload one after another, the
+// artifacts are saved after every stage. Once all stages are done the
+// assembled script replaces the one of the movie, items keep the voices and
+// images already generated for their texts.
+func (s *Server) scriptStages(ctx context.Context, job *model.Job) error {
+	var payload scriptStagesPayload
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	stages, err := orderStages(payload.Stages)
+	if err != nil {
+		return err
+	}
+
+	movie, err := model.GetMovie(job.MovieId)
+	if err != nil {
+		return err
+	}
+
+	if err := movie.Require(opGenerateScript, scriptStates...); err != nil {
+		return err
+	}
+
+	stager, err := s.providers.ScriptStager(movie.ScriptProvider.String)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := movie.GetScriptArtifacts()
+	if err != nil {
+		return err
+	}
+
+	if err := job.SetProgress(0, len(stages)); err != nil {
+		return err
+	}
+
+	req, err := scriptRequest(movie)
+	if err != nil {
+		return err
+	}
+
+	ctx = ai.WithCallTags(ctx, movie.Id, ai.NoItem)
+	for i, stage := range stages {
+		if err := ai.RunScriptStage(ctx, stager, stage, req, artifacts); err != nil {
+			return err
+		}
+
+		if err := movie.SetScriptArtifacts(artifacts); err != nil {
+			return err
+		}
+
+		if err := job.SetProgress(i+1, len(stages)); err != nil {
+			return err
+		}
+	}
+
+	if !artifacts.Complete() {
+		// later stages are still to be run
+		return nil
+	}
+
+	script, err := artifacts.Script()
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(script)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal script")
+	}
+
+	if violations := ai.CheckScript(script, req); len(violations) > 0 {
+		return &ai.ScriptValidationError{Attempts: 1, Violations: violations, Output: string(raw)}
+	}
+
+	link := ai.ScriptLink{Provider: s.providers.Resolve(ai.KindScript, movie.ScriptProvider.String), Model: ai.ModelOf(stager)}
+	movie.ScriptModel = sql.NullString{String: link.String(), Valid: true}
+	rev := model.NewRevision(model.RevisionSourceLLM, link.String(), chatPrompt("script stages "+strings.Join(stages, ", "), req.Idea))
+	// texts the stages did not change keep their voices and images
+	if err := s.findAssets(movie, script); err != nil {
+		return err
+	}
+
+	return movie.SetScript(script, rev, &model.StateGuard{Op: opGenerateScript, States: scriptStates, Reason: "script generated"})
+}
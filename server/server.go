@@ -1,14 +1,18 @@
 package server
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cmingxu/mpu/ai"
@@ -22,27 +26,124 @@ type Server struct {
 	engine  *gin.Engine
 	addr    string
 	workdir string
+
+	providers      *ai.Registry      // AI providers
+	scriptAttempts int               // 文案不合规时最多生成几次
+	composer       Composer          // 视频合成
+	prices         *model.PriceTable // AI 调用价格
+
+	workers     int                // 任务并发数
+	itemWorkers int                // 单个任务内同时生成的脚本条目数
+	jobFuncs    map[string]JobFunc // 任务类型对应的执行函数
+	wake        chan struct{}      // 唤醒空闲的 worker
+	workerWg    sync.WaitGroup
 }
 
-func New(addr string, workdir string) *Server {
+func New(addr string, workdir string, workers int, providers *ai.Registry) *Server {
+	if workers <= 0 {
+		workers = 1
+	}
+
 	s := &Server{
-		addr:    addr,
-		workdir: workdir,
-		engine:  gin.Default(),
+		addr:           addr,
+		workdir:        workdir,
+		engine:         gin.Default(),
+		workers:        workers,
+		itemWorkers:    DefaultItemWorkers,
+		wake:           make(chan struct{}, 1),
+		providers:      providers,
+		scriptAttempts: ai.DefaultScriptAttempts,
+		composer:       DefaultComposer,
+		prices:         &model.PriceTable{},
 	}
 
+	providers.SetRecorder(recordCall)
+
+	s.registerJobs()
+	s.routes()
+
 	return s
 }
 
+// Handler returns the http handler with every route registered, it serves
+// requests without listening, jobs only run once workers are started.
+func (s *Server) Handler() http.Handler {
+	return s.engine
+}
+
+// StartWorkers starts the background job workers, they stop when ctx is
+// done and Wait returns once they all did.
+func (s *Server) StartWorkers(ctx context.Context) error {
+	return s.startWorkers(ctx)
+}
+
+// Wait blocks until all job workers stopped.
+func (s *Server) Wait() {
+	s.workerWg.Wait()
+}
+
+// shutdownTimeout is how long requests in flight get to finish once the
+// server is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// Start serves http and runs the job workers until SIGINT or SIGTERM, then
+// stops accepting requests, cancels the workers and waits for them, so
+// running jobs are requeued instead of killed halfway.
 func (s *Server) Start() error {
-	log.Info().Msgf("Starting server on %s", s.addr)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	if err := s.StartWorkers(ctx); err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: s.addr, Handler: s.engine}
+	served := make(chan error, 1)
+	go func() {
+		log.Info().Msgf("Starting server on %s", s.addr)
+		served <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Info().Msg("Shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if serr := srv.Shutdown(shutdownCtx); serr != nil {
+		log.Error().Err(serr).Msg("failed to shut down http server")
+	}
+
+	s.Wait()
+	log.Info().Msg("Job workers stopped")
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) routes() {
 	s.engine.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "pong"})
 	})
 
+	// the server stays healthy while providers are down, their breakers
+	// tell which ones
 	s.engine.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "OK"})
+		breakers := s.providers.Breakers()
+		message := "OK"
+		for _, b := range breakers {
+			if b.State != ai.BreakerClosed {
+				message = "DEGRADED"
+			}
+		}
+
+		c.JSON(200, gin.H{"message": message, "providers": breakers})
 	})
 
 	api := s.engine.Group("/api")
@@ -65,15 +166,22 @@ func (s *Server) Start() error {
 		idInt, err := strconv.Atoi(id)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+			return
 		}
 
-		if tpl, err := model.GetTemplate(int64(idInt)); err != nil {
+		if tpl, err := model.GetTemplate(int64(idInt)); errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		} else if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		} else {
 			c.JSON(http.StatusOK, gin.H{"data": tpl})
 		}
 	})
 
+	api.POST("/templates", s.createTemplate)
+	api.PUT("/templates/:id", s.updateTemplate)
+	api.DELETE("/templates/:id", s.deleteTemplate)
+
 	api.GET("/templates/default", func(c *gin.Context) {
 		d, err := model.DefaultTemplates()
 		if err != nil {
@@ -84,10 +192,29 @@ func (s *Server) Start() error {
 		c.JSON(200, gin.H{"data": d})
 	})
 
+	api.GET("/providers", func(c *gin.Context) {
+		data := gin.H{}
+		for _, kind := range []string{ai.KindScript, ai.KindSpeech, ai.KindImage} {
+			data[kind] = gin.H{
+				"default": s.providers.Default(kind),
+				"names":   s.providers.Names(kind),
+			}
+		}
+
+		c.JSON(200, gin.H{"data": data})
+	})
+
+	api.GET("/presets", func(c *gin.Context) {
+		c.JSON(200, gin.H{"data": model.ListPresets()})
+	})
+
 	api.POST("/movies", func(c *gin.Context) {
 		var binding struct {
-			Idea    string `json:"idea"`
-			TplName string `json:"tpl_name"`
+			Idea             string `json:"idea"`
+			TplName          string `json:"tpl_name"`
+			Preset           string `json:"preset"`
+			TargetDurationMs int64  `json:"target_duration_ms"`
+			movieProviders
 		}
 
 		if err := c.ShouldBindJSON(&binding); err != nil {
@@ -95,15 +222,37 @@ func (s *Server) Start() error {
 			return
 		}
 
-		movie := model.NewMovie()
-		movie.Idea = sql.NullString{String: binding.Idea, Valid: true}
+		if binding.TargetDurationMs < 0 {
+			c.JSON(400, gin.H{"error": "Invalid target duration"})
+			return
+		}
 
-		_, err := model.GetTemplateByName(binding.TplName)
+		tpl, err := model.GetTemplateByName(binding.TplName)
 		if err != nil {
 			c.JSON(400, gin.H{"error": "Invalid template name"})
 			return
 		}
 
+		movie := model.NewMovie()
+		movie.TplName = tpl.Name
+		movie.Idea = sql.NullString{String: binding.Idea, Valid: true}
+		movie.TargetDurationMs = sql.NullInt64{Int64: binding.TargetDurationMs, Valid: binding.TargetDurationMs > 0}
+
+		if _, ok := model.GetPreset(binding.Preset); !ok {
+			c.JSON(400, gin.H{"error": "Invalid preset"})
+			return
+		}
+		if binding.Preset == "" {
+			// movies are made for the platform of their template
+			binding.Preset = tpl.Preset
+		}
+		movie.Preset = sql.NullString{String: binding.Preset, Valid: binding.Preset != ""}
+
+		if err := s.applyProviders(movie, binding.movieProviders); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
 		if err := movie.Create(); err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
@@ -127,323 +276,421 @@ func (s *Server) Start() error {
 	})
 
 	api.GET("/movies/:movie_id", func(c *gin.Context) {
-		movieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(movieId)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		if movie, err := model.GetMovie(int64(movieIdInt)); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(200, gin.H{"data": movie})
+		if c.GetHeader("If-None-Match") != "" && etagWeakMatches(c.GetHeader("If-None-Match"), movie) {
+			c.Status(http.StatusNotModified)
+			return
 		}
+
+		c.JSON(200, gin.H{"data": movie})
 	})
 
-	api.POST("/movies/:movie_id/generate_script", func(c *gin.Context) {
-		moveieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(moveieId)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
+	api.PUT("/movies/:movie_id/providers", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		movie, err := model.GetMovie(int64(movieIdInt))
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		var binding movieProviders
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
 			return
 		}
 
-		var binding struct {
-			Idea string `json:"idea"`
+		if err := s.applyProviders(movie, binding); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
 		}
 
-		if err := c.ShouldBindJSON(&binding); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid request body"})
+		if err := movie.Update(); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
-		if len(binding.Idea) != 0 && movie.Idea.String != binding.Idea {
-			movie.Idea = sql.NullString{String: binding.Idea, Valid: true}
-			if err := movie.Update(); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+		c.Header("ETag", movie.ETag())
+		c.JSON(200, gin.H{"data": movie})
+	})
 
-				return
-			}
+	api.POST("/movies/:movie_id/generate_script", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
+			return
 		}
 
-		scripts, err := ai.GetClient().GenerateScript(c, movie.Idea.String, time.Minute*3)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if err := movie.Require(opGenerateScript, scriptStates...); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
 		}
 
-		canSerializeToScriptItems := false
-		if err := json.Unmarshal([]byte(scripts), &model.MovieScript{}); err == nil {
-			canSerializeToScriptItems = true
+		var binding struct {
+			Idea             string `json:"idea"`
+			Preset           string `json:"preset"`
+			TargetDurationMs int64  `json:"target_duration_ms"`
 		}
 
-		if !canSerializeToScriptItems {
-			c.JSON(400, gin.H{"error": "Generated script is not in the correct format"})
+		if err := c.ShouldBindJSON(&binding); err != nil || binding.TargetDurationMs < 0 {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
 		}
 
-		movie.Script = sql.NullString{String: scripts, Valid: true}
-		if err := movie.Update(); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if _, ok := model.GetPreset(binding.Preset); !ok {
+			c.JSON(400, gin.H{"error": "Invalid preset"})
 			return
 		}
 
-		c.JSON(200, gin.H{"data": movie})
-	})
+		changed := false
+		if binding.Preset != "" && movie.Preset.String != binding.Preset {
+			// a new platform brings its own duration unless one is given
+			movie.Preset = sql.NullString{String: binding.Preset, Valid: true}
+			movie.TargetDurationMs = sql.NullInt64{}
+			changed = true
+		}
 
-	api.POST("/movies/:movie_id/scripts/:scirpt_index/generate_voice", func(c *gin.Context) {
-		moveieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(moveieId)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
-			return
+		if len(binding.Idea) != 0 && movie.Idea.String != binding.Idea {
+			movie.Idea = sql.NullString{String: binding.Idea, Valid: true}
+			changed = true
 		}
 
-		movie, err := model.GetMovie(int64(movieIdInt))
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
+		if binding.TargetDurationMs > 0 && movie.TargetDurationMs.Int64 != binding.TargetDurationMs {
+			movie.TargetDurationMs = sql.NullInt64{Int64: binding.TargetDurationMs, Valid: true}
+			changed = true
 		}
 
-		script, err := movie.GetScript()
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
+		if changed {
+			if err := movie.Update(); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
 		}
 
-		scriptIndex := c.Param("scirpt_index")
-		scriptIndexInt, err := strconv.Atoi(scriptIndex)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid script index"})
+		s.respondJob(c, movie.Id, JobGenerateScript, nil)
+	})
+
+	api.GET("/movies/:movie_id/script_stages", s.getScriptStages)
+	api.POST("/movies/:movie_id/script_stages", s.runScriptStages)
+
+	s.scriptEditRoutes(api)
+	s.revisionRoutes(api)
+	s.costRoutes(api)
+	s.assetRoutes(api)
+
+	api.POST("/movies/:movie_id/scripts/:scirpt_index/generate_voice", func(c *gin.Context) {
+		movie, index, ok := scriptItemParams(c, opGenerateVoice, voiceStates)
+		if !ok {
 			return
 		}
 
-		if scriptIndexInt < 0 || scriptIndexInt >= len(script.ScriptItems) {
-			c.JSON(400, gin.H{"error": "Script index out of range"})
+		s.respondJob(c, movie.Id, JobGenerateVoiceItem, itemPayload{Index: index, Force: forceParam(c)})
+	})
+
+	api.POST("/movies/:movie_id/generate_voice", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		item := script.ScriptItems[scriptIndexInt]
-		content, err := ai.GetTTSInstance().GenerateAudio(c, item.ZhSubtitle)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-		}
-		fp := fmt.Sprintf("/movie/%d/audio/%d.mp3",
-			movieIdInt, scriptIndexInt)
-		if err := saveMp3File(content, s.workdir, fp); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if err := movie.Require(opGenerateVoice, voiceStates...); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
 		}
 
-		item.VoicePath = fp
-		raw, _ := json.Marshal(script)
-		movie.Script = sql.NullString{String: string(raw), Valid: true}
-		if err := movie.Update(); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		s.respondJob(c, movie.Id, JobGenerateVoice, assetPayload{Force: forceParam(c)})
+	})
+
+	api.POST("/movies/:movie_id/scripts/:scirpt_index/generate_image", func(c *gin.Context) {
+		movie, index, ok := scriptItemParams(c, opGenerateImage, imageStates)
+		if !ok {
 			return
 		}
 
-		c.JSON(200, gin.H{"data": movie})
+		s.respondJob(c, movie.Id, JobGenerateImageItem, itemPayload{Index: index, Force: forceParam(c)})
 	})
 
-	api.POST("/movies/:movie_id/generate_voice", func(c *gin.Context) {
-		moveieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(moveieId)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
+	api.GET("voices_list", func(c *gin.Context) {
+		c.JSON(200, gin.H{"data": ai.VoiceList})
+	})
+
+	api.POST("/movies/:movie_id/generate_image", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		movie, err := model.GetMovie(int64(movieIdInt))
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if err := movie.Require(opGenerateImage, imageStates...); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
 		}
 
-		script, err := movie.GetScript()
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		s.respondJob(c, movie.Id, JobGenerateImage, assetPayload{Force: forceParam(c)})
+	})
+
+	api.POST("/movies/:movie_id/render", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		for i, item := range script.ScriptItems {
-			log.Info().Msgf("Generating voice for item %d: %s", i, item.ZhSubtitle)
-			rawMp3, err := ai.GetTTSInstance().GenerateAudio(c, item.ZhSubtitle)
-			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
-
-			fp := fmt.Sprintf("movie/%d/audio/%d.mp3",
-				movieIdInt, i)
+		if err := movie.Require(opRender, renderStates...); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 
-			if err := saveMp3File(rawMp3, s.workdir, fp); err != nil {
+		// moving to rendering right away keeps other generation off the
+		// movie until the render job is done
+		if err := movie.Transition(model.StateRendering, "render requested"); err != nil {
+			if model.IsStateError(err) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
 				c.JSON(500, gin.H{"error": err.Error()})
-				return
 			}
-			item.VoicePath = fp
+			return
 		}
 
-		raw, _ := json.Marshal(script)
-		movie.Script = sql.NullString{String: string(raw), Valid: true}
-		if err := movie.Update(); err != nil {
+		job, err := s.enqueue(movie.Id, JobRender, nil)
+		if err != nil {
+			if terr := movie.Transition(model.StateFailed, err.Error()); terr != nil {
+				log.Error().Err(terr).Msgf("failed to mark movie %d as failed", movie.Id)
+			}
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(200, gin.H{"data": movie})
+		c.JSON(http.StatusAccepted, gin.H{"data": job})
 	})
 
-	api.POST("/movies/:movie_id/scripts/:scirpt_index/generate_image", func(c *gin.Context) {
-		moveieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(moveieId)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
+	api.GET("/movies/:movie_id/render/log", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		movie, err := model.GetMovie(int64(movieIdInt))
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
+		s.serveMovieFile(c, filepath.Join(movieDir(movie.Id), renderLogFile), "text/plain; charset=utf-8")
+	})
 
-		script, err := movie.GetScript()
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+	api.GET("/movies/:movie_id/render/output", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		scriptIndex := c.Param("scirpt_index")
-		scriptIndexInt, err := strconv.Atoi(scriptIndex)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid script index"})
+		if !movie.OutputPath.Valid {
+			c.JSON(404, gin.H{"error": "Movie not rendered"})
 			return
 		}
 
-		if scriptIndexInt < 0 || scriptIndexInt >= len(script.ScriptItems) {
-			c.JSON(400, gin.H{"error": "Script index out of range"})
+		s.serveMovieFile(c, movie.OutputPath.String, "video/mp4")
+	})
+
+	api.GET("/movies/:movie_id/subtitles", s.getSubtitles)
+
+	api.GET("/movies/:movie_id/states", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		item := script.ScriptItems[scriptIndexInt]
-		content, err := ai.GetTxt2Img().GenerateImage(c, item.ImagePrompt)
-		if err != nil {
+		if list, err := model.ListStateTransitions(movie.Id); err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"data": list})
 		}
+	})
 
-		fp := fmt.Sprintf("movie/%d/image/%d.png", movieIdInt, scriptIndexInt)
-		if err := saveImageFile(content, s.workdir, fp); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+	api.GET("/movies/:movie_id/jobs", func(c *gin.Context) {
+		movie, ok := movieParam(c)
+		if !ok {
 			return
 		}
 
-		item.ImagePath = fp
-		raw, _ := json.Marshal(script)
-		movie.Script = sql.NullString{String: string(raw), Valid: true}
-		if err := movie.Update(); err != nil {
+		if jobs, err := model.ListMovieJobs(movie.Id); err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
-			return
+		} else {
+			c.JSON(200, gin.H{"data": jobs})
 		}
-
-		c.JSON(200, gin.H{"data": movie})
 	})
 
-	api.GET("voices_list", func(c *gin.Context) {
-		c.JSON(200, gin.H{"data": ai.VoiceList})
-	})
-
-	api.POST("/movies/:movie_id/generate_image", func(c *gin.Context) {
-		moveieId := c.Param("movie_id")
-		movieIdInt, err := strconv.Atoi(moveieId)
+	api.GET("/jobs/:job_id", func(c *gin.Context) {
+		jobId := c.Param("job_id")
+		jobIdInt, err := strconv.Atoi(jobId)
 		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid movie ID"})
+			c.JSON(400, gin.H{"error": "Invalid job ID"})
 			return
 		}
 
-		movie, err := model.GetMovie(int64(movieIdInt))
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		job, err := model.GetJob(int64(jobIdInt))
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Job not found"})
 			return
 		}
 
-		script, err := movie.GetScript()
 		if err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
 
-		for i, item := range script.ScriptItems {
-			log.Info().Msgf("Generating voice for item %d: %s", i, item.ZhSubtitle)
-			content, err := ai.GetTxt2Img().GenerateImage(c, item.ImagePrompt)
-			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
+		c.JSON(200, gin.H{"data": job})
+	})
 
-			fp := fmt.Sprintf("movie/%d/image/%d.png", movieIdInt, i)
-			if err := saveImageFile(content, s.workdir, fp); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
-			item.ImagePath = fp
+}
+
+// movieParam loads the movie named by the movie_id route parameter and
+// checks the If-Match header against it, it writes the error response
+// itself and reports whether to go on. The response carries the ETag of
+// the movie as loaded.
+func movieParam(c *gin.Context) (*model.Movie, bool) {
+	movieId := c.Param("movie_id")
+	movieIdInt, err := strconv.Atoi(movieId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid movie ID"})
+		return nil, false
+	}
+
+	movie, err := model.GetMovie(int64(movieIdInt))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Movie not found"})
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if match := c.GetHeader("If-Match"); match != "" && !etagMatches(match, movie) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Movie was changed, reload it and try again"})
+		return nil, false
+	}
+
+	c.Header("ETag", movie.ETag())
+	return movie, true
+}
+
+// etagMatches reports whether the If-Match header names the current
+// version of movie. The comparison is strong, weak tags never match.
+func etagMatches(header string, movie *model.Movie) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == movie.ETag() {
+			return true
 		}
+	}
 
-		raw, _ := json.Marshal(script)
-		movie.Script = sql.NullString{String: string(raw), Valid: true}
-		if err := movie.Update(); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
+	return false
+}
+
+// etagWeakMatches reports whether the If-None-Match header names the
+// current version of movie. The comparison is weak, W/ is ignored.
+func etagWeakMatches(header string, movie *model.Movie) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == "*" || tag == movie.ETag() {
+			return true
 		}
+	}
 
-		c.JSON(200, gin.H{"data": movie})
-	})
+	return false
+}
 
-	return s.engine.Run(s.addr)
+// errorStatus is the status of an error changing a movie, conflicts with
+// its state or with a concurrent change are for the client to resolve.
+func errorStatus(err error) int {
+	if model.IsStateError(err) || errors.Is(err, model.ErrMovieChanged) {
+		return http.StatusConflict
+	}
+
+	return 500
 }
 
-func saveMp3File(content []byte, workdir, fp string) error {
-	log.Info().Msgf("Saving mp3 file to %s", fp)
+// scriptItemParams resolves the movie and script index of the per item
+// routes and checks the movie allows op, it writes the error response itself
+// and reports whether to go on.
+func scriptItemParams(c *gin.Context, op string, states []model.State) (*model.Movie, int, bool) {
+	movie, ok := movieParam(c)
+	if !ok {
+		return nil, 0, false
+	}
 
-	abspath := filepath.Join(workdir, fp)
+	if err := movie.Require(op, states...); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return nil, 0, false
+	}
 
-	if err := os.RemoveAll(abspath); err != nil {
-		return err
+	script, err := movie.GetScript()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, 0, false
 	}
 
-	if err := os.MkdirAll(filepath.Dir(abspath), 0777); err != nil {
-		return err
+	scriptIndex := c.Param("scirpt_index")
+	scriptIndexInt, err := strconv.Atoi(scriptIndex)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid script index"})
+		return nil, 0, false
 	}
 
-	if err := ioutil.WriteFile(abspath, content, 0777); err != nil {
-		return err
+	if scriptIndexInt < 0 || scriptIndexInt >= len(script.ScriptItems) {
+		c.JSON(400, gin.H{"error": "Script index out of range"})
+		return nil, 0, false
 	}
 
-	return nil
+	return movie, scriptIndexInt, true
 }
 
-func saveImageFile(content []byte, workdir, fp string) error {
-	log.Info().Msgf("Saving image file to %s", fp)
+// movieProviders selects the providers of a movie by name, empty names
+// keep the current choice.
+type movieProviders struct {
+	ScriptProvider string `json:"script_provider"`
+	SpeechProvider string `json:"speech_provider"`
+	ImageProvider  string `json:"image_provider"`
+}
 
-	abspath := filepath.Join(workdir, fp)
+func (s *Server) applyProviders(movie *model.Movie, p movieProviders) error {
+	for _, choice := range []struct {
+		kind  string
+		name  string
+		field *sql.NullString
+	}{
+		{ai.KindScript, p.ScriptProvider, &movie.ScriptProvider},
+		{ai.KindSpeech, p.SpeechProvider, &movie.SpeechProvider},
+		{ai.KindImage, p.ImageProvider, &movie.ImageProvider},
+	} {
+		if choice.name == "" {
+			continue
+		}
 
-	if err := os.RemoveAll(abspath); err != nil {
-		return err
+		if !s.providers.Has(choice.kind, choice.name) {
+			return fmt.Errorf("unknown %s provider %s", choice.kind, choice.name)
+		}
+
+		*choice.field = sql.NullString{String: choice.name, Valid: true}
 	}
 
-	if err := os.MkdirAll(filepath.Dir(abspath), 0777); err != nil {
-		return err
+	return nil
+}
+
+// respondJob enqueues a job and answers 202 with it, the client polls
+// GET /api/jobs/:job_id for the outcome.
+func (s *Server) respondJob(c *gin.Context, movieId int64, kind string, payload interface{}) {
+	job, err := s.enqueue(movieId, kind, payload)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := ioutil.WriteFile(abspath, content, 0777); err != nil {
-		return err
+	c.JSON(http.StatusAccepted, gin.H{"data": job})
+}
+
+// serveMovieFile sends fp, relative to the workdir, or 404 when it does not
+// exist yet.
+func (s *Server) serveMovieFile(c *gin.Context, fp, contentType string) {
+	abspath := filepath.Join(s.workdir, fp)
+	if _, err := os.Stat(abspath); err != nil {
+		c.JSON(404, gin.H{"error": "File not found"})
+		return
 	}
 
-	return nil
+	c.Header("Content-Type", contentType)
+	c.File(abspath)
 }
@@ -0,0 +1,1406 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	os.Exit(m.Run())
+}
+
+// stubScript is a ScriptGenerator returning a fixed answer.
+type stubScript struct {
+	out string
+	err error
+}
+
+func (s *stubScript) GenerateScript(ctx context.Context, req ai.ScriptRequest) (string, error) {
+	return s.out, s.err
+}
+
+// recorder is a ScriptGenerator which remembers its last request.
+type recorder struct {
+	mu   sync.Mutex
+	last ai.ScriptRequest
+}
+
+func (r *recorder) GenerateScript(ctx context.Context, req ai.ScriptRequest) (string, error) {
+	r.mu.Lock()
+	r.last = req
+	r.mu.Unlock()
+
+	return ai.NewFake().GenerateScript(ctx, req)
+}
+
+func (r *recorder) request() ai.ScriptRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last
+}
+
+// assetRecorder is a fake speech and image provider which remembers what
+// it was asked for.
+type assetRecorder struct {
+	mu     sync.Mutex
+	voice  string
+	prompt string
+}
+
+func (r *assetRecorder) GenerateAudio(ctx context.Context, text string, opts ai.SpeechOptions) ([]byte, error) {
+	r.mu.Lock()
+	r.voice = opts.Voice
+	r.mu.Unlock()
+
+	return ai.NewFake().GenerateAudio(ctx, text, opts)
+}
+
+func (r *assetRecorder) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	r.mu.Lock()
+	r.prompt = prompt
+	r.mu.Unlock()
+
+	return ai.NewFake().GenerateImage(ctx, prompt)
+}
+
+func (r *assetRecorder) last() (voice, prompt string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.voice, r.prompt
+}
+
+// failing implements every provider interface and always fails.
+type failing struct{}
+
+func (failing) GenerateAudio(ctx context.Context, text string, opts ai.SpeechOptions) ([]byte, error) {
+	return nil, errors.New("speech provider down")
+}
+
+func (failing) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	return nil, errors.New("image provider down")
+}
+
+type testEnv struct {
+	t       *testing.T
+	server  *Server
+	http    *httptest.Server
+	workdir string
+	cancel  context.CancelFunc
+}
+
+// newTestEnv runs a Server with started job workers, see newIdleTestEnv.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	e := newIdleTestEnv(t)
+	e.startWorkers()
+
+	return e
+}
+
+// newIdleTestEnv runs a Server in process on a temp sqlite file and
+// workdir without job workers. The fake providers are the defaults,
+// "broken" script/speech/image providers always fail and "garbage" returns
+// malformed script output.
+func newIdleTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	workdir := t.TempDir()
+	if err := model.Init(filepath.Join(workdir, "mpu.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	providers := ai.NewRegistry()
+	mustNil(t, providers.Add(ai.FakeProvider, ai.NewFake()))
+	mustNil(t, providers.Add("broken", failing{}))
+	mustNil(t, providers.Add("broken", &stubScript{err: errors.New("llm provider down")}))
+	mustNil(t, providers.Add("garbage", &stubScript{out: "sorry, here is your script: {"}))
+	for _, kind := range []string{ai.KindScript, ai.KindSpeech, ai.KindImage} {
+		mustNil(t, providers.SetDefault(kind, ai.FakeProvider))
+	}
+
+	s := New("", workdir, 2, providers)
+	ts := httptest.NewServer(s.Handler())
+	e := &testEnv{t: t, server: s, http: ts, workdir: workdir, cancel: func() {}}
+	t.Cleanup(func() {
+		ts.Close()
+		e.cancel()
+		s.Wait()
+		model.Close()
+	})
+
+	return e
+}
+
+func (e *testEnv) startWorkers() {
+	e.t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	mustNil(e.t, e.server.StartWorkers(ctx))
+}
+
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type response struct {
+	Data  json.RawMessage `json:"data"`
+	Error string          `json:"error"`
+	Total int64           `json:"total"`
+}
+
+func (e *testEnv) do(method, path string, body interface{}) (int, *response) {
+	e.t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(b)
+	default:
+		raw, err := json.Marshal(b)
+		mustNil(e.t, err)
+		reader = bytes.NewBuffer(raw)
+	}
+
+	req, err := http.NewRequest(method, e.http.URL+path, reader)
+	mustNil(e.t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	mustNil(e.t, err)
+	defer resp.Body.Close()
+
+	var r response
+	raw, err := io.ReadAll(resp.Body)
+	mustNil(e.t, err)
+	if err := json.Unmarshal(raw, &r); err != nil {
+		e.t.Fatalf("%s %s: invalid json response %q", method, path, raw)
+	}
+
+	return resp.StatusCode, &r
+}
+
+// expect performs the request and fails the test unless it answers status,
+// the data field is decoded into out when given.
+func (e *testEnv) expect(status int, method, path string, body interface{}, out interface{}) *response {
+	e.t.Helper()
+
+	code, r := e.do(method, path, body)
+	if code != status {
+		e.t.Fatalf("%s %s: expected status %d, got %d: %s %s", method, path, status, code, r.Error, r.Data)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(r.Data, out); err != nil {
+			e.t.Fatalf("%s %s: failed to decode data %s: %v", method, path, r.Data, err)
+		}
+	}
+
+	return r
+}
+
+type jobView struct {
+	Id       int64  `json:"id"`
+	MovieId  int64  `json:"movie_id"`
+	Kind     string `json:"kind"`
+	State    string `json:"state"`
+	Progress int    `json:"progress"`
+	Total    int    `json:"total"`
+	Error    string `json:"error"`
+}
+
+type movieView struct {
+	Id             int64  `json:"id"`
+	TplName        string `json:"tpl_name"`
+	State          string `json:"state"`
+	Idea           string `json:"idea"`
+	Script         string `json:"script"`
+	ImageProvider  string `json:"image_provider"`
+	SpeechProvider string `json:"speech_provider"`
+	ScriptProvider string `json:"script_provider"`
+}
+
+func (m *movieView) script(t *testing.T) *model.MovieScript {
+	t.Helper()
+
+	var script model.MovieScript
+	if err := json.Unmarshal([]byte(m.Script), &script); err != nil {
+		t.Fatalf("movie %d has no valid script: %v", m.Id, err)
+	}
+
+	return &script
+}
+
+// runJob posts to a generation route, waits for the job and returns it.
+func (e *testEnv) runJob(path string, body interface{}) *jobView {
+	e.t.Helper()
+
+	var job jobView
+	e.expect(http.StatusAccepted, http.MethodPost, path, body, &job)
+	if job.Id == 0 || job.State != model.JobStatePending.String() {
+		e.t.Fatalf("POST %s: unexpected job %+v", path, job)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/jobs/%d", job.Id), nil, &job)
+		if job.State == model.JobStateSucceeded.String() || job.State == model.JobStateFailed.String() {
+			return &job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	e.t.Fatalf("job %d of POST %s did not finish: %+v", job.Id, path, job)
+	return nil
+}
+
+func (e *testEnv) mustSucceed(job *jobView) {
+	e.t.Helper()
+	if job.State != model.JobStateSucceeded.String() {
+		e.t.Fatalf("job %d %s failed: %s", job.Id, job.Kind, job.Error)
+	}
+}
+
+func (e *testEnv) createMovie(body interface{}) *movieView {
+	e.t.Helper()
+
+	var movie movieView
+	e.expect(http.StatusCreated, http.MethodPost, "/api/movies", body, &movie)
+	return &movie
+}
+
+func (e *testEnv) movie(id int64) *movieView {
+	e.t.Helper()
+
+	var movie movieView
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/movies/%d", id), nil, &movie)
+	return &movie
+}
+
+func TestStaticRoutes(t *testing.T) {
+	e := newTestEnv(t)
+
+	for _, path := range []string{"/ping", "/health"} {
+		code, _ := e.do(http.MethodGet, path, nil)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", path, code)
+		}
+	}
+
+	code, _ := e.do(http.MethodGet, "/api/version", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /api/version: expected 200, got %d", code)
+	}
+
+	mustNil(t, e.server.providers.Register(ai.ProviderConfig{Name: "sd", Type: "sdwebui", Endpoint: "http://127.0.0.1:1"}))
+	resp, err := http.Get(e.http.URL + "/health")
+	mustNil(t, err)
+	var health struct {
+		Message   string                      `json:"message"`
+		Providers map[string]ai.BreakerStatus `json:"providers"`
+	}
+	mustNil(t, json.NewDecoder(resp.Body).Decode(&health))
+	resp.Body.Close()
+	if health.Message != "OK" || health.Providers["sd"].State != ai.BreakerClosed {
+		t.Fatalf("health should show the breaker of every configured provider: %+v", health)
+	}
+
+	var voices []string
+	e.expect(http.StatusOK, http.MethodGet, "/api/voices_list", nil, &voices)
+	if len(voices) != len(ai.VoiceList) {
+		t.Fatalf("expected %d voices, got %v", len(ai.VoiceList), voices)
+	}
+
+	var providers map[string]struct {
+		Default string   `json:"default"`
+		Names   []string `json:"names"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, "/api/providers", nil, &providers)
+	if providers[ai.KindSpeech].Default != ai.FakeProvider || len(providers[ai.KindSpeech].Names) != 2 {
+		t.Fatalf("unexpected providers %+v", providers)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	e := newTestEnv(t)
+
+	var list []model.Template
+	e.expect(http.StatusOK, http.MethodGet, "/api/templates", nil, &list)
+	if len(list) != 1 || list[0].Name != "sign" {
+		t.Fatalf("unexpected templates %+v", list)
+	}
+
+	var tpl model.Template
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/templates/%d", list[0].Id), nil, &tpl)
+	if tpl.Name != "sign" {
+		t.Fatalf("unexpected template %+v", tpl)
+	}
+
+	e.expect(http.StatusOK, http.MethodGet, "/api/templates/default", nil, &tpl)
+	if tpl.Name != "sign" {
+		t.Fatalf("unexpected default template %+v", tpl)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodGet, "/api/templates/abc", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, "/api/templates/404", nil, nil)
+}
+
+func TestMovies(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "image_provider": "broken"})
+	if movie.Id == 0 || movie.State != model.StateInit.String() || movie.ImageProvider != "broken" {
+		t.Fatalf("unexpected movie %+v", movie)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/movies", "{", nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/movies", gin.H{"idea": "x", "tpl_name": "nope"}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/movies",
+		gin.H{"idea": "x", "tpl_name": "sign", "speech_provider": "nope"}, nil)
+
+	var list []movieView
+	r := e.expect(http.StatusOK, http.MethodGet, "/api/movies", nil, &list)
+	if len(list) != 1 || r.Total != 1 {
+		t.Fatalf("unexpected movie list %+v total %d", list, r.Total)
+	}
+
+	if got := e.movie(movie.Id); got.Idea != "金牛座" {
+		t.Fatalf("unexpected movie %+v", got)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodGet, "/api/movies/abc", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, "/api/movies/404", nil, nil)
+
+	var updated movieView
+	e.expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/movies/%d/providers", movie.Id),
+		gin.H{"image_provider": ai.FakeProvider}, &updated)
+	if updated.ImageProvider != ai.FakeProvider {
+		t.Fatalf("image provider not updated %+v", updated)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPut, fmt.Sprintf("/api/movies/%d/providers", movie.Id),
+		gin.H{"script_provider": "nope"}, nil)
+	e.expect(http.StatusNotFound, http.MethodPut, "/api/movies/404/providers", gin.H{}, nil)
+}
+
+func TestGeneratePipeline(t *testing.T) {
+	e := newTestEnv(t)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+
+	// out of order operations are refused before a job is queued
+	e.expect(http.StatusConflict, http.MethodPost, base+"/generate_voice", nil, nil)
+	e.expect(http.StatusConflict, http.MethodPost, base+"/generate_image", nil, nil)
+	e.expect(http.StatusConflict, http.MethodPost, base+"/scripts/0/generate_voice", nil, nil)
+
+	job := e.runJob(base+"/generate_script", gin.H{"idea": "金牛座女生的特点"})
+	e.mustSucceed(job)
+	if job.Progress != 1 || job.Total != 1 {
+		t.Fatalf("unexpected script job progress %+v", job)
+	}
+
+	got := e.movie(movie.Id)
+	if got.State != model.StateScripted.String() || got.Idea != "金牛座女生的特点" {
+		t.Fatalf("unexpected movie after script %+v", got)
+	}
+
+	items := len(got.script(t).ScriptItems)
+	e.expect(http.StatusConflict, http.MethodPost, base+"/scripts/0/generate_image", nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/scripts/abc/generate_voice", nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, fmt.Sprintf("%s/scripts/%d/generate_voice", base, items), nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/scripts/-1/generate_voice", nil, nil)
+
+	e.mustSucceed(e.runJob(base+"/scripts/0/generate_voice", nil))
+	if got := e.movie(movie.Id); got.State != model.StateScripted.String() || got.script(t).ScriptItems[0].VoicePath == "" {
+		t.Fatalf("unexpected movie after one voice %+v", got)
+	}
+
+	job = e.runJob(base+"/generate_voice", nil)
+	e.mustSucceed(job)
+	if job.Progress != items || job.Total != items {
+		t.Fatalf("unexpected voice job progress %+v", job)
+	}
+
+	e.mustSucceed(e.runJob(base+"/scripts/1/generate_image", nil))
+	e.mustSucceed(e.runJob(base+"/generate_image", nil))
+
+	got = e.movie(movie.Id)
+	if got.State != model.StateIllustrated.String() {
+		t.Fatalf("unexpected movie state %s", got.State)
+	}
+
+	for i, item := range got.script(t).ScriptItems {
+		for _, fp := range []string{item.VoicePath, item.ImagePath} {
+			if _, err := os.Stat(filepath.Join(e.workdir, fp)); err != nil {
+				t.Fatalf("item %d asset %q missing: %v", i, fp, err)
+			}
+		}
+	}
+
+	var transitions []model.StateTransition
+	e.expect(http.StatusOK, http.MethodGet, base+"/states", nil, &transitions)
+	if len(transitions) != 3 || transitions[2].ToState != model.StateIllustrated.String() {
+		t.Fatalf("unexpected transitions %+v", transitions)
+	}
+
+	var jobs []jobView
+	e.expect(http.StatusOK, http.MethodGet, base+"/jobs", nil, &jobs)
+	if len(jobs) != 5 {
+		t.Fatalf("expected 5 jobs, got %+v", jobs)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodGet, "/api/jobs/abc", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, "/api/jobs/404", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, "/api/movies/404/jobs", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodPost, "/api/movies/404/generate_script", gin.H{}, nil)
+}
+
+func TestGenerateScriptFailures(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "script_provider": "garbage"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/generate_script", "{", nil)
+
+	job := e.runJob(base+"/generate_script", gin.H{})
+	if job.State != model.JobStateFailed.String() || !strings.Contains(job.Error, "invalid after 3 attempts") {
+		t.Fatalf("malformed llm output should fail the job: %+v", job)
+	}
+
+	if got := e.movie(movie.Id); got.Script != "" || got.State != model.StateInit.String() {
+		t.Fatalf("malformed llm output must not be saved: %+v", got)
+	}
+
+	e.expect(http.StatusOK, http.MethodPut, base+"/providers", gin.H{"script_provider": "broken"}, nil)
+	job = e.runJob(base+"/generate_script", gin.H{})
+	if job.State != model.JobStateFailed.String() || job.Error != "llm provider down" {
+		t.Fatalf("provider failure should fail the job: %+v", job)
+	}
+}
+
+func TestGenerateScriptRepaired(t *testing.T) {
+	e := newTestEnv(t)
+
+	fake, err := ai.NewFake().GenerateScript(context.Background(), ai.ScriptRequest{})
+	mustNil(t, err)
+	mustNil(t, e.server.providers.Add("fenced", &stubScript{out: "```json\n" + fake + "\n```"}))
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "script_provider": "fenced"})
+	e.mustSucceed(e.runJob(fmt.Sprintf("/api/movies/%d/generate_script", movie.Id), gin.H{}))
+
+	if got := e.movie(movie.Id); strings.Contains(got.Script, "```") || len(got.script(t).ScriptItems) != 4 {
+		t.Fatalf("fenced llm output should be saved as clean json: %+v", got)
+	}
+}
+
+func TestGenerateAssetFailures(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "speech_provider": "broken"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+
+	for _, path := range []string{"/generate_voice", "/scripts/0/generate_voice"} {
+		job := e.runJob(base+path, nil)
+		if job.State != model.JobStateFailed.String() || !strings.HasSuffix(job.Error, "speech provider down") {
+			t.Fatalf("POST %s: provider failure should fail the job: %+v", path, job)
+		}
+	}
+
+	if got := e.movie(movie.Id); got.State != model.StateScripted.String() {
+		t.Fatalf("failed voice generation must not advance the movie: %+v", got)
+	}
+
+	e.expect(http.StatusOK, http.MethodPut, base+"/providers",
+		gin.H{"speech_provider": ai.FakeProvider, "image_provider": "broken"}, nil)
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+
+	for _, path := range []string{"/generate_image", "/scripts/0/generate_image"} {
+		job := e.runJob(base+path, nil)
+		if job.State != model.JobStateFailed.String() || !strings.HasSuffix(job.Error, "image provider down") {
+			t.Fatalf("POST %s: provider failure should fail the job: %+v", path, job)
+		}
+	}
+}
+
+// flaky is a speech and image provider which fails the text fail and
+// remembers how many calls it served at once.
+type flaky struct {
+	fail string
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (f *flaky) call(text string) error {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.max {
+		f.max = f.inFlight
+	}
+	f.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inFlight--
+	if text == f.fail {
+		return errors.New("flaky provider failed")
+	}
+	return nil
+}
+
+func (f *flaky) GenerateAudio(ctx context.Context, text string, opts ai.SpeechOptions) ([]byte, error) {
+	if err := f.call(text); err != nil {
+		return nil, err
+	}
+	return ai.NewFake().GenerateAudio(ctx, text, opts)
+}
+
+func (f *flaky) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	if err := f.call(prompt); err != nil {
+		return nil, err
+	}
+	return ai.NewFake().GenerateImage(ctx, prompt)
+}
+
+func (f *flaky) maxInFlight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.max
+}
+
+func TestGenerateItemsInParallel(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+	script := e.movie(movie.Id).script(t)
+
+	provider := &flaky{fail: script.ScriptItems[1].ZhSubtitle}
+	mustNil(t, e.server.providers.Add("flaky", provider))
+	e.server.providers.SetConcurrency("flaky", 2)
+	e.expect(http.StatusOK, http.MethodPut, base+"/providers", gin.H{"speech_provider": "flaky"}, nil)
+
+	job := e.runJob(base+"/generate_voice", nil)
+	if job.State != model.JobStateFailed.String() || !strings.HasPrefix(job.Error, "1 of 4 items failed: item 1: ") {
+		t.Fatalf("one failed item should fail the job: %+v", job)
+	}
+	if job.Progress != 4 || job.Total != 4 {
+		t.Fatalf("every item should be counted: %+v", job)
+	}
+	if n := provider.maxInFlight(); n != 2 {
+		t.Fatalf("expected the provider limit of 2 calls at once to be reached, got %d", n)
+	}
+
+	got := e.movie(movie.Id)
+	for i, item := range got.script(t).ScriptItems {
+		want := model.ItemStatusDone
+		if i == 1 {
+			want = model.ItemStatusFailed
+		}
+		if item.VoiceStatus != want || (want == model.ItemStatusDone) != (item.VoicePath != "") {
+			t.Fatalf("item %d: expected voice %s: %+v", i, want, item)
+		}
+	}
+	if got.State != model.StateScripted.String() {
+		t.Fatalf("a missing voice must keep the movie scripted: %+v", got)
+	}
+
+	// only the failed item is left to do
+	provider.mu.Lock()
+	provider.fail = ""
+	provider.mu.Unlock()
+	e.mustSucceed(e.runJob(base+"/scripts/1/generate_voice", nil))
+	if got := e.movie(movie.Id); got.State != model.StateVoiced.String() {
+		t.Fatalf("the last voice should advance the movie: %+v", got)
+	}
+}
+
+func TestSubtitles(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+	e.expect(http.StatusConflict, http.MethodGet, base+"/subtitles", nil, nil)
+
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+	e.expect(http.StatusBadRequest, http.MethodGet, base+"/subtitles?format=sub", nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodGet, base+"/subtitles?lang=jp", nil, nil)
+
+	items := len(e.movie(movie.Id).script(t).ScriptItems)
+	for format, want := range map[string]string{"srt": " --> ", "vtt": " --> ", "ass": "Dialogue: "} {
+		resp, err := http.Get(e.http.URL + base + "/subtitles?lang=both&format=" + format)
+		mustNil(t, err)
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		mustNil(t, err)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", format, resp.StatusCode, raw)
+		}
+
+		n := strings.Count(string(raw), want)
+		if format == "ass" {
+			n /= 2 // one event per language
+		}
+		if n != items {
+			t.Fatalf("%s: expected %d cues:\n%s", format, items, raw)
+		}
+	}
+
+	// the fake voice of the first item, 11 characters at 6 per second, is
+	// 1.836s of 36ms frames
+	resp, err := http.Get(e.http.URL + base + "/subtitles?lang=cn")
+	mustNil(t, err)
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(raw), "1\n00:00:00,000 --> 00:00:01,836\n") ||
+		!strings.Contains(string(raw), "2\n00:00:02,136 --> ") {
+		t.Fatalf("unexpected srt timing:\n%s", raw)
+	}
+}
+
+func TestMovieDuration(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/movies", gin.H{"tpl_name": "sign", "target_duration_ms": -1}, nil)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "target_duration_ms": 60000})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+
+	var got struct {
+		DurationMs       int64  `json:"duration_ms"`
+		TargetDurationMs int64  `json:"target_duration_ms"`
+		DurationWarning  string `json:"duration_warning"`
+		Script           string `json:"script"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &got)
+	if got.DurationMs != 0 || got.TargetDurationMs != 60000 || got.DurationWarning != "" {
+		t.Fatalf("unexpected movie before voices %+v", got)
+	}
+
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &got)
+
+	var script model.MovieScript
+	mustNil(t, json.Unmarshal([]byte(got.Script), &script))
+	var end int64
+	for i, item := range script.ScriptItems {
+		if item.DurationMs <= 0 || item.StartMs < end {
+			t.Fatalf("item %d is not timed: %+v", i, item)
+		}
+		end = item.StartMs + item.DurationMs
+	}
+
+	if got.DurationMs != end || !strings.Contains(got.DurationWarning, "shorter than the target 1m0s") {
+		t.Fatalf("unexpected movie duration %+v", got)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	e := newTestEnv(t)
+	rec := &recorder{}
+	mustNil(t, e.server.providers.Add("recorder", rec))
+
+	var presets []struct {
+		Name             string `json:"name"`
+		Aspect           string `json:"aspect"`
+		TargetDurationMs int64  `json:"target_duration_ms"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, "/api/presets", nil, &presets)
+	if len(presets) != 4 || presets[0].Name != model.DefaultPresetName || presets[3].Aspect != "16:9" {
+		t.Fatalf("unexpected presets %+v", presets)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/movies", gin.H{"tpl_name": "sign", "preset": "tiktok"}, nil)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "preset": "douyin", "script_provider": "recorder"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+	req := rec.request()
+	if req.Duration != time.Minute || req.WordCount() != 432 || req.MaxSubtitleChars != 16 || req.MaxSubtitleWords != 10 {
+		t.Fatalf("douyin preset not applied to the script request %+v", req)
+	}
+
+	// the voice is read at 1.2x, 11 characters at 7.2 per second are 43
+	// frames of 36ms
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+	if item := e.movie(movie.Id).script(t).ScriptItems[0]; item.DurationMs != 1548 {
+		t.Fatalf("douyin speech speed not applied %+v", item)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/generate_script", gin.H{"preset": "tiktok"}, nil)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{"preset": "bilibili", "target_duration_ms": 90000}))
+	if req := rec.request(); req.Duration != 90*time.Second || req.WordCount() != 540 {
+		t.Fatalf("per request duration not applied %+v", req)
+	}
+
+	var got struct {
+		Preset           string `json:"preset"`
+		TargetDurationMs int64  `json:"target_duration_ms"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &got)
+	if got.Preset != "bilibili" || got.TargetDurationMs != 90000 {
+		t.Fatalf("unexpected movie after preset change %+v", got)
+	}
+}
+
+func TestRequeueInterruptedJobs(t *testing.T) {
+	e := newIdleTestEnv(t)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+
+	// a job left running by a crashed server
+	job, err := model.NewJob(movie.Id, JobGenerateScript, nil)
+	mustNil(t, err)
+	mustNil(t, job.Create())
+	claimed, err := model.ClaimNextJob()
+	mustNil(t, err)
+	if claimed == nil || claimed.Id != job.Id {
+		t.Fatalf("expected to claim job %d, got %+v", job.Id, claimed)
+	}
+
+	// starting the workers requeues it
+	e.startWorkers()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err = model.GetJob(job.Id)
+		mustNil(t, err)
+		if job.Finished() {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if job.State != model.JobStateSucceeded.String() || job.Attempts != 2 {
+		t.Fatalf("requeued job should run again: %+v", job)
+	}
+}
+
+func TestShutdownRequeuesJobs(t *testing.T) {
+	e := newIdleTestEnv(t)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+
+	started := make(chan struct{})
+	e.server.jobFuncs["block"] = func(ctx context.Context, job *model.Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	e.startWorkers()
+
+	job, err := e.server.enqueue(movie.Id, "block", nil)
+	mustNil(t, err)
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job never started")
+	}
+
+	e.cancel()
+	e.server.Wait()
+
+	job, err = model.GetJob(job.Id)
+	mustNil(t, err)
+	if job.State != model.JobStatePending.String() || job.Attempts != 0 {
+		t.Fatalf("a job interrupted by shutdown should be requeued: %+v", job)
+	}
+}
+
+func TestScriptStages(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d/script_stages", movie.Id)
+
+	e.expect(http.StatusBadRequest, http.MethodPost, base, gin.H{"stages": []string{"spin"}}, nil)
+
+	job := e.runJob(base, gin.H{"stages": []string{"translate"}})
+	if job.State != model.JobStateFailed.String() || !strings.Contains(job.Error, "needs stage segment first") {
+		t.Fatalf("a stage should not run before the one it needs: %+v", job)
+	}
+
+	e.mustSucceed(e.runJob(base, gin.H{"stages": []string{"outline", "draft", "segment"}}))
+	if got := e.movie(movie.Id); got.Script != "" || got.State != model.StateInit.String() {
+		t.Fatalf("unfinished stages must not replace the script: %+v", got)
+	}
+
+	job = e.runJob(base, gin.H{"stages": []string{"image_prompts", "translate"}})
+	e.mustSucceed(job)
+	if job.Total != 2 {
+		t.Fatalf("expected 2 stages to run, got %+v", job)
+	}
+
+	got := e.movie(movie.Id)
+	if script := got.script(t); got.State != model.StateScripted.String() || len(script.ScriptItems) != 4 ||
+		script.ScriptItems[3].EnSubtitle != "sincerity is their greatest charm" {
+		t.Fatalf("finished stages should make the script: %+v", got)
+	}
+
+	var stages struct {
+		Stages []struct {
+			Name string `json:"name"`
+			Done bool   `json:"done"`
+		} `json:"stages"`
+		Artifacts model.ScriptArtifacts `json:"artifacts"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &stages)
+	if len(stages.Stages) != 5 || !stages.Stages[4].Done || len(stages.Artifacts.Outline) != 3 {
+		t.Fatalf("unexpected stages %+v", stages)
+	}
+
+	// running a stage again drops what was built on it
+	e.expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/movies/%d/providers", movie.Id), gin.H{"script_provider": "broken"}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, base, gin.H{}, nil)
+	e.expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/movies/%d/providers", movie.Id), gin.H{"script_provider": ai.FakeProvider}, nil)
+	e.mustSucceed(e.runJob(base, gin.H{"stages": []string{"segment"}}))
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &stages)
+	if !stages.Stages[2].Done || stages.Stages[3].Done || stages.Stages[4].Done {
+		t.Fatalf("segment should clear translations and image prompts %+v", stages)
+	}
+}
+
+func TestScriptStagesKeepAssets(t *testing.T) {
+	e := newTestEnv(t)
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/script_stages", gin.H{}))
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+	before := e.movie(movie.Id).script(t)
+
+	// the chinese text stays, so do the voices
+	e.mustSucceed(e.runJob(base+"/script_stages", gin.H{"stages": []string{"translate"}}))
+	got := e.movie(movie.Id)
+	if got.State != model.StateVoiced.String() {
+		t.Fatalf("re-running translate should keep the movie voiced, got %s", got.State)
+	}
+
+	script := got.script(t)
+	for i, item := range script.ScriptItems {
+		if item.VoicePath == "" || item.VoicePath != before.ScriptItems[i].VoicePath || item.VoiceAsset == 0 {
+			t.Fatalf("item %d lost its voice %+v", i, item)
+		}
+	}
+}
+
+func TestTemplateDefinitions(t *testing.T) {
+	e := newTestEnv(t)
+	rec, assets := &recorder{}, &assetRecorder{}
+	mustNil(t, e.server.providers.Add("recorder", rec))
+	mustNil(t, e.server.providers.Add("assets", assets))
+
+	layout := model.NewRenderSpec(1080, 1920).Layout
+	layout.Subtitle.Y = 1500
+	tpl := gin.H{
+		"name":          "story",
+		"system_prompt": "讲一个关于{{.Idea}}的故事，大约 {{.WordCount}} 字，每条字幕不超过 {{.MaxSubtitleChars}} 字",
+		"image_style":   "水彩画",
+		"voice":         "anna",
+		"preset":        "douyin",
+		"layout":        layout,
+	}
+
+	var created struct {
+		Id     int64              `json:"id"`
+		Preset string             `json:"preset"`
+		Layout model.RenderLayout `json:"layout"`
+	}
+	e.expect(http.StatusCreated, http.MethodPost, "/api/templates", tpl, &created)
+	if created.Preset != "douyin" || created.Layout.Subtitle.Y != 1500 {
+		t.Fatalf("unexpected template %+v", created)
+	}
+	e.expect(http.StatusConflict, http.MethodPost, "/api/templates", tpl, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/templates", gin.H{"name": "bad", "system_prompt": "{{.Nope}}"}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/templates", gin.H{"name": "bad", "preset": "tiktok"}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, "/api/templates", gin.H{"name": "bad", "layout": gin.H{"padding": "wide"}}, nil)
+
+	base := fmt.Sprintf("/api/templates/%d", created.Id)
+	e.expect(http.StatusBadRequest, http.MethodPut, base, gin.H{"name": "renamed"}, nil)
+	e.expect(http.StatusOK, http.MethodPut, base, gin.H{"image_style": "油画"}, nil)
+
+	var movie struct {
+		Id      int64  `json:"id"`
+		TplName string `json:"tpl_name"`
+		Preset  string `json:"preset"`
+	}
+	e.expect(http.StatusCreated, http.MethodPost, "/api/movies", gin.H{
+		"idea": "金牛座", "tpl_name": "story",
+		"script_provider": "recorder", "speech_provider": "assets", "image_provider": "assets",
+	}, &movie)
+	if movie.TplName != "story" || movie.Preset != "douyin" {
+		t.Fatalf("template not applied to the movie %+v", movie)
+	}
+
+	movieBase := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(movieBase+"/generate_script", gin.H{}))
+	if req := rec.request(); req.SystemPrompt != tpl["system_prompt"] {
+		t.Fatalf("template prompt not used %+v", req)
+	}
+	prompt, err := ai.BuildSystemPrompt(rec.request())
+	mustNil(t, err)
+	if prompt != "讲一个关于金牛座的故事，大约 432 字，每条字幕不超过 16 字" {
+		t.Fatalf("unexpected system prompt %q", prompt)
+	}
+
+	e.mustSucceed(e.runJob(movieBase+"/generate_voice", nil))
+	e.mustSucceed(e.runJob(movieBase+"/generate_image", nil))
+	if voice, prompt := assets.last(); voice != "anna" || !strings.HasSuffix(prompt, "，油画") {
+		t.Fatalf("template voice and style not used: %q %q", voice, prompt)
+	}
+
+	// subtitles sit where the template layout draws them
+	resp, err := http.Get(e.http.URL + movieBase + "/subtitles?format=ass")
+	mustNil(t, err)
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	mustNil(t, err)
+	if !strings.Contains(string(raw), ",10,10,360,1\n") {
+		t.Fatalf("template layout not used by subtitles:\n%s", raw)
+	}
+
+	e.expect(http.StatusConflict, http.MethodDelete, base, nil, nil)
+	var sign struct {
+		Id         int64  `json:"id"`
+		ImageStyle string `json:"image_style"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, "/api/templates/default", nil, &sign)
+	if !strings.HasPrefix(sign.ImageStyle, "火柴人") {
+		t.Fatalf("the sign template should carry the stick figure style %+v", sign)
+	}
+	e.expect(http.StatusConflict, http.MethodDelete, fmt.Sprintf("/api/templates/%d", sign.Id), nil, nil)
+
+	var unused struct {
+		Id int64 `json:"id"`
+	}
+	e.expect(http.StatusCreated, http.MethodPost, "/api/templates", gin.H{"name": "unused"}, &unused)
+	e.expect(http.StatusOK, http.MethodDelete, fmt.Sprintf("/api/templates/%d", unused.Id), nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, fmt.Sprintf("/api/templates/%d", unused.Id), nil, nil)
+}
+
+func TestEditScript(t *testing.T) {
+	e := newTestEnv(t)
+	movie, base := e.illustrate()
+	before := e.movie(movie.Id).script(t)
+	items := len(before.ScriptItems)
+
+	// edits answer the whole script, decoded fresh as emptied paths are left out
+	edit := func(method, path string, body interface{}) model.MovieScript {
+		var script model.MovieScript
+		e.expect(http.StatusOK, method, base+path, body, &script)
+		return script
+	}
+
+	script := edit(http.MethodPut, "/scripts/0", gin.H{"en": "new words"})
+	if got := e.movie(movie.Id); got.State != model.StateIllustrated.String() ||
+		script.ScriptItems[0].EnSubtitle != "new words" || script.ScriptItems[0].VoicePath != before.ScriptItems[0].VoicePath {
+		t.Fatalf("english edits keep the assets %s %+v", got.State, script.ScriptItems[0])
+	}
+
+	// a new item has no assets yet, dropping it again restores the state
+	script = edit(http.MethodPost, "/scripts", gin.H{"index": 1, "cn": "插入的字幕", "en": "inserted"})
+	if got := e.movie(movie.Id); got.State != model.StateScripted.String() || len(script.ScriptItems) != items+1 ||
+		script.ScriptItems[1].ZhSubtitle != "插入的字幕" {
+		t.Fatalf("unexpected script after insert %s %+v", got.State, script)
+	}
+	script = edit(http.MethodDelete, "/scripts/1", nil)
+	if got := e.movie(movie.Id); got.State != model.StateIllustrated.String() || len(script.ScriptItems) != items {
+		t.Fatalf("unexpected movie after delete %s", got.State)
+	}
+
+	script = edit(http.MethodPut, "/scripts/0", gin.H{"cn": "新的字幕内容"})
+	if item := script.ScriptItems[0]; item.VoicePath != "" || item.ImagePath != before.ScriptItems[0].ImagePath {
+		t.Fatalf("a new chinese subtitle drops the voice only %+v", item)
+	}
+	if got := e.movie(movie.Id); got.State != model.StateScripted.String() {
+		t.Fatalf("unexpected state after edit %s", got.State)
+	}
+
+	e.mustSucceed(e.runJob(base+"/scripts/0/generate_voice", nil))
+	voice := e.movie(movie.Id).script(t).ScriptItems[0].VoicePath
+	if !strings.HasPrefix(voice, "cas/") || voice == before.ScriptItems[0].VoicePath {
+		t.Fatalf("voice files are stored by content, got %q", voice)
+	}
+
+	script = edit(http.MethodPost, "/scripts/0/split", gin.H{"at": 2, "en": []string{"new", "words"}})
+	if len(script.ScriptItems) != items+1 || script.ScriptItems[0].ZhSubtitle != "新的" ||
+		script.ScriptItems[1].ZhSubtitle != "字幕内容" || script.ScriptItems[1].VoicePath != "" ||
+		script.ScriptItems[1].ImagePath != before.ScriptItems[0].ImagePath {
+		t.Fatalf("unexpected script after split %+v", script.ScriptItems[:2])
+	}
+
+	script = edit(http.MethodPost, "/scripts/0/merge", nil)
+	if len(script.ScriptItems) != items || script.ScriptItems[0].ZhSubtitle != "新的字幕内容" ||
+		script.ScriptItems[0].EnSubtitle != "new words" {
+		t.Fatalf("unexpected script after merge %+v", script.ScriptItems[0])
+	}
+
+	order := make([]int, items)
+	for i := range order {
+		order[i] = items - 1 - i
+	}
+	script = edit(http.MethodPost, "/scripts/reorder", gin.H{"order": order})
+	if script.ScriptItems[items-1].ZhSubtitle != "新的字幕内容" {
+		t.Fatalf("unexpected script after reorder %+v", script)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/scripts/reorder", gin.H{"order": []int{0, 0}}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/scripts/0/split", gin.H{"at": 100}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, fmt.Sprintf("%s/scripts/%d/merge", base, items-1), nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodDelete, fmt.Sprintf("%s/scripts/%d", base, items), nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodPut, base+"/scripts/abc", gin.H{}, nil)
+	e.expect(http.StatusBadRequest, http.MethodPost, base+"/scripts", gin.H{"index": items + 1, "cn": "字幕"}, nil)
+	e.expect(http.StatusNotFound, http.MethodPut, "/api/movies/404/scripts/0", gin.H{}, nil)
+
+	fresh := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	e.expect(http.StatusConflict, http.MethodPut, fmt.Sprintf("/api/movies/%d/scripts/0", fresh.Id), gin.H{"en": "x"}, nil)
+}
+
+func TestMovieETag(t *testing.T) {
+	e := newTestEnv(t)
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign"})
+	path := fmt.Sprintf("%s/api/movies/%d", e.http.URL, movie.Id)
+
+	send := func(method, url string, header http.Header, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		mustNil(t, err)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		mustNil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	etag := send(http.MethodGet, path, http.Header{}, "").Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("movie served without ETag")
+	}
+
+	if resp := send(http.MethodGet, path, http.Header{"If-None-Match": {etag}}, ""); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", resp.StatusCode)
+	}
+
+	// If-Match compares strongly, If-None-Match weakly
+	if resp := send(http.MethodPut, path+"/providers", http.Header{"If-Match": {"W/" + etag}}, "{}"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a weak If-Match, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, path, http.Header{"If-None-Match": {"W/" + etag}}, ""); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 for a weak If-None-Match, got %d", resp.StatusCode)
+	}
+
+	providers := `{"image_provider": "fake"}`
+	resp := send(http.MethodPut, path+"/providers", http.Header{"If-Match": {etag}}, providers)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag || resp.Header.Get("ETag") == "" {
+		t.Fatalf("expected a new version, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// the old version no longer matches
+	if resp := send(http.MethodPut, path+"/providers", http.Header{"If-Match": {etag}}, providers); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale If-Match, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodPost, path+"/generate_script", http.Header{"If-Match": {etag}}, "{}"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale If-Match, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, path, http.Header{"If-None-Match": {etag}}, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the changed movie, got %d", resp.StatusCode)
+	}
+}
+
+func TestScriptFallbacks(t *testing.T) {
+	e := newTestEnv(t)
+	mustNil(t, e.server.providers.SetScriptFallbacks([]ai.ScriptLink{{Provider: "garbage"}, {Provider: ai.FakeProvider}}))
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "script_provider": "broken"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+
+	var got struct {
+		ScriptModel string `json:"script_model"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, base, nil, &got)
+	if got.ScriptModel != ai.FakeProvider {
+		t.Fatalf("the movie should record the model which wrote the script, got %q", got.ScriptModel)
+	}
+
+	mustNil(t, e.server.providers.SetScriptFallbacks([]ai.ScriptLink{{Provider: "garbage"}}))
+	job := e.runJob(base+"/generate_script", gin.H{})
+	if job.State != model.JobStateFailed.String() || !strings.HasPrefix(job.Error, "every script model failed: broken: llm provider down; garbage: ") {
+		t.Fatalf("a failed chain should name every model: %+v", job)
+	}
+}
+
+func TestCosts(t *testing.T) {
+	e := newTestEnv(t)
+	e.server.SetPrices(&model.PriceTable{Currency: "CNY", Prices: []model.Price{
+		{Provider: ai.FakeProvider, Characters: 100, Images: 0.5},
+	}})
+	movie, base := e.illustrate()
+	script := e.movie(movie.Id).script(t)
+
+	var calls []model.AICall
+	e.expect(http.StatusOK, http.MethodGet, base+"/ai_calls", nil, &calls)
+	if len(calls) != 1+2*len(script.ScriptItems) {
+		t.Fatalf("expected a call per script and per item asset, got %d", len(calls))
+	}
+	last := calls[0]
+	if last.Kind != ai.KindImage || last.Provider != ai.FakeProvider || last.Status != model.CallStatusOK ||
+		last.MovieId == nil || *last.MovieId != movie.Id || last.ItemIndex == nil || last.Images != 1 || last.PromptHash == "" {
+		t.Fatalf("unexpected image call %+v", last)
+	}
+	if first := calls[len(calls)-1]; first.Kind != ai.KindScript || first.ItemIndex != nil {
+		t.Fatalf("the script call belongs to no item: %+v", first)
+	}
+
+	chars := 0
+	for _, item := range script.ScriptItems {
+		chars += len([]rune(item.ZhSubtitle))
+	}
+	want := float64(chars)*100/1000 + float64(len(script.ScriptItems))*0.5
+
+	var costs struct {
+		Data     []model.CallUsage `json:"data"`
+		Cost     float64           `json:"cost"`
+		Currency string            `json:"currency"`
+	}
+	resp, err := http.Get(e.http.URL + base + "/costs")
+	mustNil(t, err)
+	mustNil(t, json.NewDecoder(resp.Body).Decode(&costs))
+	resp.Body.Close()
+	if len(costs.Data) != 3 || costs.Currency != "CNY" || math.Abs(costs.Cost-want) > 1e-9 {
+		t.Fatalf("expected a cost of %v, got %+v", want, costs)
+	}
+
+	var days []struct {
+		Day  string  `json:"day"`
+		Cost float64 `json:"cost"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, "/api/costs", nil, &days)
+	if len(days) != 1 || days[0].Day != time.Now().UTC().Format(time.DateOnly) || math.Abs(days[0].Cost-want) > 1e-9 {
+		t.Fatalf("expected today to cost %v, got %+v", want, days)
+	}
+	e.expect(http.StatusBadRequest, http.MethodGet, "/api/costs?from=yesterday", nil, nil)
+}
+
+func TestAssetCache(t *testing.T) {
+	e := newTestEnv(t)
+	movie, base := e.illustrate()
+	before := e.movie(movie.Id).script(t)
+
+	calls := func() int {
+		var calls []model.AICall
+		e.expect(http.StatusOK, http.MethodGet, base+"/ai_calls", nil, &calls)
+		return len(calls)
+	}
+	paid := calls()
+
+	e.mustSucceed(e.runJob(base+"/generate_voice", nil))
+	e.mustSucceed(e.runJob(base+"/generate_image", nil))
+	e.mustSucceed(e.runJob(base+"/scripts/0/generate_voice", nil))
+	if n := calls(); n != paid {
+		t.Fatalf("cached assets should not be generated again, %d calls after %d", n, paid)
+	}
+
+	after := e.movie(movie.Id).script(t)
+	for i, item := range after.ScriptItems {
+		if item.VoicePath != before.ScriptItems[i].VoicePath || item.ImagePath != before.ScriptItems[i].ImagePath ||
+			item.DurationMs != before.ScriptItems[i].DurationMs || !strings.HasPrefix(item.ImagePath, "cas/") {
+			t.Fatalf("item %d should point at its cached assets: %+v", i, item)
+		}
+	}
+
+	e.mustSucceed(e.runJob(base+"/generate_voice?force=true", nil))
+	if n := calls(); n != paid+len(after.ScriptItems) {
+		t.Fatalf("force should generate every voice again, %d calls after %d", n, paid)
+	}
+	e.mustSucceed(e.runJob(base+"/scripts/1/generate_image?force=true", nil))
+	if n := calls(); n != paid+len(after.ScriptItems)+1 {
+		t.Fatalf("force should generate the image again, %d calls after %d", n, paid)
+	}
+
+	// a file removed from the cas is generated again
+	mustNil(t, os.Remove(filepath.Join(e.workdir, after.ScriptItems[2].ImagePath)))
+	e.mustSucceed(e.runJob(base+"/generate_image", nil))
+	if n := calls(); n != paid+len(after.ScriptItems)+2 {
+		t.Fatalf("a missing cached image should be generated again, %d calls after %d", n, paid)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	e := newTestEnv(t)
+	movie, base := e.illustrate()
+	script := e.movie(movie.Id).script(t)
+
+	var voices, images []model.Asset
+	e.expect(http.StatusOK, http.MethodGet, base+"/assets?kind=voice", nil, &voices)
+	e.expect(http.StatusOK, http.MethodGet, base+"/assets?kind=image", nil, &images)
+	if len(voices) == 0 || len(images) != len(script.ScriptItems) {
+		t.Fatalf("expected the voices and an image per item, got %d and %d", len(voices), len(images))
+	}
+
+	item := script.ScriptItems[0]
+	var voice, image model.Asset
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/assets/%d", item.VoiceAsset), nil, &voice)
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/assets/%d", item.ImageAsset), nil, &image)
+	if voice.Path != item.VoicePath || voice.Mime != "audio/mpeg" || voice.Size == 0 || voice.DurationMs != item.DurationMs ||
+		!strings.Contains(voice.Path, voice.Sha256) || voice.Provider != ai.FakeProvider || *voice.MovieId != movie.Id {
+		t.Fatalf("unexpected voice asset %+v", voice)
+	}
+	if image.Path != item.ImagePath || image.Kind != model.AssetImage || image.Mime != "image/png" ||
+		image.Width == 0 || image.Height == 0 {
+		t.Fatalf("unexpected image asset %+v", image)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/assets/%d/file", e.http.URL, image.Id))
+	mustNil(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" ||
+		resp.ContentLength != image.Size {
+		t.Fatalf("unexpected asset file response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// nothing is uploaded yet, the kind still filters
+	var uploads []model.Asset
+	e.expect(http.StatusOK, http.MethodGet, base+"/assets?kind=upload", nil, &uploads)
+	if len(uploads) != 0 {
+		t.Fatalf("expected no uploads, got %+v", uploads)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodGet, base+"/assets?kind=song", nil, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, "/api/assets/404", nil, nil)
+}
+
+// jpegImages is an image provider which answers jpeg.
+type jpegImages struct{}
+
+func (jpegImages) GenerateImage(ctx context.Context, prompt string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 32, 18)), nil)
+	return buf.Bytes(), err
+}
+
+func TestImageCacheKey(t *testing.T) {
+	e := newTestEnv(t)
+	mustNil(t, e.server.providers.Add("jpeg", jpegImages{}))
+	generator, err := e.server.providers.ImageGenerator("")
+	mustNil(t, err)
+
+	vertical := &model.Movie{}
+	wide := &model.Movie{Preset: sql.NullString{String: "bilibili", Valid: true}}
+	if e.server.imageKey(vertical, generator, "山") == e.server.imageKey(wide, generator, "山") {
+		t.Fatal("images drawn for another aspect ratio should not be reused")
+	}
+
+	movie := e.createMovie(gin.H{"idea": "金牛座", "tpl_name": "sign", "image_provider": "jpeg"})
+	base := fmt.Sprintf("/api/movies/%d", movie.Id)
+	for _, path := range []string{"/generate_script", "/generate_voice", "/generate_image"} {
+		e.mustSucceed(e.runJob(base+path, gin.H{}))
+	}
+
+	item := e.movie(movie.Id).script(t).ScriptItems[0]
+	var asset model.Asset
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/assets/%d", item.ImageAsset), nil, &asset)
+	if !strings.HasSuffix(item.ImagePath, ".jpg") || asset.Mime != "image/jpeg" || asset.Width != 32 {
+		t.Fatalf("jpeg images should be stored as jpeg: %s %+v", item.ImagePath, asset)
+	}
+}
+
+func TestScriptRevisions(t *testing.T) {
+	e := newTestEnv(t)
+	movie, base := e.illustrate()
+	generated := e.movie(movie.Id).script(t)
+
+	e.expect(http.StatusOK, http.MethodPut, base+"/scripts/0", gin.H{"cn": "改过的字幕"}, nil)
+	e.mustSucceed(e.runJob(base+"/generate_script", gin.H{}))
+
+	var revisions []model.ScriptRevision
+	e.expect(http.StatusOK, http.MethodGet, base+"/script_revisions", nil, &revisions)
+	if len(revisions) != 3 || revisions[0].Source != model.RevisionSourceLLM || revisions[0].Author != "fake" ||
+		!strings.Contains(revisions[0].Prompt, "[user]\n金牛座") || revisions[1].Source != model.RevisionSourceEdit {
+		t.Fatalf("unexpected revisions %+v", revisions)
+	}
+	first, edited := revisions[2].Id, revisions[1].Id
+
+	var diff model.ScriptDiff
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("%s/script_revisions/diff?from=%d&to=%d", base, first, edited), nil, &diff)
+	if len(diff.Items) != len(generated.ScriptItems) || diff.Items[0].Op != model.DiffChanged ||
+		diff.Items[0].To.ZhSubtitle != "改过的字幕" || diff.Items[1].Op != model.DiffUnchanged {
+		t.Fatalf("unexpected diff %+v", diff.Items)
+	}
+
+	// the first script comes back with the voices and images made for it
+	var script model.MovieScript
+	e.expect(http.StatusOK, http.MethodPost, fmt.Sprintf("%s/script_revisions/%d/restore", base, first), nil, &script)
+	if script.ScriptItems[0].ZhSubtitle != generated.ScriptItems[0].ZhSubtitle || script.ScriptItems[0].VoicePath == "" {
+		t.Fatalf("unexpected restored script %+v", script.ScriptItems[0])
+	}
+	if got := e.movie(movie.Id); got.State != model.StateIllustrated.String() {
+		t.Fatalf("a restored script with all assets is illustrated, got %s", got.State)
+	}
+
+	var imported model.MovieScript
+	e.expect(http.StatusOK, http.MethodPut, base+"/script", gin.H{"title": "导入", "script_items": []gin.H{
+		{"cn": "导入的字幕", "en": "imported", "voice_path": "movie/1/audio/x.mp3"},
+	}}, &imported)
+	if got := e.movie(movie.Id); got.State != model.StateScripted.String() || imported.ScriptItems[0].VoicePath != "" {
+		t.Fatalf("imported scripts start without assets of their own %s %+v", got.State, imported.ScriptItems[0])
+	}
+
+	e.expect(http.StatusOK, http.MethodGet, base+"/script_revisions", nil, &revisions)
+	if len(revisions) != 5 || revisions[0].Source != model.RevisionSourceImport || revisions[1].Source != model.RevisionSourceRestore {
+		t.Fatalf("unexpected revisions %+v", revisions)
+	}
+
+	var rev struct {
+		Script model.MovieScript `json:"script"`
+	}
+	e.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("%s/script_revisions/%d", base, edited), nil, &rev)
+	if rev.Script.ScriptItems[0].ZhSubtitle != "改过的字幕" {
+		t.Fatalf("unexpected revision %+v", rev)
+	}
+
+	e.expect(http.StatusBadRequest, http.MethodPut, base+"/script", gin.H{"script_items": []gin.H{}}, nil)
+	e.expect(http.StatusNotFound, http.MethodGet, base+"/script_revisions/404", nil, nil)
+	e.expect(http.StatusBadRequest, http.MethodGet, base+"/script_revisions/diff?from=abc", nil, nil)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cmingxu/mpu/media"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assFontName is the family of the font the composer renders with.
+const assFontName = "ZCOOL QingKe HuangYou"
+
+// subtitleCues times every script item after the real length of its voice,
+// items follow each other with the same pause the composer puts in between.
+func subtitleCues(script *model.MovieScript) []media.Cue {
+	cues := make([]media.Cue, 0, len(script.ScriptItems))
+	for _, item := range script.ScriptItems {
+		start := time.Duration(item.StartMs) * time.Millisecond
+		cues = append(cues, media.Cue{
+			Start: start,
+			End:   start + time.Duration(item.DurationMs)*time.Millisecond,
+			Cn:    item.ZhSubtitle,
+			En:    item.EnSubtitle,
+		})
+	}
+
+	return cues
+}
+
+// assOptions places the ASS tracks where the composer draws its subtitles.
+func assOptions(spec *model.RenderSpec) media.AssOptions {
+	style := func(ts model.RenderTextStyle, pos model.RenderPosition) media.AssStyle {
+		return media.AssStyle{
+			Font:       assFontName,
+			FontSize:   ts.FontSize,
+			Color:      ts.Color,
+			Background: ts.Background,
+			MarginV:    spec.Height - pos.Y - ts.LineHeight,
+		}
+	}
+
+	return media.AssOptions{
+		Width:  spec.Width,
+		Height: spec.Height,
+		Cn:     style(spec.Styles.Subtitle, spec.Layout.Subtitle),
+		En:     style(spec.Styles.Translation, spec.Layout.Translation),
+	}
+}
+
+func (s *Server) getSubtitles(c *gin.Context) {
+	format := c.DefaultQuery("format", media.FormatSRT)
+	lang := c.DefaultQuery("lang", media.LangBoth)
+	contentType, ok := media.SubtitleContentTypes[format]
+	if !ok {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid format, expected one of %v", media.SubtitleFormats)})
+		return
+	}
+
+	if lang != media.LangCn && lang != media.LangEn && lang != media.LangBoth {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid lang, expected one of %v", media.SubtitleLangs)})
+		return
+	}
+
+	movie, ok := movieParam(c)
+	if !ok {
+		return
+	}
+
+	script, err := movie.GetScript()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !script.AllVoiced() {
+		c.JSON(http.StatusConflict, gin.H{"error": "subtitles are timed by the voices, generate them first"})
+		return
+	}
+
+	if err := s.timeScript(script); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	cues := subtitleCues(script)
+
+	spec, err := movieRenderSpec(movie)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := media.WriteSubtitles(&buf, format, lang, cues, assOptions(spec)); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="movie-%d.%s.%s"`, movie.Id, lang, format))
+	c.Data(200, contentType, buf.Bytes())
+}
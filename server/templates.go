@@ -0,0 +1,183 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cmingxu/mpu/ai"
+	"github.com/cmingxu/mpu/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// templateBinding is the body of the template endpoints, fields left out of
+// an update keep their value.
+type templateBinding struct {
+	Name         *string         `json:"name"`
+	SystemPrompt *string         `json:"system_prompt"`
+	ImageStyle   *string         `json:"image_style"`
+	Voice        *string         `json:"voice"`
+	Preset       *string         `json:"preset"`
+	Layout       json.RawMessage `json:"layout"`
+	Bgm          *string         `json:"bgm"`
+	BgmVolume    *float64        `json:"bgm_volume"`
+}
+
+func (b *templateBinding) apply(tpl *model.Template) {
+	for _, f := range []struct {
+		value *string
+		field *string
+	}{
+		{b.Name, &tpl.Name},
+		{b.SystemPrompt, &tpl.SystemPrompt},
+		{b.ImageStyle, &tpl.ImageStyle},
+		{b.Voice, &tpl.Voice},
+		{b.Preset, &tpl.Preset},
+		{b.Bgm, &tpl.Bgm},
+	} {
+		if f.value != nil {
+			*f.field = *f.value
+		}
+	}
+
+	if b.BgmVolume != nil {
+		tpl.BgmVolume = *b.BgmVolume
+	}
+
+	switch {
+	case b.Layout == nil:
+	case string(b.Layout) == "null":
+		tpl.Layout = ""
+	default:
+		tpl.Layout = string(b.Layout)
+	}
+}
+
+// validateTemplate checks the template and that its system prompt renders.
+func validateTemplate(tpl *model.Template) error {
+	if err := tpl.Validate(); err != nil {
+		return err
+	}
+
+	_, err := ai.BuildSystemPrompt(ai.ScriptRequest{
+		Idea:         "idea",
+		Duration:     time.Minute,
+		SystemPrompt: tpl.SystemPrompt,
+	})
+	return err
+}
+
+func templateParam(c *gin.Context) (*model.Template, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return nil, false
+	}
+
+	tpl, err := model.GetTemplate(int64(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return tpl, true
+}
+
+func (s *Server) createTemplate(c *gin.Context) {
+	var binding templateBinding
+	if err := c.ShouldBindJSON(&binding); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	tpl := model.NewTemplate("")
+	binding.apply(tpl)
+	if err := validateTemplate(tpl); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := model.GetTemplateByName(tpl.Name); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Template name already exists"})
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tpl.Create(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := model.GetTemplate(tpl.Id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"data": created})
+}
+
+func (s *Server) updateTemplate(c *gin.Context) {
+	tpl, ok := templateParam(c)
+	if !ok {
+		return
+	}
+
+	var binding templateBinding
+	if err := c.ShouldBindJSON(&binding); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// movies refer to their template by name
+	if binding.Name != nil && *binding.Name != tpl.Name {
+		c.JSON(400, gin.H{"error": "Template name can not be changed"})
+		return
+	}
+
+	binding.apply(tpl)
+	if err := validateTemplate(tpl); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tpl.Update(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": tpl})
+}
+
+func (s *Server) deleteTemplate(c *gin.Context) {
+	tpl, ok := templateParam(c)
+	if !ok {
+		return
+	}
+
+	if tpl.Name == model.DefaultTemplateName {
+		c.JSON(http.StatusConflict, gin.H{"error": "The default template can not be deleted"})
+		return
+	}
+
+	if err := tpl.Delete(); errors.Is(err, model.ErrTemplateInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Template deleted"})
+}
@@ -1,5 +1,8 @@
 #!/usr/bin/env bash
 
+# runs against a live server, no AI keys needed when it uses the fake providers:
+#   mpu --work-dir /tmp/mpu server --listen-addr :8081 --fake-providers
+
 ENDPOTINT="http://localhost:8081"
 
 # make sure utils command exists
@@ -22,6 +25,20 @@ function POST() {
   curl -s -X POST "$ENDPOTINT/$1" -d "$2"
 }
 
+# wait for job $1 to finish, prints the final job body
+function WAIT_JOB() {
+  for _ in $(seq 1 60); do
+    job=$(GET "api/jobs/$1")
+    state=$(echo "$job" | jq -r '.data.state')
+    if [[ "$state" == "succeeded" || "$state" == "failed" ]]; then
+      echo "$job"
+      return
+    fi
+    sleep 1
+  done
+  echo "$job"
+}
+
 # display message in GREEN color function OK() { echo -e "\033[0;32m$1\033[0m" }
 function OK() {
   echo -e "\033[0;32m$1\033[0m"
@@ -56,7 +73,7 @@ function test_templates_list() {
   body=$(GET "api/templates")
 
   # first object in the response field name should be "sign"
-  if [[ $(echo "$body" | jq -r '.data.[0].name') == "sign" ]]; then
+  if [[ $(echo "$body" | jq -r '.data[0].name') == "sign" ]]; then
     OK "Templates list test passed."
   else
     FAIL "Templates list test failed. Response: $body"
@@ -129,16 +146,45 @@ function test_movie_generate_script() {
 
   POST_BODY='{"idea": "列出三个金牛女生的特点， 每一个加以扩展和说明"}'
   body=$(POST "api/movies/1/generate_script" "${POST_BODY}")
+  job=$(WAIT_JOB "$(echo "$body" | jq -r '.data.id')")
 
-  echo $body
+  if [[ $(echo "$job" | jq -r '.data.state') == "succeeded" ]] &&
+    [[ $(GET "api/movies/1" | jq -r '.data.state') == "scripted" ]]; then
+    OK "Movie generate script test passed."
+  else
+    FAIL "Movie generate script test failed. Response: $body $job"
+    exit 1
+  fi
+}
+
+function test_generate_script_voice() {
+  BLOCK "Testing movie generate script voice..."
+
+  body=$(POST "api/movies/1/generate_voice")
+  job=$(WAIT_JOB "$(echo "$body" | jq -r '.data.id')")
+
+  if [[ $(echo "$job" | jq -r '.data.state') == "succeeded" ]] &&
+    [[ $(GET "api/movies/1" | jq -r '.data.state') == "voiced" ]]; then
+    OK "Movie generate voice test passed."
+  else
+    FAIL "Movie generate voice test failed. Response: $body $job"
+    exit 1
+  fi
 }
 
 function test_generate_script_image() {
   BLOCK "Testing movie generate script image..."
 
   body=$(POST "api/movies/1/generate_image")
+  job=$(WAIT_JOB "$(echo "$body" | jq -r '.data.id')")
 
-  echo $body
+  if [[ $(echo "$job" | jq -r '.data.state') == "succeeded" ]] &&
+    [[ $(GET "api/movies/1" | jq -r '.data.state') == "illustrated" ]]; then
+    OK "Movie generate image test passed."
+  else
+    FAIL "Movie generate image test failed. Response: $body $job"
+    exit 1
+  fi
 }
 
 test_ping